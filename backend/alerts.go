@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// AlertRule is stored with its table and checked against every cell after
+// each refresh.  Every condition that is set has to hold, so they combine:
+// "desk under $100 posted in the last hour" is TitleRegex, PriceBelow and
+// PostedWithin together.
+type AlertRule struct {
+	ID   int    `json:"id"` // 0 for a new rule, which is given one
+	Name string `json:"name"`
+
+	// only look at one row or column, nil for all of them
+	Row *int `json:"row,omitempty"`
+	Col *int `json:"col,omitempty"`
+
+	// the cell found at least this many new listings
+	MinHits int `json:"minHits,omitempty"`
+
+	// conditions on each new listing
+	TitleRegex   string `json:"titleRegex,omitempty"`
+	PriceBelow   int    `json:"priceBelow,omitempty"`
+	PostedWithin string `json:"postedWithin,omitempty"` // a duration like 1h or 30m
+}
+
+// Alert is a rule matching in one cell at one refresh
+type Alert struct {
+	ID       int       `json:"id"`
+	RuleID   int       `json:"ruleId"`
+	RuleName string    `json:"ruleName"`
+	Time     time.Time `json:"time"`
+	Row      int       `json:"row"`
+	Col      int       `json:"col"`
+	Side     string    `json:"side"`
+	Top      string    `json:"top"`
+	Hits     int       `json:"hits"`
+	Listings []Listing `json:"listings"`
+}
+
+// a table keeps this many alerts, dropping the oldest
+var maxAlertHistory = 200
+
+func init() {
+	setRefreshListener("alerts", checkAlertRules)
+}
+
+// compiledAlertRule is an AlertRule ready to be checked
+type compiledAlertRule struct {
+	AlertRule
+	title        *regexp.Regexp
+	postedWithin time.Duration
+}
+
+func (r AlertRule) hasListingConditions() bool {
+	return r.TitleRegex != "" || r.PriceBelow > 0 || r.PostedWithin != ""
+}
+
+// compile checks the rule, returning every problem with it
+func (r AlertRule) compile() (compiledAlertRule, []string) {
+	c := compiledAlertRule{AlertRule: r}
+	var errs []string
+	where := fmt.Sprintf("rule %q", r.Name)
+
+	if r.MinHits <= 0 && !r.hasListingConditions() {
+		errs = append(errs, where+": needs at least one of minHits, titleRegex, priceBelow or postedWithin")
+	}
+	if r.MinHits < 0 || r.PriceBelow < 0 {
+		errs = append(errs, where+": minHits and priceBelow must not be negative")
+	}
+	if r.TitleRegex != "" {
+		title, err := regexp.Compile("(?i)" + r.TitleRegex)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: titleRegex: %v", where, err))
+		}
+		c.title = title
+	}
+	if r.PostedWithin != "" {
+		d, err := time.ParseDuration(r.PostedWithin)
+		if err != nil || d <= 0 {
+			errs = append(errs, fmt.Sprintf("%s: postedWithin %q should be a duration like 1h", where, r.PostedWithin))
+		}
+		c.postedWithin = d
+	}
+	return c, errs
+}
+
+// listingMatches checks the conditions on a single listing
+func (c compiledAlertRule) listingMatches(l Listing, now time.Time) bool {
+	if c.title != nil && !c.title.MatchString(l.Title) {
+		return false
+	}
+	if c.PriceBelow > 0 && (!l.HasPrice || l.Price >= c.PriceBelow) {
+		return false
+	}
+	if c.postedWithin > 0 && (l.Date.IsZero() || now.Sub(l.Date) > c.postedWithin) {
+		return false
+	}
+	return true
+}
+
+// match returns the alert for the rule in this cell, if there is one
+func (c compiledAlertRule) match(cell CellRefresh, now time.Time) (Alert, bool) {
+	if cell.FirstFetch || cell.Error != "" {
+		return Alert{}, false
+	}
+	if (c.Row != nil && *c.Row != cell.Row) || (c.Col != nil && *c.Col != cell.Col) {
+		return Alert{}, false
+	}
+	if c.MinHits > 0 && cell.Hits < c.MinHits {
+		return Alert{}, false
+	}
+
+	listings := cell.NewListings
+	if c.hasListingConditions() {
+		listings = []Listing{}
+		for _, l := range cell.NewListings {
+			if c.listingMatches(l, now) {
+				listings = append(listings, l)
+			}
+		}
+		if len(listings) == 0 {
+			return Alert{}, false
+		}
+	}
+
+	return Alert{
+		RuleID:   c.ID,
+		RuleName: c.Name,
+		Time:     now,
+		Row:      cell.Row,
+		Col:      cell.Col,
+		Side:     cell.Side,
+		Top:      cell.Top,
+		Hits:     cell.Hits,
+		Listings: listings,
+	}, true
+}
+
+// checkAlertRules is the refresh listener that records what the table's
+// rules match
+func checkAlertRules(r TableRefresh) {
+	tableModel, found := model.lookupTableModelByID(r.TableID)
+	if !found || len(tableModel.AlertRules) == 0 {
+		return
+	}
+
+	nextID := 1
+	if n := len(tableModel.AlertHistory); n > 0 {
+		nextID = tableModel.AlertHistory[n-1].ID + 1
+	}
+	matched := 0
+	for _, rule := range tableModel.AlertRules {
+		compiled, errs := rule.compile()
+		if len(errs) > 0 {
+			warnf("table %d: %s\n", r.TableID, strings.Join(errs, "; "))
+			continue
+		}
+		for _, cell := range r.Cells {
+			if alert, ok := compiled.match(cell, r.Time); ok {
+				alert.ID = nextID
+				nextID++
+				tableModel.AlertHistory = append(tableModel.AlertHistory, alert)
+				matched++
+			}
+		}
+	}
+	if matched == 0 {
+		return
+	}
+
+	printf("table %d: %d alerts\n", r.TableID, matched)
+	if extra := len(tableModel.AlertHistory) - maxAlertHistory; extra > 0 {
+		tableModel.AlertHistory = tableModel.AlertHistory[extra:]
+	}
+	writeTable(tableModel, r.TableID)
+}
+
+// updateAlertRules replaces a table's rules, giving new ones an ID.
+// Alerts point at their rule by ID, so no two rules can share one.
+func updateAlertRules(tableID int, rules []AlertRule) error {
+	var errs []string
+	maxID := 0
+	ids := map[int]bool{}
+	for i, rule := range rules {
+		if rule.ID < 0 {
+			errs = append(errs, fmt.Sprintf("rules[%d]: id %d must not be negative", i, rule.ID))
+		} else if rule.ID > 0 && ids[rule.ID] {
+			errs = append(errs, fmt.Sprintf("rules[%d]: id %d is used by another rule", i, rule.ID))
+		}
+		ids[rule.ID] = true
+		if strings.TrimSpace(rule.Name) == "" {
+			rules[i].Name = fmt.Sprintf("rule %d", i+1)
+		}
+		if _, ruleErrs := rules[i].compile(); len(ruleErrs) > 0 {
+			errs = append(errs, ruleErrs...)
+		}
+		if rule.ID > maxID {
+			maxID = rule.ID
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+
+	for i := range rules {
+		if rules[i].ID == 0 {
+			maxID++
+			rules[i].ID = maxID
+		}
+	}
+
+	tableModel := model.getTableModelByID(tableID)
+	tableModel.AlertRules = rules
+	writeTable(tableModel, tableID)
+	return nil
+}
+
+// alertHistory is a table's alerts newest first, optionally only those
+// after since and at most limit of them
+func alertHistory(tableID int, since time.Time, limit int) []Alert {
+	tableModel := model.getTableModelByID(tableID)
+	alerts := []Alert{}
+	for i := len(tableModel.AlertHistory) - 1; i >= 0; i-- {
+		a := tableModel.AlertHistory[i]
+		if !a.Time.After(since) || (limit > 0 && len(alerts) == limit) {
+			break
+		}
+		alerts = append(alerts, a)
+	}
+	return alerts
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_alertRule_conditionsCombine(t *testing.T) {
+	now := time.Date(2021, 1, 20, 12, 0, 0, 0, time.UTC)
+	cell := CellRefresh{Row: 0, Col: 1, Side: "desk", Top: "sfbay", Hits: 3, NewListings: []Listing{
+		{Title: "Oak DESK", Price: 80, HasPrice: true, Date: now.Add(-30 * time.Minute)},
+		{Title: "Pine desk", Price: 150, HasPrice: true, Date: now.Add(-10 * time.Minute)},
+		{Title: "Old desk", Price: 20, HasPrice: true, Date: now.Add(-3 * time.Hour)},
+		{Title: "Free desk"},
+	}}
+	row1 := 1
+
+	for _, tc := range []struct {
+		rule     AlertRule
+		expected []string
+	}{
+		{AlertRule{MinHits: 3}, []string{"Oak DESK", "Pine desk", "Old desk", "Free desk"}},
+		{AlertRule{MinHits: 4}, nil},
+		{AlertRule{TitleRegex: "oak|pine"}, []string{"Oak DESK", "Pine desk"}},
+		{AlertRule{PriceBelow: 100}, []string{"Oak DESK", "Old desk"}},
+		{AlertRule{PostedWithin: "1h"}, []string{"Oak DESK", "Pine desk"}},
+		{AlertRule{PriceBelow: 100, PostedWithin: "1h", MinHits: 2}, []string{"Oak DESK"}},
+		{AlertRule{TitleRegex: "chair"}, nil},
+		{AlertRule{MinHits: 1, Row: &row1}, nil},
+	} {
+		compiled, errs := tc.rule.compile()
+		if len(errs) > 0 {
+			t.Fatal(errs)
+		}
+		alert, ok := compiled.match(cell, now)
+		var titles []string
+		for _, l := range alert.Listings {
+			titles = append(titles, l.Title)
+		}
+		if ok != (tc.expected != nil) || strings.Join(titles, ",") != strings.Join(tc.expected, ",") {
+			t.Errorf("%+v: expected %v, got %v (%v)", tc.rule, tc.expected, titles, ok)
+		}
+	}
+
+	cell.FirstFetch = true
+	compiled, _ := AlertRule{MinHits: 1}.compile()
+	if _, ok := compiled.match(cell, now); ok {
+		t.Fatal("a cell's first fetch shouldn't alert")
+	}
+}
+
+func Test_alertRule_compileReportsProblems(t *testing.T) {
+	_, errs := AlertRule{Name: "x"}.compile()
+	if len(errs) != 1 {
+		t.Fatalf("a rule without conditions should be refused: %v", errs)
+	}
+	_, errs = AlertRule{Name: "x", TitleRegex: "(", PostedWithin: "soon"}.compile()
+	if len(errs) != 2 {
+		t.Fatalf("expected regex and duration errors: %v", errs)
+	}
+}
+
+func Test_api_alertrules_and_alerts(t *testing.T) {
+	stub := setUpStubTable(t, Listing{Title: "Oak desk", URL: "https://stub.example/1", Price: 300, HasPrice: true})
+
+	rec := postAPI("/api/alertrules", `{"tableId": 0, "rules": [{"name": "bad", "titleRegex": "("}]}`)
+	expectStatus(t, rec, http.StatusBadRequest)
+	for _, rules := range []string{
+		`[{"id": 3, "minHits": 1}, {"id": 3, "priceBelow": 100}]`,
+		`[{"id": -1, "minHits": 1}]`,
+	} {
+		rec = postAPI("/api/alertrules", `{"tableId": 0, "rules": `+rules+`}`)
+		expectStatus(t, rec, http.StatusBadRequest)
+		if !strings.Contains(rec.Body.String(), "rules[") {
+			t.Fatalf("the error should say which rule: %s", rec.Body.String())
+		}
+	}
+	if len(model.getTableModelByID(0).AlertRules) != 0 {
+		t.Fatal("refused rules shouldn't be saved")
+	}
+
+	rec = postAPI("/api/alertrules", `{"tableId": 0, "rules": [
+		{"name": "cheap", "priceBelow": 100},
+		{"titleRegex": "desk"}
+	]}`)
+	expectStatus(t, rec, http.StatusOK)
+	rules := model.getTableModelByID(0).AlertRules
+	if len(rules) != 2 || rules[0].ID != 1 || rules[1].ID != 2 || rules[1].Name != "rule 2" {
+		t.Fatalf("rules should get IDs and names: %+v", rules)
+	}
+
+	updateTableData(0) // first fetch
+	stub.listings = append(stub.listings,
+		Listing{Title: "Pine desk", URL: "https://stub.example/2", Price: 50, HasPrice: true})
+	updateTableData(0)
+	stub.listings = append(stub.listings,
+		Listing{Title: "Chair", URL: "https://stub.example/3", Price: 10, HasPrice: true})
+	updateTableData(0)
+
+	rec = postAPI("/api/alerts", `{"tableId": 0}`)
+	expectStatus(t, rec, http.StatusOK)
+	var alerts []Alert
+	if err := json.Unmarshal(rec.Body.Bytes(), &alerts); err != nil {
+		t.Fatal(err)
+	}
+	// pine desk matches both rules, the chair only the cheap one
+	if len(alerts) != 3 {
+		t.Fatalf("expected 3 alerts, got %+v", alerts)
+	}
+	if alerts[0].RuleName != "cheap" || alerts[0].Listings[0].Title != "Chair" || alerts[0].ID != 3 {
+		t.Fatalf("newest alert should be the cheap chair: %+v", alerts[0])
+	}
+
+	rec = postAPI("/api/alerts", `{"tableId": 0, "limit": 1}`)
+	json.Unmarshal(rec.Body.Bytes(), &alerts)
+	if len(alerts) != 1 {
+		t.Fatalf("limit not applied: %+v", alerts)
+	}
+
+	rec = postAPI("/api/alerts", `{"tableId": 7}`)
+	expectStatus(t, rec, http.StatusNotFound)
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+var defaultconfigpath = "craigsmatrix.yaml"
+
+// Config is everything that can be set in craigsmatrix.yaml.
+// Every setting can also be given as a flag or a CRAIGSMATRIX_* environment
+// variable.  Flags beat the environment, which beats the file.
+type Config struct {
+	Listen    string       `yaml:"listen"`
+	DataDir   string       `yaml:"dataDir"`
+	StaticDir string       `yaml:"staticDir"`
+	LogLevel  string       `yaml:"logLevel"`
+	Debug     bool         `yaml:"debug"`
+	Scrape    ScrapeConfig `yaml:"scrape"`
+
+	// Sources are extra places listings can come from besides craigslist.
+	// They can only be set in the file.
+	Sources []SourceConfig `yaml:"sources"`
+
+	Notify NotifyConfig `yaml:"notify"`
+	SMTP   SMTPConfig   `yaml:"smtp"`
+	Hooks  HooksConfig  `yaml:"hooks"`
+	MQTT   MQTTConfig   `yaml:"mqtt"`
+}
+
+// ScrapeConfig is the scrape: section of the config file
+type ScrapeConfig struct {
+	Timeout     duration `yaml:"timeout"`
+	Retries     int      `yaml:"retries"`
+	BackoffBase duration `yaml:"backoffBase"`
+	BackoffMax  duration `yaml:"backoffMax"`
+	CacheTTL    duration `yaml:"cacheTTL"`
+	RateLimit   int      `yaml:"rateLimit"`
+	RateBurst   int      `yaml:"rateBurst"`
+	RobotsTxt   bool     `yaml:"robotsTxt"`
+	UserAgent   string   `yaml:"userAgent"`
+	Proxies     []string `yaml:"proxies"`
+	ProxyRotate bool     `yaml:"proxyRotate"`
+
+	// where craigslist lives, {site} is replaced by the top heading
+	SiteURLTemplate string `yaml:"siteURLTemplate"`
+
+	// what the /api/ cell preview and the craigslist source are allowed to
+	// fetch, so they have to cover siteURLTemplate
+	PageAllowedHosts []string `yaml:"pageAllowedHosts"`
+	PageAllowedPaths []string `yaml:"pageAllowedPaths"`
+}
+
+// duration lets the config file say "3s" or "10m"
+type duration time.Duration
+
+func (d *duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+func (d duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+func defaultConfig() Config {
+	fetch := defaultFetchSettings()
+	polite := defaultPolitenessSettings()
+	pageProxy := defaultPageProxySettings()
+	return Config{
+		Listen:    ":8080",
+		DataDir:   "./data",
+		StaticDir: "",
+		LogLevel:  "info",
+		Scrape: ScrapeConfig{
+			Timeout:     duration(fetch.Timeout),
+			Retries:     fetch.MaxRetries,
+			BackoffBase: duration(fetch.BackoffBase),
+			BackoffMax:  duration(fetch.BackoffMax),
+			CacheTTL:    duration(10 * time.Minute),
+			RateLimit:   polite.RequestsPerMinute,
+			RateBurst:   polite.Burst,
+			RobotsTxt:   polite.RespectRobotsTxt,
+			UserAgent:   polite.UserAgent,
+
+			SiteURLTemplate: defaultCraigslistSiteURLTemplate,
+
+			PageAllowedHosts: pageProxy.AllowedHosts,
+			PageAllowedPaths: pageProxy.AllowedPaths,
+		},
+		Notify: defaultNotifyConfig(),
+		SMTP:   defaultSMTPConfig(),
+		Hooks:  defaultHooksConfig(),
+		MQTT:   defaultMQTTConfig(),
+	}
+}
+
+// configSetting ties a flag and an environment variable to a Config field
+type configSetting struct {
+	name  string
+	usage string
+	field func(c *Config) interface{}
+}
+
+var configSettings = []configSetting{
+	{"listen", "address to serve on", func(c *Config) interface{} { return &c.Listen }},
+	{"data-dir", "directory for themodel.json and the http cache", func(c *Config) interface{} { return &c.DataDir }},
+	{"static-dir", "serve the frontend from this directory instead of the copy built into the binary", func(c *Config) interface{} { return &c.StaticDir }},
+	{"log-level", "debug, info, warn or error", func(c *Config) interface{} { return &c.LogLevel }},
+	{"debug", "return canned results instead of fetching craigslist", func(c *Config) interface{} { return &c.Debug }},
+	{"fetch-timeout", "timeout for each request to craigslist", func(c *Config) interface{} { return &c.Scrape.Timeout }},
+	{"fetch-retries", "how many times to retry a failed request to craigslist", func(c *Config) interface{} { return &c.Scrape.Retries }},
+	{"fetch-backoff-base", "wait before the first retry, doubled for each one after", func(c *Config) interface{} { return &c.Scrape.BackoffBase }},
+	{"fetch-backoff-max", "longest wait between retries", func(c *Config) interface{} { return &c.Scrape.BackoffMax }},
+	{"cache-ttl", "how long a fetched page is reused without asking craigslist again", func(c *Config) interface{} { return &c.Scrape.CacheTTL }},
+	{"rate-limit", "requests per minute to each craigslist host", func(c *Config) interface{} { return &c.Scrape.RateLimit }},
+	{"rate-burst", "requests allowed at once before the rate limit kicks in", func(c *Config) interface{} { return &c.Scrape.RateBurst }},
+	{"robots-txt", "check robots.txt before fetching", func(c *Config) interface{} { return &c.Scrape.RobotsTxt }},
+	{"user-agent", "User-Agent sent to craigslist", func(c *Config) interface{} { return &c.Scrape.UserAgent }},
+	{"proxy", "comma separated HTTP or SOCKS5 proxies for scraping, e.g. socks5://localhost:1080", func(c *Config) interface{} { return &c.Scrape.Proxies }},
+	{"proxy-rotate", "rotate through the proxies on every request", func(c *Config) interface{} { return &c.Scrape.ProxyRotate }},
+	{"site-url-template", "where craigslist lives, {site} is replaced by the top heading", func(c *Config) interface{} { return &c.Scrape.SiteURLTemplate }},
+	{"page-allowed-hosts", "comma separated domains the cell preview may fetch from", func(c *Config) interface{} { return &c.Scrape.PageAllowedHosts }},
+	{"page-allowed-paths", "comma separated path prefixes the cell preview may fetch", func(c *Config) interface{} { return &c.Scrape.PageAllowedPaths }},
+	{"smtp-host", "mail server for digests, empty sends none", func(c *Config) interface{} { return &c.SMTP.Host }},
+	{"smtp-port", "mail server port", func(c *Config) interface{} { return &c.SMTP.Port }},
+	{"smtp-username", "mail server login", func(c *Config) interface{} { return &c.SMTP.Username }},
+	{"smtp-password", "mail server password", func(c *Config) interface{} { return &c.SMTP.Password }},
+	{"smtp-from", "address digests are sent from", func(c *Config) interface{} { return &c.SMTP.From }},
+	{"mqtt-broker", "MQTT broker to publish refreshes to, e.g. tcp://localhost:1883", func(c *Config) interface{} { return &c.MQTT.Broker }},
+	{"mqtt-username", "MQTT login", func(c *Config) interface{} { return &c.MQTT.Username }},
+	{"mqtt-password", "MQTT password", func(c *Config) interface{} { return &c.MQTT.Password }},
+	{"smtp-starttls", "refuse to send digests unless the mail server offers STARTTLS", func(c *Config) interface{} { return &c.SMTP.StartTLS }},
+	{"smtp-timeout", "give up on the mail server after this long", func(c *Config) interface{} { return &c.SMTP.Timeout }},
+}
+
+func (s configSetting) envName() string {
+	return "CRAIGSMATRIX_" + strings.ToUpper(strings.Replace(s.name, "-", "_", -1))
+}
+
+// setConfigField parses value into whatever field points at
+func setConfigField(field interface{}, value string) error {
+	switch f := field.(type) {
+	case *string:
+		*f = value
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		*f = n
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", value)
+		}
+		*f = b
+	case *duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration like 3s or 10m", value)
+		}
+		*f = duration(d)
+	case *[]string:
+		*f = nil
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*f = append(*f, item)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported setting type %T", field)
+	}
+	return nil
+}
+
+// settingFlag is a flag.Value that remembers the raw string, so flags can be
+// applied after the file and the environment have been read
+type settingFlag struct {
+	value  string
+	isBool bool
+}
+
+func (f *settingFlag) String() string     { return f.value }
+func (f *settingFlag) Set(v string) error { f.value = v; return nil }
+func (f *settingFlag) IsBoolFlag() bool   { return f.isBool }
+
+// loadConfig reads defaults, then the config file, then the environment,
+// then the command line flags in args
+func loadConfig(args []string) (Config, error) {
+	cfg := defaultConfig()
+
+	fs := flag.NewFlagSet("craigsmatrix", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("CRAIGSMATRIX_CONFIG"), "path to the config file (default "+defaultconfigpath+" if it exists)")
+	flags := map[string]*settingFlag{}
+	for _, s := range configSettings {
+		_, isBool := s.field(&cfg).(*bool)
+		flags[s.name] = &settingFlag{isBool: isBool}
+		fs.Var(flags[s.name], s.name, s.usage+" (env "+s.envName()+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	path := *configPath
+	if path == "" {
+		if _, err := os.Stat(defaultconfigpath); err == nil {
+			path = defaultconfigpath
+		}
+	}
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("config: %v", err)
+		}
+		if err := yaml.UnmarshalStrict(b, &cfg); err != nil {
+			return cfg, fmt.Errorf("config: %s: %v", path, err)
+		}
+	}
+
+	for _, s := range configSettings {
+		if value, ok := os.LookupEnv(s.envName()); ok {
+			if err := setConfigField(s.field(&cfg), value); err != nil {
+				return cfg, fmt.Errorf("config: %s: %v", s.envName(), err)
+			}
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range configSettings {
+			if s.name == f.Name && flagErr == nil {
+				if err := setConfigField(s.field(&cfg), flags[s.name].value); err != nil {
+					flagErr = fmt.Errorf("config: -%s: %v", s.name, err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return cfg, flagErr
+	}
+
+	if errs := cfg.validate(); len(errs) > 0 {
+		where := "config"
+		if path != "" {
+			where = "config " + path
+		}
+		return cfg, fmt.Errorf("%s:\n  %s", where, strings.Join(errs, "\n  "))
+	}
+	return cfg, nil
+}
+
+// validate returns one message per problem, so they can all be fixed at once
+func (c Config) validate() []string {
+	var errs []string
+	addErr := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, a...))
+	}
+
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		addErr("listen: %q should look like :8080 or 127.0.0.1:8080", c.Listen)
+	}
+	if c.DataDir == "" {
+		addErr("dataDir: must not be empty")
+	} else if info, err := os.Stat(c.DataDir); err == nil && !info.IsDir() {
+		addErr("dataDir: %s is not a directory", c.DataDir)
+	}
+	if c.StaticDir != "" {
+		if info, err := os.Stat(c.StaticDir); err != nil || !info.IsDir() {
+			addErr("staticDir: %s is not a directory", c.StaticDir)
+		}
+	}
+	if _, ok := logLevels[c.LogLevel]; !ok {
+		addErr("logLevel: %q should be one of debug, info, warn, error", c.LogLevel)
+	}
+
+	s := c.Scrape
+	if s.Timeout <= 0 {
+		addErr("scrape.timeout: must be positive")
+	}
+	if s.Retries < 0 {
+		addErr("scrape.retries: must not be negative")
+	}
+	if s.BackoffBase <= 0 || s.BackoffMax < s.BackoffBase {
+		addErr("scrape.backoffBase and scrape.backoffMax: need 0 < backoffBase <= backoffMax")
+	}
+	if s.CacheTTL < 0 {
+		addErr("scrape.cacheTTL: must not be negative")
+	}
+	if s.RateLimit < 0 {
+		addErr("scrape.rateLimit: must not be negative, 0 turns the limit off")
+	}
+	if s.RateBurst < 1 {
+		addErr("scrape.rateBurst: must be at least 1")
+	}
+	if strings.TrimSpace(s.UserAgent) == "" {
+		addErr("scrape.userAgent: must not be empty")
+	}
+	if !strings.Contains(s.SiteURLTemplate, "{site}") {
+		addErr("scrape.siteURLTemplate: %q must contain {site}", s.SiteURLTemplate)
+	}
+	if len(s.PageAllowedHosts) == 0 {
+		addErr("scrape.pageAllowedHosts: must list at least one domain")
+	}
+	if len(s.PageAllowedPaths) == 0 {
+		addErr("scrape.pageAllowedPaths: must list at least one path prefix")
+	}
+	for _, p := range s.Proxies {
+		if _, err := parseProxyURL(p); err != nil {
+			addErr("scrape.proxies: %v", err)
+		}
+	}
+
+	errs = append(errs, c.Notify.validate()...)
+	errs = append(errs, c.SMTP.validate()...)
+	errs = append(errs, c.Hooks.validate()...)
+	errs = append(errs, c.MQTT.validate()...)
+
+	names := map[string]bool{defaultSourceName: true}
+	for i, source := range c.Sources {
+		where := fmt.Sprintf("sources[%d]", i)
+		errs = append(errs, source.validate(where)...)
+		if source.Name != "" && names[source.Name] {
+			addErr("%s: name %q is already taken", where, source.Name)
+		}
+		names[source.Name] = true
+	}
+	return errs
+}
+
+// applyConfig copies the config into the globals the rest of the server uses
+func applyConfig(c Config) error {
+	if err := os.MkdirAll(c.DataDir, 0755); err != nil {
+		return fmt.Errorf("config: dataDir: %v", err)
+	}
+
+	listenAddress = c.Listen
+	staticDir = c.StaticDir
+	defaultmodelpath = filepath.Join(c.DataDir, "themodel.json")
+	defaulthttpcachedir = filepath.Join(c.DataDir, "httpcache")
+	defaulthttpcachettl = time.Duration(c.Scrape.CacheTTL)
+	debug = c.Debug
+	setLogLevel(c.LogLevel)
+
+	setFetchSettings(FetchSettings{
+		Timeout:     time.Duration(c.Scrape.Timeout),
+		MaxRetries:  c.Scrape.Retries,
+		BackoffBase: time.Duration(c.Scrape.BackoffBase),
+		BackoffMax:  time.Duration(c.Scrape.BackoffMax),
+	})
+	politenessSettings = PolitenessSettings{
+		RequestsPerMinute: c.Scrape.RateLimit,
+		Burst:             c.Scrape.RateBurst,
+		RespectRobotsTxt:  c.Scrape.RobotsTxt,
+		UserAgent:         c.Scrape.UserAgent,
+	}
+	proxySettings = ProxySettings{
+		URLs:   c.Scrape.Proxies,
+		Rotate: c.Scrape.ProxyRotate,
+	}
+	setCraigslistSiteURLTemplate(c.Scrape.SiteURLTemplate)
+	pageProxySettings = PageProxySettings{
+		AllowedHosts: c.Scrape.PageAllowedHosts,
+		AllowedPaths: c.Scrape.PageAllowedPaths,
+	}
+	setConfiguredSources(c.Sources)
+	setNotifier(newNotifier(c.Notify))
+	smtpSettings = c.SMTP
+	setHookRunner(newHookRunner(c.Hooks))
+	setMQTTPublisher(newMQTTPublisher(c.MQTT))
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestConfig(t *testing.T, contents string) (string, func()) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "craigsmatrix.yaml")
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func Test_loadConfig_exampleFileIsValid(t *testing.T) {
+	cfg, err := loadConfig([]string{"-config", "craigsmatrix.example.yaml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listen != ":8080" || time.Duration(cfg.Scrape.Timeout) != 3*time.Second {
+		t.Fatalf("example file not read: %+v", cfg)
+	}
+}
+
+func Test_loadConfig_flagsBeatEnvironmentBeatsFile(t *testing.T) {
+	path, cleanup := writeTestConfig(t, "listen: \":9000\"\nlogLevel: warn\nscrape:\n  timeout: 7s\n")
+	defer cleanup()
+
+	os.Setenv("CRAIGSMATRIX_LOG_LEVEL", "debug")
+	os.Setenv("CRAIGSMATRIX_FETCH_TIMEOUT", "9s")
+	defer os.Unsetenv("CRAIGSMATRIX_LOG_LEVEL")
+	defer os.Unsetenv("CRAIGSMATRIX_FETCH_TIMEOUT")
+
+	cfg, err := loadConfig([]string{"-config", path, "-fetch-timeout", "11s", "-robots-txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Listen != ":9000" {
+		t.Fatalf("listen should come from the file, got %q", cfg.Listen)
+	}
+	if cfg.LogLevel != "debug" {
+		t.Fatalf("logLevel should come from the environment, got %q", cfg.LogLevel)
+	}
+	if time.Duration(cfg.Scrape.Timeout) != 11*time.Second || !cfg.Scrape.RobotsTxt {
+		t.Fatalf("flags should win, got %+v", cfg.Scrape)
+	}
+}
+
+func Test_loadConfig_reportsEveryProblem(t *testing.T) {
+	path, cleanup := writeTestConfig(t, "listen: nonsense\nlogLevel: loud\nscrape:\n  rateBurst: 0\n  proxies: [\"ftp://x\"]\n")
+	defer cleanup()
+
+	_, err := loadConfig([]string{"-config", path})
+	if err == nil {
+		t.Fatalf("expected validation errors")
+	}
+	for _, want := range []string{"listen:", "logLevel:", "scrape.rateBurst:", "scrape.proxies:"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("error should mention %s:\n%v", want, err)
+		}
+	}
+}
+
+func Test_loadConfig_rejectsUnknownKeys(t *testing.T) {
+	path, cleanup := writeTestConfig(t, "listne: \":8080\"\n")
+	defer cleanup()
+
+	if _, err := loadConfig([]string{"-config", path}); err == nil || !strings.Contains(err.Error(), "listne") {
+		t.Fatalf("a misspelled key should be reported, got %v", err)
+	}
+}
@@ -2,37 +2,50 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"io/ioutil"
-	"log"
-	"math/rand"
 	"net/http"
+	"net/url"
 	"strings"
-	"time"
 
 	"golang.org/x/net/html"
 )
 
 
-func fetchCraigslistQuery(url string) string {
+func fetchCraigslistQuery(url string) (string, error) {
 	if debug == true {
 		return `<html><body><ul><li class="result-row" data-pid="6744258112">` +
-			` Wow cool ` + url + ` </li></ul></body></html>`
+			` Wow cool ` + url + ` </li></ul></body></html>`, nil
 	}
-	rawHTML, err := makeRequest(url)
+	rawHTML, _, err := makePageProxyRequest(url, pageProxySettings)
 	if err != nil {
-		return `<html><body><ul><li class="result-row" data-pid="6744258112">` +
-			` ERROR: ` + err.Error() + ` : ` + url + ` </li></ul></body></html>`
+		return "", err
 	}
 
-	return extractCraigslistResultRows(rawHTML)
+	var seen, newLinks []string
+	withModel(func() {
+		if cell, found := findCellByPageURL(url); found {
+			seen, newLinks = cell.LinksAlreadySeen, cell.NewLinks
+		}
+	})
+	return extractCraigslistResultRows(rawHTML, url, seen, newLinks), nil
 }
 
-func extractCraigslistResultRows(rawHTML string) string {
+// extractCraigslistResultRows returns the sanitized list of results from a
+// search page, with links made absolute against pageURL
+func extractCraigslistResultRows(rawHTML, pageURL string, seen, newLinks []string) string {
 
 	doc, _ := html.Parse(strings.NewReader(rawHTML))
-	resultRows, _ := getResultRows(doc)
+	resultRows, err := getResultRows(doc)
+	if err != nil {
+		return `<p class="craigsmatrix-empty">No results</p>`
+	}
+
+	base, _ := url.Parse(pageURL)
+	resultRows.Attr = sanitizeAttributes(resultRows, sanitizerAllowedElements["ul"], base)
+	sanitizeResultRows(resultRows, base, seen, newLinks)
 	return renderNode(resultRows)
 }
 
@@ -65,29 +78,47 @@ func renderNode(n *html.Node) string {
 	return buf.String()
 }
 
-func makeRequest(url string) (string, error) {
+// makeRequest fetches url, retrying failures that look temporary.
+// The status code of the last attempt is returned along with any *FetchError.
+func makeRequest(url string) (string, int, error) {
+	return fetchURL(context.Background(), url, nil)
+}
 
-	log.Print("makeRequest: sleep ... ")
-	r := rand.Intn(1000)
-	time.Sleep(time.Duration(r) * time.Millisecond)
+// fetchURL is makeRequest with a context for the requests and a
+// CheckRedirect for the client, nil for the default
+func fetchURL(ctx context.Context, url string, checkRedirect func(*http.Request, []*http.Request) error) (string, int, error) {
 
-	log.Printf("makeRequest: %s\n", url)
+	debugf("makeRequest: %s", url)
 
+	// The timeout starts at the network, not here, so a wait for the
+	// rate limiter isn't counted against it
+	ctx = withFetchTimeout(ctx, fetchSettings.Timeout)
 	client := http.Client{
-		Timeout: time.Duration(3 * time.Second),
+		Transport:     fetchTransport(),
+		CheckRedirect: checkRedirect,
 	}
-	resp, err := client.Get(url) //"https://httpbin.org/get"
 
-	//gracefully handle error with invalid craigslist URL
-	if err != nil {
-		log.Println("    TIMEOUT: " + url)
-		return "TIMEOUT", errors.New("TIMEOUT")
-	}
+	var body string
+	statusCode, err := withRetries(fetchSettings, func() (int, *FetchError) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return 0, &FetchError{Kind: FetchErrorClient, URL: url, Err: err}
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			warnf("makeRequest %s: %v", url, err)
+			return 0, classifyTransportError(url, err)
+		}
+		defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatalln(err)
-	}
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return resp.StatusCode, classifyTransportError(url, err)
+		}
+		body = string(b)
+
+		return resp.StatusCode, classifyResponse(url, resp, body)
+	})
 
-	return string(body), nil
+	return body, statusCode, err
 }
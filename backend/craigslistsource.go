@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// craigslistSource searches {top}.craigslist.org for side in the table's
+// category
+type craigslistSource struct{}
+
+func (craigslistSource) Name() string {
+	return "craigslist"
+}
+
+func (craigslistSource) QueryURL(side, top string, filters SourceFilters) string {
+	pageURL := makeCraigslistPageURL(side, top, filters.Category)
+	if pageURL == "" {
+		return ""
+	}
+	if filters.MinPrice > 0 {
+		pageURL += "&min_price=" + strconv.Itoa(filters.MinPrice)
+	}
+	if filters.MaxPrice > 0 {
+		pageURL += "&max_price=" + strconv.Itoa(filters.MaxPrice)
+	}
+	return pageURL
+}
+
+// Listings only fetches what the page proxy would, so a top heading can't
+// point it anywhere else
+func (craigslistSource) Listings(queryURL string) ([]Listing, error) {
+	if queryURL == "" {
+		return nil, fmt.Errorf("the top heading isn't a craigslist site name")
+	}
+	rawHTML, _, err := makePageProxyRequest(queryURL, pageProxySettings)
+	if err != nil {
+		return nil, err
+	}
+	return parseCraigslistListings(rawHTML, queryURL), nil
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// Email digests: refreshes queue their new listings on the table, and on
+// the table's schedule they're mailed to its recipients and the queue is
+// emptied.
+
+// SMTPConfig is the smtp: section of the config file
+type SMTPConfig struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	From     string `yaml:"from"`
+	// StartTLS refuses to send unless the server upgrades the connection
+	StartTLS bool `yaml:"startTLS"`
+	// Timeout is for the whole conversation with the server, dial to QUIT
+	Timeout duration `yaml:"timeout"`
+}
+
+func defaultSMTPConfig() SMTPConfig {
+	return SMTPConfig{Port: 587, StartTLS: true, Timeout: duration(30 * time.Second)}
+}
+
+// validate returns one message per problem.  No host means no email.
+func (c SMTPConfig) validate() []string {
+	var errs []string
+	if c.Host == "" {
+		return errs
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		errs = append(errs, fmt.Sprintf("smtp.port: %d is not a port", c.Port))
+	}
+	if c.Timeout <= 0 {
+		errs = append(errs, "smtp.timeout: must be positive")
+	}
+	if !strings.Contains(c.From, "@") {
+		errs = append(errs, fmt.Sprintf("smtp.from: %q should be an email address", c.From))
+	}
+	return errs
+}
+
+var smtpSettings = defaultSMTPConfig()
+
+// DigestSettings are a table's digest recipients and schedule, and the
+// listings waiting to go out
+type DigestSettings struct {
+	Recipients []string      `json:"recipients,omitempty"`
+	Schedule   string        `json:"schedule"` // "", "hourly" or "daily 07:30"
+	LastSent   time.Time     `json:"lastSent"`
+	Pending    []DigestEntry `json:"pending,omitempty"`
+}
+
+// DigestEntry is one listing waiting for the next digest
+type DigestEntry struct {
+	Row     int       `json:"row"`
+	Col     int       `json:"col"`
+	Side    string    `json:"side"`
+	Top     string    `json:"top"`
+	PageURL string    `json:"pageUrl"`
+	Found   time.Time `json:"found"`
+	Listing Listing   `json:"listing"`
+}
+
+// digestEntryKey tells queued entries apart: the same listing can be
+// queued by two cells, or by one cell on two refreshes
+type digestEntryKey struct {
+	Row, Col int
+	URL      string
+	Found    int64
+}
+
+func (e DigestEntry) key() digestEntryKey {
+	return digestEntryKey{e.Row, e.Col, e.Listing.URL, e.Found.UnixNano()}
+}
+
+// the queue is trimmed to the newest entries beyond this
+var maxPendingDigestEntries = 500
+
+var digestHTMLTemplate = htmltemplate.Must(htmltemplate.ParseFS(templateFiles, "templates/digest_email.html"))
+var digestTextTemplate = texttemplate.Must(texttemplate.ParseFS(templateFiles, "templates/digest_email.txt"))
+
+func init() {
+	setRefreshListener("digest", queueForDigest)
+}
+
+// parseDigestSchedule checks a schedule, returning the time of day for
+// daily ones
+func parseDigestSchedule(schedule string) (hour, minute int, err error) {
+	fields := strings.Fields(schedule)
+	switch {
+	case len(fields) == 0, len(fields) == 1 && fields[0] == "hourly":
+		return 0, 0, nil
+	case len(fields) == 2 && fields[0] == "daily":
+		t, err := time.Parse("15:04", fields[1])
+		if err != nil {
+			break
+		}
+		return t.Hour(), t.Minute(), nil
+	}
+	return 0, 0, fmt.Errorf("schedule %q should be empty, hourly or daily HH:MM", schedule)
+}
+
+// nextDigestTime is when the digest after one sent at last is due.
+// The zero time means never.
+func nextDigestTime(schedule string, last time.Time) time.Time {
+	hour, minute, err := parseDigestSchedule(schedule)
+	if err != nil || strings.TrimSpace(schedule) == "" {
+		return time.Time{}
+	}
+	if strings.TrimSpace(schedule) == "hourly" {
+		return last.Add(time.Hour)
+	}
+	last = last.Local()
+	next := time.Date(last.Year(), last.Month(), last.Day(), hour, minute, 0, 0, time.Local)
+	if !next.After(last) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// queueForDigest is the refresh listener that keeps each table's queue
+func queueForDigest(r TableRefresh) {
+	tableModel, found := model.lookupTableModelByID(r.TableID)
+	if !found || len(tableModel.Digest.Recipients) == 0 || r.newListingCount() == 0 {
+		return
+	}
+
+	for _, c := range r.cellsWithNewListings() {
+		for _, l := range c.NewListings {
+			tableModel.Digest.Pending = append(tableModel.Digest.Pending, DigestEntry{
+				Row: c.Row, Col: c.Col, Side: c.Side, Top: c.Top, PageURL: c.PageURL,
+				Found: r.Time, Listing: l,
+			})
+		}
+	}
+	if extra := len(tableModel.Digest.Pending) - maxPendingDigestEntries; extra > 0 {
+		tableModel.Digest.Pending = tableModel.Digest.Pending[extra:]
+	}
+	writeTable(tableModel, r.TableID)
+}
+
+// updateTableDigest sets who gets a table's digest and when
+func updateTableDigest(tableID int, recipients []string, schedule string) error {
+	if _, _, err := parseDigestSchedule(schedule); err != nil {
+		return err
+	}
+	var cleaned []string
+	for _, r := range recipients {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		if !strings.Contains(r, "@") {
+			return fmt.Errorf("%q is not an email address", r)
+		}
+		cleaned = append(cleaned, r)
+	}
+
+	tableModel := model.getTableModelByID(tableID)
+	tableModel.Digest.Recipients = cleaned
+	tableModel.Digest.Schedule = strings.TrimSpace(schedule)
+	if tableModel.Digest.LastSent.IsZero() {
+		// start counting from now rather than sending straight away
+		tableModel.Digest.LastSent = time.Now()
+	}
+	writeTable(tableModel, tableID)
+	return nil
+}
+
+// digestSection is the listings of one cell in a digest
+type digestSection struct {
+	Side     string
+	Top      string
+	PageURL  string
+	Listings []Listing
+}
+
+type digestData struct {
+	Subject   string
+	TableName string
+	Sections  []digestSection
+}
+
+func makeDigestData(tableModel TableModel) digestData {
+	entries := append([]DigestEntry{}, tableModel.Digest.Pending...)
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Row != entries[j].Row {
+			return entries[i].Row < entries[j].Row
+		}
+		return entries[i].Col < entries[j].Col
+	})
+
+	data := digestData{TableName: strings.TrimSpace(tableModel.Name)}
+	for _, e := range entries {
+		n := len(data.Sections)
+		if n == 0 || data.Sections[n-1].Side != e.Side || data.Sections[n-1].Top != e.Top {
+			data.Sections = append(data.Sections, digestSection{Side: e.Side, Top: e.Top, PageURL: e.PageURL})
+			n++
+		}
+		data.Sections[n-1].Listings = append(data.Sections[n-1].Listings, e.Listing)
+	}
+
+	plural := "s"
+	if len(entries) == 1 {
+		plural = ""
+	}
+	data.Subject = fmt.Sprintf("%d new listing%s in %s", len(entries), plural, data.TableName)
+	return data
+}
+
+// digestBatch is a table's queue as it was when its digest was started
+type digestBatch struct {
+	TableID    int
+	Recipients []string
+	Entries    []DigestEntry
+	Data       digestData
+}
+
+// startTableDigest takes a copy of the table's queue to mail.  The model
+// has to be locked.
+func startTableDigest(tableModel TableModel) (digestBatch, error) {
+	if len(tableModel.Digest.Recipients) == 0 {
+		return digestBatch{}, fmt.Errorf("table %d has no digest recipients", tableModel.ID)
+	}
+	return digestBatch{
+		TableID:    tableModel.ID,
+		Recipients: append([]string{}, tableModel.Digest.Recipients...),
+		Entries:    append([]DigestEntry{}, tableModel.Digest.Pending...),
+		Data:       makeDigestData(tableModel),
+	}, nil
+}
+
+// mail sends the batch, if there's anything in it.  It doesn't touch the
+// model, so it can run unlocked.
+func (b digestBatch) mail() error {
+	if len(b.Entries) == 0 {
+		return nil
+	}
+	var text, html bytes.Buffer
+	if err := digestTextTemplate.Execute(&text, b.Data); err != nil {
+		return err
+	}
+	if err := digestHTMLTemplate.Execute(&html, b.Data); err != nil {
+		return err
+	}
+	if err := sendMail(smtpSettings, b.Recipients, b.Data.Subject, text.String(), html.String()); err != nil {
+		return err
+	}
+	printf("digest: mailed %d listings of table %d to %s\n", len(b.Entries), b.TableID, strings.Join(b.Recipients, ", "))
+	return nil
+}
+
+// finishTableDigest takes the mailed entries off the table's queue.  The
+// table may have been refreshed, trimmed or deleted while the mail went
+// out, so entries are matched rather than counted.  The model has to be
+// locked.
+func finishTableDigest(b digestBatch) {
+	tableModel, found := model.lookupTableModelByID(b.TableID)
+	if !found {
+		return
+	}
+	sent := map[digestEntryKey]bool{}
+	for _, e := range b.Entries {
+		sent[e.key()] = true
+	}
+	pending := []DigestEntry{}
+	for _, e := range tableModel.Digest.Pending {
+		if !sent[e.key()] {
+			pending = append(pending, e)
+		}
+	}
+	tableModel.Digest.Pending = pending
+	tableModel.Digest.LastSent = time.Now()
+	writeTable(tableModel, b.TableID)
+}
+
+// sendTableDigest mails the table's queue now.  The queue is only emptied
+// once the mail has gone.  Like sendDueDigests it locks the model itself,
+// but not while mail is going out.
+func sendTableDigest(tableID int) (int, error) {
+	var b digestBatch
+	var err error
+	withModel(func() {
+		b, err = startTableDigest(model.getTableModelByID(tableID))
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := b.mail(); err != nil {
+		return 0, err
+	}
+	withModel(func() {
+		finishTableDigest(b)
+	})
+	return len(b.Entries), nil
+}
+
+// sendDueDigests sends every digest whose time has come.  It locks the
+// model itself, but not while mail is going out.
+func sendDueDigests(now time.Time) {
+	var batches []digestBatch
+	modelMu.Lock()
+	for _, tableModel := range model.TableModels {
+		d := tableModel.Digest
+		next := nextDigestTime(d.Schedule, d.LastSent)
+		if len(d.Recipients) == 0 || next.IsZero() || now.Before(next) {
+			continue
+		}
+		if b, err := startTableDigest(tableModel); err == nil {
+			batches = append(batches, b)
+		}
+	}
+	modelMu.Unlock()
+
+	for _, b := range batches {
+		if err := b.mail(); err != nil {
+			errorf("digest for table %d: %v\n", b.TableID, err)
+			continue
+		}
+		modelMu.Lock()
+		finishTableDigest(b)
+		modelMu.Unlock()
+	}
+}
+
+// startDigestScheduler checks for due digests every interval.  A panic
+// is logged and the next tick tries again.
+func startDigestScheduler(interval time.Duration) {
+	go func() {
+		for now := range time.Tick(interval) {
+			sendDueDigestsSafely(now)
+		}
+	}()
+}
+
+func sendDueDigestsSafely(now time.Time) {
+	defer func() {
+		if r := recover(); r != nil {
+			errorf("digest: %v\n", r)
+		}
+	}()
+	sendDueDigests(now)
+}
+
+// buildDigestMessage is a multipart/alternative mail with the text and
+// html bodies
+func buildDigestMessage(from string, to []string, subject, text, html string) ([]byte, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", text},
+		{"text/html; charset=utf-8", html},
+	} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		qp.Write([]byte(part.content))
+		qp.Close()
+	}
+	mw.Close()
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%d.craigsmatrix@%s>\r\n", time.Now().UnixNano(), mailDomain(from))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+func mailDomain(address string) string {
+	return strings.Trim(address[strings.LastIndex(address, "@")+1:], "<> ")
+}
+
+// sendMail sends over SMTP, upgrading with STARTTLS and logging in when
+// the settings ask for it
+func sendMail(s SMTPConfig, to []string, subject, text, html string) error {
+	if s.Host == "" {
+		return fmt.Errorf("no smtp.host is configured")
+	}
+	msg, err := buildDigestMessage(s.From, to, subject, text, html)
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+	timeout := time.Duration(s.Timeout)
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return err
+	}
+	c, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Hello("localhost"); err != nil {
+		return err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: s.Host}); err != nil {
+			return err
+		}
+	} else if s.StartTLS {
+		return fmt.Errorf("%s doesn't offer STARTTLS, set smtp.startTLS false to send anyway", addr)
+	}
+	if s.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(s.From); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smtpCatcher is a stand-in mail server that keeps what it's sent
+type smtpCatcher struct {
+	listener net.Listener
+	mu       sync.Mutex
+	auth     []string
+	rcpts    []string
+	messages []string
+	wg       sync.WaitGroup
+}
+
+func startSMTPCatcher(t *testing.T) *smtpCatcher {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &smtpCatcher{listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.wg.Add(1)
+			go c.serve(conn)
+		}
+	}()
+	return c
+}
+
+func (c *smtpCatcher) Close() {
+	c.listener.Close()
+	c.wg.Wait()
+}
+
+func (c *smtpCatcher) settings() SMTPConfig {
+	host, port, _ := net.SplitHostPort(c.listener.Addr().String())
+	n, _ := strconv.Atoi(port)
+	return SMTPConfig{Host: host, Port: n, From: "matrix@example.com", Username: "me", Password: "pw", Timeout: duration(5 * time.Second)}
+}
+
+func (c *smtpCatcher) serve(conn net.Conn) {
+	defer c.wg.Done()
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+
+	reply("220 catcher ready")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.Fields(line + " x")[0])
+		c.mu.Lock()
+		switch verb {
+		case "EHLO":
+			reply("250-catcher\r\n250 AUTH PLAIN")
+		case "AUTH":
+			decoded, _ := base64.StdEncoding.DecodeString(strings.Fields(line)[2])
+			c.auth = append(c.auth, string(decoded))
+			reply("235 ok")
+		case "MAIL":
+			reply("250 ok")
+		case "RCPT":
+			c.rcpts = append(c.rcpts, line)
+			reply("250 ok")
+		case "DATA":
+			reply("354 go on")
+			var msg strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil || l == ".\r\n" {
+					break
+				}
+				msg.WriteString(strings.TrimPrefix(l, "."))
+			}
+			c.messages = append(c.messages, msg.String())
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			c.mu.Unlock()
+			return
+		default:
+			reply("250 ok")
+		}
+		c.mu.Unlock()
+	}
+}
+
+// digestParts pulls the text and html bodies out of a caught message
+func digestParts(t *testing.T, raw string) (*mail.Message, string, string) {
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var text, html string
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		b, _ := ioutil.ReadAll(part) // quoted-printable is decoded by NextPart
+		if strings.HasPrefix(part.Header.Get("Content-Type"), "text/html") {
+			html = string(b)
+		} else {
+			text = string(b)
+		}
+	}
+	return msg, text, html
+}
+
+func Test_nextDigestTime(t *testing.T) {
+	last := time.Date(2021, 1, 20, 8, 0, 0, 0, time.Local)
+	if got := nextDigestTime("daily 07:30", last); !got.Equal(time.Date(2021, 1, 21, 7, 30, 0, 0, time.Local)) {
+		t.Fatalf("daily after its time should be tomorrow, got %v", got)
+	}
+	if got := nextDigestTime("daily 09:15", last); !got.Equal(time.Date(2021, 1, 20, 9, 15, 0, 0, time.Local)) {
+		t.Fatalf("daily before its time should be today, got %v", got)
+	}
+	if got := nextDigestTime("hourly", last); !got.Equal(last.Add(time.Hour)) {
+		t.Fatalf("hourly should be an hour on, got %v", got)
+	}
+	if !nextDigestTime("", last).IsZero() || !nextDigestTime("weekly", last).IsZero() {
+		t.Fatal("no schedule should never be due")
+	}
+	if _, _, err := parseDigestSchedule("daily 25:00"); err == nil {
+		t.Fatal("expected an error for a bad time")
+	}
+}
+
+func Test_digest_queuesNewListings_andMailsThemGrouped(t *testing.T) {
+	stub := setUpStubTable(t, Listing{Title: "Oak desk", URL: "https://stub.example/1"})
+	addSideField(0)
+	editTableModelField(0, 1, "chair", "side")
+	updateTableName("Furniture")
+
+	catcher := startSMTPCatcher(t)
+	defer catcher.Close()
+	smtpSettings = catcher.settings()
+	defer func() { smtpSettings = defaultSMTPConfig() }()
+
+	rec := postAPI("/api/updatedigest", `{"tableId": 0, "recipients": ["a@example.com", " b@example.com "], "schedule": "daily 07:00"}`)
+	expectStatus(t, rec, http.StatusOK)
+
+	updateTableData(0) // first fetch, nothing queued
+	stub.listings = append(stub.listings, Listing{Title: "Pine <desk>", URL: "https://stub.example/2", Price: 60, HasPrice: true})
+	updateTableData(0)
+
+	tableModel := model.getTableModelByID(0)
+	if len(tableModel.Digest.Pending) != 2 {
+		t.Fatalf("both cells should have queued the pine desk: %+v", tableModel.Digest.Pending)
+	}
+
+	// not due yet
+	sendDueDigests(time.Now())
+	if len(catcher.messages) != 0 {
+		t.Fatal("digest sent before its time")
+	}
+	sendDueDigests(time.Now().Add(25 * time.Hour))
+	if len(catcher.messages) != 1 {
+		t.Fatalf("expected one digest, got %d", len(catcher.messages))
+	}
+
+	if len(catcher.rcpts) != 2 || !strings.Contains(catcher.rcpts[1], "b@example.com") {
+		t.Fatalf("wrong recipients %v", catcher.rcpts)
+	}
+	if len(catcher.auth) != 1 || catcher.auth[0] != "\x00me\x00pw" {
+		t.Fatalf("expected AUTH PLAIN as me, got %q", catcher.auth)
+	}
+
+	msg, text, html := digestParts(t, catcher.messages[0])
+	if msg.Header.Get("Subject") != "2 new listings in Furniture" {
+		t.Fatalf("subject %q", msg.Header.Get("Subject"))
+	}
+	if !strings.Contains(text, "SideHeading in TopHeading") || !strings.Contains(text, "chair in TopHeading") ||
+		strings.Index(text, "SideHeading in") > strings.Index(text, "chair in") || !strings.Contains(text, "Pine <desk> $60") {
+		t.Fatalf("text part not grouped by row:\n%s", text)
+	}
+	if !strings.Contains(html, "Pine &lt;desk&gt;") || !strings.Contains(html, `href="https://stub.example/2"`) {
+		t.Fatalf("html part not escaped or linked:\n%s", html)
+	}
+
+	tableModel = model.getTableModelByID(0)
+	if len(tableModel.Digest.Pending) != 0 {
+		t.Fatal("a sent digest should empty the queue")
+	}
+}
+
+func Test_sendTableDigest_keepsQueueWhenMailFails(t *testing.T) {
+	resetModelForAPITest()
+	if err := updateTableDigest(0, []string{"a@example.com"}, "hourly"); err != nil {
+		t.Fatal(err)
+	}
+	tableModel := model.getTableModelByID(0)
+	tableModel.Digest.Pending = []DigestEntry{{Side: "desk", Top: "sfbay", Listing: Listing{Title: "Oak desk"}}}
+	writeTable(tableModel, 0)
+
+	smtpSettings = SMTPConfig{Host: "127.0.0.1", Port: 1, From: "matrix@example.com", Timeout: duration(time.Second)}
+	defer func() { smtpSettings = defaultSMTPConfig() }()
+
+	rec := postAPI("/api/senddigest", `{"tableId": 0}`)
+	expectStatus(t, rec, http.StatusBadGateway)
+	if len(model.getTableModelByID(0).Digest.Pending) != 1 {
+		t.Fatal("the queue should survive a failed send")
+	}
+
+	rec = postAPI("/api/updatedigest", `{"tableId": 0, "recipients": ["nobody"], "schedule": "hourly"}`)
+	expectStatus(t, rec, http.StatusBadRequest)
+}
+
+func Test_sendMail_requiresSTARTTLSWhenAsked(t *testing.T) {
+	catcher := startSMTPCatcher(t)
+	defer catcher.Close()
+
+	s := catcher.settings()
+	s.StartTLS = true
+	err := sendMail(s, []string{"a@example.com"}, "hi", "text", "<p>html</p>")
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Fatalf("expected a STARTTLS error, got %v", err)
+	}
+}
+
+func Test_sendMail_givesUpOnASilentServer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		// accept and never send a greeting
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(2 * time.Second)
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	n, _ := strconv.Atoi(port)
+	s := SMTPConfig{Host: host, Port: n, From: "matrix@example.com", Timeout: duration(100 * time.Millisecond)}
+
+	start := time.Now()
+	err = sendMail(s, []string{"a@example.com"}, "hi", "text", "<p>html</p>")
+	if err == nil {
+		t.Fatal("expected a timeout")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("sendMail should give up after its timeout, took %v", elapsed)
+	}
+}
+
+func queueTestDigest(t *testing.T, titles ...string) {
+	tableModel := model.getTableModelByID(0)
+	for _, title := range titles {
+		tableModel.Digest.Pending = append(tableModel.Digest.Pending, DigestEntry{
+			Side: "desk", Top: "sfbay", Found: time.Now(), Listing: Listing{Title: title, URL: "https://stub.example/" + title},
+		})
+	}
+	writeTable(tableModel, 0)
+}
+
+func Test_finishTableDigest_onlyRemovesWhatWasSent(t *testing.T) {
+	resetModelForAPITest()
+	if err := updateTableDigest(0, []string{"a@example.com"}, "hourly"); err != nil {
+		t.Fatal(err)
+	}
+	queueTestDigest(t, "one", "two")
+	b, err := startTableDigest(model.getTableModelByID(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// while the mail goes out, a refresh queues more and the queue is trimmed
+	defer func(max int) { maxPendingDigestEntries = max }(maxPendingDigestEntries)
+	maxPendingDigestEntries = 2
+	queueTestDigest(t, "three")
+	tableModel := model.getTableModelByID(0)
+	tableModel.Digest.Pending = tableModel.Digest.Pending[1:]
+	writeTable(tableModel, 0)
+
+	finishTableDigest(b)
+	pending := model.getTableModelByID(0).Digest.Pending
+	if len(pending) != 1 || pending[0].Listing.Title != "three" {
+		t.Fatalf("only the unsent listing should be left: %+v", pending)
+	}
+}
+
+func Test_finishTableDigest_skipsDeletedTables(t *testing.T) {
+	resetModelForAPITest()
+	addTable()
+	id := model.ActiveTableModelID
+	if err := updateTableDigest(id, []string{"a@example.com"}, "hourly"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := startTableDigest(model.getTableModelByID(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleteTable()
+
+	finishTableDigest(b)
+	if _, found := model.lookupTableModelByID(id); found || len(model.TableModels) != 1 {
+		t.Fatalf("the deleted table shouldn't come back: %+v", model.TableModels)
+	}
+}
+
+func Test_sendDueDigests_whileRequestsChangeTheModel(t *testing.T) {
+	resetModelForAPITest()
+	if err := updateTableDigest(0, []string{"a@example.com"}, "hourly"); err != nil {
+		t.Fatal(err)
+	}
+	queueTestDigest(t, "one")
+
+	catcher := startSMTPCatcher(t)
+	defer catcher.Close()
+	smtpSettings = catcher.settings()
+	defer func() { smtpSettings = defaultSMTPConfig() }()
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 20; i++ {
+			postAPI("/api/updatetablename", `{"name": "Furniture `+strconv.Itoa(i)+`"}`)
+			postAPI("/api/addtable", `{}`)
+			postAPI("/api/deletetable", `{}`)
+		}
+		close(done)
+	}()
+	sendDueDigestsSafely(time.Now().Add(2 * time.Hour))
+	<-done
+
+	if len(catcher.messages) != 1 || len(model.getTableModelByID(0).Digest.Pending) != 0 {
+		t.Fatalf("expected the digest sent and the queue emptied, got %d messages", len(catcher.messages))
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Spreadsheet exports of a table, or of every table when the id is left
+// off:
+//
+//	/export/csv/matrix/:id     hits, side headings down and top headings across
+//	/export/csv/listings/:id   one row per listing a cell found
+//
+// and the same under /export/xlsx/, where each table gets its own worksheet.
+
+func addExportRoutes(router *httprouter.Router) {
+	router.GET("/export/:format/:kind", lockModel(exportHandler))
+	router.GET("/export/:format/:kind/:id", lockModel(exportHandler))
+}
+
+// exportSheet is a table's worth of cells, each a string or an int
+type exportSheet struct {
+	Name string
+	Rows [][]interface{}
+}
+
+// matrixSheet is the hit count of every cell, with the table name in the
+// corner
+func matrixSheet(tableModel TableModel) exportSheet {
+	header := []interface{}{strings.TrimSpace(tableModel.Name)}
+	for _, top := range tableModel.TopHeadings {
+		header = append(header, top)
+	}
+	sheet := exportSheet{Name: tableModel.Name, Rows: [][]interface{}{header}}
+	for i, side := range tableModel.SideHeadings {
+		row := []interface{}{side}
+		for j := range tableModel.TopHeadings {
+			hits := 0
+			if i < len(tableModel.Rows) && j < len(tableModel.Rows[i]) {
+				hits = tableModel.Rows[i][j].Hits
+			}
+			row = append(row, hits)
+		}
+		sheet.Rows = append(sheet.Rows, row)
+	}
+	return sheet
+}
+
+var listingsSheetHeader = []interface{}{"table", "row", "column", "title", "url", "price", "posted", "first seen", "state"}
+
+// listingsSheet is every listing the table's cells remember, one per row.
+// A listing is new if the last refresh of its cell found it, seen if an
+// earlier one did.
+func listingsSheet(tableModel TableModel) exportSheet {
+	sheet := exportSheet{Name: tableModel.Name, Rows: [][]interface{}{listingsSheetHeader}}
+	for i, side := range tableModel.SideHeadings {
+		for j, top := range tableModel.TopHeadings {
+			if i >= len(tableModel.Rows) || j >= len(tableModel.Rows[i]) {
+				continue
+			}
+			cell := tableModel.Rows[i][j]
+			for _, l := range cell.Recent {
+				var price interface{} = ""
+				if l.HasPrice {
+					price = l.Price
+				}
+				state := "seen"
+				if sliceContains(cell.NewLinks, l.URL) {
+					state = "new"
+				}
+				sheet.Rows = append(sheet.Rows, []interface{}{
+					strings.TrimSpace(tableModel.Name), side, top,
+					l.Title, l.URL, price, formatExportTime(l.Posted), formatExportTime(l.FirstSeen), state,
+				})
+			}
+		}
+	}
+	return sheet
+}
+
+func formatExportTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
+
+// csvSafe keeps a spreadsheet from taking text, like a listing title of
+// "=HYPERLINK(...)", for a formula
+func csvSafe(s string) string {
+	if s != "" && strings.ContainsAny(s[:1], "=+-@\t\r") {
+		return "'" + s
+	}
+	return s
+}
+
+// writeCSV puts the sheets one after the other.  Listings sheets share a
+// header, so only the first is written; matrices are kept apart by an
+// empty line.
+func writeCSV(sheets []exportSheet, kind string) ([]byte, error) {
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	for n, sheet := range sheets {
+		rows := sheet.Rows
+		if n > 0 && kind == "listings" {
+			rows = rows[1:]
+		} else if n > 0 {
+			w.Write(nil)
+		}
+		for _, row := range rows {
+			record := make([]string, len(row))
+			for i, v := range row {
+				record[i] = fmt.Sprint(v)
+				if _, isText := v.(string); isText {
+					record[i] = csvSafe(record[i])
+				}
+			}
+			if err := w.Write(record); err != nil {
+				return nil, err
+			}
+		}
+	}
+	w.Flush()
+	return b.Bytes(), w.Error()
+}
+
+// xlsxSheetName makes name fit Excel's rules for worksheet names: at most
+// 31 characters, none of []:*?/\ and no two the same
+func xlsxSheetName(name string, used map[string]bool) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(name))
+	name = strings.Trim(name, "'")
+	if name == "" {
+		name = "Sheet"
+	}
+	base := []rune(name)
+	for n := 1; ; n++ {
+		candidate := string(base)
+		if n > 1 {
+			suffix := fmt.Sprintf(" (%d)", n)
+			candidate = string(truncateRunes(base, 31-len(suffix))) + suffix
+		}
+		candidate = string(truncateRunes([]rune(candidate), 31))
+		if !used[strings.ToLower(candidate)] {
+			used[strings.ToLower(candidate)] = true
+			return candidate
+		}
+	}
+}
+
+func truncateRunes(r []rune, n int) []rune {
+	if len(r) > n {
+		return r[:n]
+	}
+	return r
+}
+
+// xlsxColumn is the letters of column i, counting from 0: A, B, ... AA
+func xlsxColumn(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func xlsxWorksheet(sheet exportSheet) string {
+	var b strings.Builder
+	b.WriteString(xml.Header)
+	b.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	for i, row := range sheet.Rows {
+		fmt.Fprintf(&b, `<row r="%d">`, i+1)
+		for j, v := range row {
+			ref := xlsxColumn(j) + strconv.Itoa(i+1)
+			switch v := v.(type) {
+			case int:
+				fmt.Fprintf(&b, `<c r="%s"><v>%d</v></c>`, ref, v)
+			default:
+				if s := fmt.Sprint(v); s != "" {
+					fmt.Fprintf(&b, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`, ref, xmlEscape(s))
+				}
+			}
+		}
+		b.WriteString(`</row>`)
+	}
+	b.WriteString(`</sheetData></worksheet>`)
+	return b.String()
+}
+
+// writeXLSX is a workbook with one worksheet per sheet.  It's the least
+// that Excel, LibreOffice and Google Sheets all open: no styles and inline
+// strings.
+func writeXLSX(sheets []exportSheet) ([]byte, error) {
+	var contentTypes, workbook, rels strings.Builder
+	contentTypes.WriteString(xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>`)
+	workbook.WriteString(xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" ` +
+		`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>`)
+	rels.WriteString(xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`)
+
+	files := map[string]string{}
+	var order []string
+	used := map[string]bool{}
+	for i, sheet := range sheets {
+		n := i + 1
+		path := fmt.Sprintf("xl/worksheets/sheet%d.xml", n)
+		files[path] = xlsxWorksheet(sheet)
+		order = append(order, path)
+		fmt.Fprintf(&contentTypes, `<Override PartName="/%s" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, path)
+		fmt.Fprintf(&workbook, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, xmlEscape(xlsxSheetName(sheet.Name, used)), n, n)
+		fmt.Fprintf(&rels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`, n, n)
+	}
+	contentTypes.WriteString(`</Types>`)
+	workbook.WriteString(`</sheets></workbook>`)
+	rels.WriteString(`</Relationships>`)
+
+	files["[Content_Types].xml"] = contentTypes.String()
+	files["_rels/.rels"] = xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`
+	files["xl/workbook.xml"] = workbook.String()
+	files["xl/_rels/workbook.xml.rels"] = rels.String()
+	order = append([]string{"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml", "xl/_rels/workbook.xml.rels"}, order...)
+
+	var b bytes.Buffer
+	z := zip.NewWriter(&b)
+	for _, name := range order {
+		f, err := z.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write([]byte(files[name])); err != nil {
+			return nil, err
+		}
+	}
+	if err := z.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Handler
+func exportHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	format, kind := p.ByName("format"), p.ByName("kind")
+	if format != "csv" && format != "xlsx" {
+		http.Error(w, "exports are csv or xlsx", http.StatusNotFound)
+		return
+	}
+	var makeSheet func(TableModel) exportSheet
+	switch kind {
+	case "matrix":
+		makeSheet = matrixSheet
+	case "listings":
+		makeSheet = listingsSheet
+	default:
+		http.Error(w, "exports are of the matrix or the listings", http.StatusNotFound)
+		return
+	}
+
+	tableModels := model.TableModels
+	filename := "craigsmatrix-" + kind
+	if s := p.ByName("id"); s != "" {
+		id, err := strconv.Atoi(s)
+		tableModel, found := model.lookupTableModelByID(id)
+		if err != nil || !found {
+			http.Error(w, "no such table", http.StatusNotFound)
+			return
+		}
+		tableModels = []TableModel{tableModel}
+		filename += "-" + s
+	}
+
+	sheets := []exportSheet{}
+	for _, tableModel := range tableModels {
+		sheets = append(sheets, makeSheet(tableModel))
+	}
+
+	var contents []byte
+	var err error
+	contentType := "text/csv; charset=utf-8"
+	if format == "xlsx" {
+		contents, err = writeXLSX(sheets)
+		contentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	} else {
+		contents, err = writeCSV(sheets, kind)
+	}
+	fatal(err)
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, filename, format))
+	w.WriteHeader(http.StatusOK)
+	w.Write(contents)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func readCSV(t *testing.T, body []byte) [][]string {
+	r := csv.NewReader(bytes.NewReader(body))
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func Test_export_csvMatrix(t *testing.T) {
+	setUpFeedTable(t)
+
+	rec := getFeed("/export/csv/matrix/0")
+	expectStatus(t, rec, http.StatusOK)
+	if !strings.Contains(rec.Header().Get("Content-Disposition"), `filename="craigsmatrix-matrix-0.csv"`) {
+		t.Fatalf("not a download: %s", rec.Header().Get("Content-Disposition"))
+	}
+	records := readCSV(t, rec.Body.Bytes())
+	// the second refresh found one new listing in each cell
+	expected := "New Table id 0,TopHeading|desk,1|chair,1"
+	var got []string
+	for _, r := range records {
+		got = append(got, strings.Join(r, ","))
+	}
+	if strings.Join(got, "|") != expected {
+		t.Fatalf("expected %s, got %s", expected, strings.Join(got, "|"))
+	}
+}
+
+func Test_export_csvListings(t *testing.T) {
+	setUpFeedTable(t)
+
+	records := readCSV(t, getFeed("/export/csv/listings/0").Body.Bytes())
+	if strings.Join(records[0], ",") != "table,row,column,title,url,price,posted,first seen,state" {
+		t.Fatalf("wrong header %v", records[0])
+	}
+	// both listings in both cells
+	if len(records) != 5 {
+		t.Fatalf("expected 4 listings, got %v", records)
+	}
+	states := map[string]string{}
+	for _, r := range records[1:] {
+		states[r[1]+" "+r[3]] = r[5] + "/" + r[8]
+	}
+	if states["desk Oak desk"] != "120/seen" || states["chair Pine chair"] != "/new" {
+		t.Fatalf("wrong prices or states: %v", states)
+	}
+}
+
+func Test_export_csvDoesntLetTextBeFormulas(t *testing.T) {
+	setUpFeedTable(t)
+	tableModel := model.getTableModelByID(0)
+	tableModel.Rows[0][0].Recent[0].Title = `=HYPERLINK("http://evil.example","click")`
+	tableModel.Rows[0][0].Hits = -1
+	writeTable(tableModel, 0)
+
+	for _, r := range readCSV(t, getFeed("/export/csv/listings/0").Body.Bytes())[1:] {
+		if strings.HasPrefix(r[3], "=") {
+			t.Fatalf("title left as a formula: %q", r[3])
+		}
+	}
+	records := readCSV(t, getFeed("/export/csv/matrix/0").Body.Bytes())
+	if records[1][1] != "-1" {
+		t.Fatalf("numbers shouldn't be changed: %v", records[1])
+	}
+	for in, expected := range map[string]string{"=1+1": "'=1+1", "+1": "'+1", "-1": "'-1", "@SUM(A1)": "'@SUM(A1)", "Oak desk": "Oak desk", "": ""} {
+		if got := csvSafe(in); got != expected {
+			t.Errorf("%q: expected %q, got %q", in, expected, got)
+		}
+	}
+}
+
+func Test_export_listingsIgnoresCellsWithoutHeadings(t *testing.T) {
+	setUpFeedTable(t)
+	tableModel := model.getTableModelByID(0)
+	tableModel.SideHeadings = tableModel.SideHeadings[:1]
+	writeTable(tableModel, 0)
+
+	rec := getFeed("/export/csv/listings/0")
+	expectStatus(t, rec, http.StatusOK)
+	if records := readCSV(t, rec.Body.Bytes()); len(records) != 3 {
+		t.Fatalf("expected the desk row's 2 listings, got %v", records)
+	}
+}
+
+func Test_export_xlsxHasASheetPerTable(t *testing.T) {
+	setUpFeedTable(t)
+	addTable()
+	updateTableName("Furniture: SF/Oakland")
+
+	rec := getFeed("/export/xlsx/matrix")
+	expectStatus(t, rec, http.StatusOK)
+	z, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, f := range z.File {
+		r, _ := f.Open()
+		contents, _ := ioutil.ReadAll(r)
+		files[f.Name] = string(contents)
+	}
+
+	for _, name := range []string{"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml", "xl/worksheets/sheet1.xml", "xl/worksheets/sheet2.xml"} {
+		if _, found := files[name]; !found {
+			t.Fatalf("%s missing from %v", name, files)
+		}
+	}
+	if !strings.Contains(files["xl/workbook.xml"], `<sheet name="Furniture_ SF_Oakland"`) {
+		t.Fatalf("sheet names should be made safe: %s", files["xl/workbook.xml"])
+	}
+	sheet := files["xl/worksheets/sheet1.xml"]
+	if !strings.Contains(sheet, `<c r="A2" t="inlineStr"><is><t xml:space="preserve">desk</t></is></c><c r="B2"><v>1</v></c>`) {
+		t.Fatalf("hits should be numbers: %s", sheet)
+	}
+}
+
+func Test_export_notFound(t *testing.T) {
+	resetModelForAPITest()
+	for _, path := range []string{"/export/pdf/matrix/0", "/export/csv/prices/0", "/export/csv/matrix/7"} {
+		expectStatus(t, getFeed(path), http.StatusNotFound)
+	}
+}
+
+func Test_xlsxSheetName(t *testing.T) {
+	used := map[string]bool{}
+	long := strings.Repeat("x", 40)
+	for _, tc := range []struct{ name, expected string }{
+		{"Cars", "Cars"},
+		{"cars", "cars (2)"},
+		{"", "Sheet"},
+		{long, long[:31]},
+		{long, long[:27] + " (2)"},
+	} {
+		if got := xlsxSheetName(tc.name, used); got != tc.expected {
+			t.Errorf("%q: expected %q, got %q", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func Test_xlsxColumn(t *testing.T) {
+	for i, expected := range map[int]string{0: "A", 25: "Z", 26: "AA", 701: "ZZ", 702: "AAA"} {
+		if got := xlsxColumn(i); got != expected {
+			t.Errorf("%d: expected %s, got %s", i, expected, got)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCraigslist serves search pages built from postings the test adds and
+// removes, so the whole refresh pipeline can run offline.  Sites live under
+// /{site}/, so point the scraper at it with setCraigslistSiteURLTemplate(f.siteURLTemplate()).
+type fakeCraigslist struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	postings map[string][]fakePosting // by site|category|query
+	nextID   int
+	requests []string
+	status   int
+}
+
+type fakePosting struct {
+	ID    int
+	Title string
+	Price int
+	Date  time.Time
+	URL   string
+}
+
+func startFakeCraigslist() *fakeCraigslist {
+	f := &fakeCraigslist{postings: map[string][]fakePosting{}, nextID: 7000000001}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	return f
+}
+
+func (f *fakeCraigslist) Close() {
+	f.server.Close()
+}
+
+func (f *fakeCraigslist) siteURLTemplate() string {
+	return f.server.URL + "/{site}"
+}
+
+func fakeCraigslistKey(site, category, query string) string {
+	return site + "|" + category + "|" + strings.ToLower(query)
+}
+
+// addPosting makes a posting show up in searches for query and returns its URL
+func (f *fakeCraigslist) addPosting(site, category, query, title string, price int) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := f.nextID
+	f.nextID++
+	p := fakePosting{
+		ID:    id,
+		Title: title,
+		Price: price,
+		Date:  time.Date(2021, 1, 1, 0, 0, 0, 0, time.Local).Add(time.Duration(id%1000) * time.Hour),
+		URL:   fmt.Sprintf("%s/%s/%s/d/%s/%d.html", f.server.URL, site, category, strings.Replace(title, " ", "-", -1), id),
+	}
+	key := fakeCraigslistKey(site, category, query)
+	f.postings[key] = append(f.postings[key], p)
+	return p.URL
+}
+
+func (f *fakeCraigslist) removePosting(postingURL string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for key, postings := range f.postings {
+		var kept []fakePosting
+		for _, p := range postings {
+			if p.URL != postingURL {
+				kept = append(kept, p)
+			}
+		}
+		f.postings[key] = kept
+	}
+}
+
+// failWith makes every search answer with status until reset with 0
+func (f *fakeCraigslist) failWith(status int) {
+	f.mu.Lock()
+	f.status = status
+	f.mu.Unlock()
+}
+
+func (f *fakeCraigslist) requestCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.requests)
+}
+
+func (f *fakeCraigslist) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.URL.String())
+
+	if r.URL.Path == "/robots.txt" {
+		w.Write([]byte("User-agent: *\nAllow: /\n"))
+		return
+	}
+	if f.status != 0 {
+		w.WriteHeader(f.status)
+		return
+	}
+
+	// /{site}/search/{category}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 3 || parts[1] != "search" {
+		http.NotFound(w, r)
+		return
+	}
+	site, category := parts[0], parts[2]
+	query := r.URL.Query().Get("query")
+
+	postings := append([]fakePosting{}, f.postings[fakeCraigslistKey(site, category, query)]...)
+	sort.Slice(postings, func(i, j int) bool { return postings[i].Date.After(postings[j].Date) })
+
+	var sb strings.Builder
+	sb.WriteString(`<html><head><title>` + html.EscapeString(query) + `</title></head><body><ul class="rows">`)
+	for _, p := range postings {
+		fmt.Fprintf(&sb, `<li class="result-row" data-pid="%d">`+
+			`<time class="result-date" datetime="%s">%s</time>`+
+			`<a href="%s" class="result-title hdrlnk">%s</a>`+
+			`<span class="result-meta"><span class="result-price">$%d</span></span></li>`,
+			p.ID, p.Date.Format("2006-01-02 15:04"), p.Date.Format("Jan 2"),
+			html.EscapeString(p.URL), html.EscapeString(p.Title), p.Price)
+	}
+	sb.WriteString(`</ul></body></html>`)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(sb.String()))
+}
+
+// setUpFakeCraigslistTable makes table 0 a 1x2 matrix, desk in sfbay and boston
+func setUpFakeCraigslistTable(t *testing.T) (*fakeCraigslist, func()) {
+	fake := startFakeCraigslist()
+	setCraigslistSiteURLTemplate(fake.siteURLTemplate())
+	allowLocalPages(t)
+
+	clearModel_andSetMockModelDiskWriter()
+	setModel(makeNewModel())
+	model.TableModels[0].Category = "for sale"
+	addTopField(0)
+	editTableModelField(0, 0, "sfbay", "top")
+	editTableModelField(0, 1, "boston", "top")
+	editTableModelField(0, 0, "desk", "side")
+
+	return fake, func() {
+		fake.Close()
+		setCraigslistSiteURLTemplate(defaultCraigslistSiteURLTemplate)
+	}
+}
+
+func Test_fakeCraigslist_servesPostingsForQuery(t *testing.T) {
+	fake := startFakeCraigslist()
+	defer fake.Close()
+	fake.addPosting("sfbay", "sss", "desk", "Oak desk", 120)
+	fake.addPosting("sfbay", "sss", "chair", "Red chair", 20)
+
+	body, _, err := makeRequest(fake.server.URL + "/sfbay/search/sss?query=desk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(body, "Oak desk") || strings.Contains(body, "Red chair") {
+		t.Fatalf("wrong postings served:\n%s", body)
+	}
+}
+
+func Test_updateTableData_againstFakeCraigslist_countsNewListings(t *testing.T) {
+	fake, cleanup := setUpFakeCraigslistTable(t)
+	defer cleanup()
+
+	oak := fake.addPosting("sfbay", "sss", "desk", "Oak desk", 120)
+	fake.addPosting("sfbay", "sss", "desk", "Pine desk", 60)
+	fake.addPosting("boston", "sss", "desk", "Steel desk", 80)
+
+	updateTableData(0)
+	row := model.TableModels[0].Rows[0]
+	if row[0].Hits != 2 || row[1].Hits != 1 {
+		t.Fatalf("first refresh should see everything as new, got %d %d", row[0].Hits, row[1].Hits)
+	}
+
+	updateTableData(0)
+	row = model.TableModels[0].Rows[0]
+	if row[0].Hits != 0 || row[1].Hits != 0 || row[0].ResultCount != 2 {
+		t.Fatalf("nothing changed so nothing should be new, got %d %d", row[0].Hits, row[1].Hits)
+	}
+
+	fake.removePosting(oak)
+	walnut := fake.addPosting("sfbay", "sss", "desk", "Walnut desk", 300)
+	updateTableData(0)
+	row = model.TableModels[0].Rows[0]
+	if row[0].Hits != 1 || row[0].ResultCount != 2 || row[0].NewLinks[0] != walnut {
+		t.Fatalf("only the walnut desk should be new, got %+v", row[0])
+	}
+}
+
+func Test_updateTableData_againstFakeCraigslist_recordsFailures(t *testing.T) {
+	fake, cleanup := setUpFakeCraigslistTable(t)
+	defer cleanup()
+
+	fake.addPosting("sfbay", "sss", "desk", "Oak desk", 120)
+	updateTableData(0)
+
+	fake.failWith(http.StatusForbidden)
+	updateTableData(0)
+
+	cell := model.TableModels[0].Rows[0][0]
+	if cell.Status != cellStatusError || !strings.Contains(cell.LastError, "blocked") || cell.ResultCount != 1 {
+		t.Fatalf("a blocked refresh should keep the old results and say why: %+v", cell)
+	}
+}
+
+func Test_cellListings_againstFakeCraigslist(t *testing.T) {
+	fake, cleanup := setUpFakeCraigslistTable(t)
+	defer cleanup()
+
+	fake.addPosting("sfbay", "sss", "desk", "Oak desk", 120)
+	updateTableData(0)
+	updateTableData(0) // the oak desk is no longer new
+	fake.addPosting("sfbay", "sss", "desk", "Pine desk", 60)
+
+	cell, _ := model.lookupCell(0, 0, 0)
+	u, _ := url.Parse(cell.PageURL)
+	if u.Path != "/sfbay/search/sss" || u.Query().Get("query") != "desk" {
+		t.Fatalf("page URL not built from the template: %s", cell.PageURL)
+	}
+
+	listings, err := cellListings(model.getTableModelByID(0), cell)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := applyListingQuery(listings, ListingQuery{UnseenOnly: true})
+	if page.Total != 1 || page.Listings[0].Title != "Pine desk" {
+		t.Fatalf("only the pine desk should be unseen, got %+v", page.Listings)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Atom and RSS feeds of what refreshes found, for a whole table, a row, a
+// column or one cell:
+//
+//	/feeds/atom/table/:id
+//	/feeds/atom/table/:id/row/:row
+//	/feeds/atom/table/:id/col/:col
+//	/feeds/atom/table/:id/cell/:row/:col
+//
+// and the same under /feeds/rss/.
+
+// a feed shows at most this many entries
+var maxFeedEntries = 100
+
+func addFeedRoutes(router *httprouter.Router) {
+	router.GET("/feeds/:format/table/:id", lockModel(feedHandler))
+	router.GET("/feeds/:format/table/:id/row/:row", lockModel(feedHandler))
+	router.GET("/feeds/:format/table/:id/col/:col", lockModel(feedHandler))
+	router.GET("/feeds/:format/table/:id/cell/:row/:col", lockModel(feedHandler))
+}
+
+// feedEntry is a SeenListing and the cell it was found in
+type feedEntry struct {
+	SeenListing
+	Side string
+	Top  string
+}
+
+// feedEntryID is the same for a listing wherever and whenever it's seen,
+// so feed readers show it once
+func feedEntryID(l SeenListing) string {
+	id := l.ID
+	if id == "" {
+		id = postingIDFromURL(l.URL)
+	}
+	return "urn:craigsmatrix:listing:" + url.PathEscape(id)
+}
+
+// collectFeedEntries gathers the listings of the cells in rows x cols, a
+// nil slice meaning all of them, newest first without repeats
+func collectFeedEntries(tableModel TableModel, rows, cols []int) []feedEntry {
+	var entries []feedEntry
+	seen := map[string]bool{}
+	for i := range tableModel.Rows {
+		if rows != nil && !intsContain(rows, i) {
+			continue
+		}
+		for j := range tableModel.Rows[i] {
+			if cols != nil && !intsContain(cols, j) {
+				continue
+			}
+			for _, l := range tableModel.Rows[i][j].Recent {
+				id := feedEntryID(l)
+				if seen[id] {
+					continue
+				}
+				seen[id] = true
+				entries = append(entries, feedEntry{l, tableModel.SideHeadings[i], tableModel.TopHeadings[j]})
+			}
+		}
+	}
+
+	sort.SliceStable(entries, func(a, b int) bool {
+		if !entries[a].FirstSeen.Equal(entries[b].FirstSeen) {
+			return entries[a].FirstSeen.After(entries[b].FirstSeen)
+		}
+		return entries[a].Posted.After(entries[b].Posted)
+	})
+	if len(entries) > maxFeedEntries {
+		entries = entries[:maxFeedEntries]
+	}
+	return entries
+}
+
+func intsContain(ints []int, n int) bool {
+	for _, i := range ints {
+		if i == n {
+			return true
+		}
+	}
+	return false
+}
+
+func feedEntrySummary(e feedEntry) string {
+	summary := e.Side + " in " + e.Top
+	if e.HasPrice {
+		summary = fmt.Sprintf("$%d, %s", e.Price, summary)
+	}
+	return summary
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Title     string   `xml:"title"`
+	ID        string   `xml:"id"`
+	Link      atomLink `xml:"link"`
+	Published string   `xml:"published,omitempty"`
+	Updated   string   `xml:"updated"`
+	Summary   string   `xml:"summary"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+	Description string  `xml:"description"`
+}
+
+type rssGUID struct {
+	Value       string `xml:",chardata"`
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+}
+
+func makeAtomFeed(title, selfURL, pageURL string, entries []feedEntry, now time.Time) atomFeed {
+	feed := atomFeed{
+		Title:   title,
+		ID:      selfURL,
+		Updated: now.UTC().Format(time.RFC3339),
+		Links:   []atomLink{{Href: selfURL, Rel: "self"}, {Href: pageURL, Rel: "alternate"}},
+		Author:  atomAuthor{Name: "craigsmatrix"},
+		Entries: []atomEntry{},
+	}
+	if len(entries) > 0 {
+		feed.Updated = entries[0].FirstSeen.UTC().Format(time.RFC3339)
+	}
+	for _, e := range entries {
+		entry := atomEntry{
+			Title:   e.Title,
+			ID:      feedEntryID(e.SeenListing),
+			Link:    atomLink{Href: e.URL, Rel: "alternate"},
+			Updated: e.FirstSeen.UTC().Format(time.RFC3339),
+			Summary: feedEntrySummary(e),
+		}
+		if !e.Posted.IsZero() {
+			entry.Published = e.Posted.UTC().Format(time.RFC3339)
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	return feed
+}
+
+func makeRSSFeed(title, pageURL string, entries []feedEntry) rssFeed {
+	feed := rssFeed{Version: "2.0", Channel: rssChannel{
+		Title:       title,
+		Link:        pageURL,
+		Description: "New listings found by craigsmatrix",
+		Items:       []rssItem{},
+	}}
+	if len(entries) > 0 {
+		feed.Channel.LastBuildDate = entries[0].FirstSeen.Format(time.RFC1123Z)
+	}
+	for _, e := range entries {
+		date := e.Posted
+		if date.IsZero() {
+			date = e.FirstSeen
+		}
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       e.Title,
+			Link:        e.URL,
+			GUID:        rssGUID{Value: feedEntryID(e.SeenListing)},
+			PubDate:     date.Format(time.RFC1123Z),
+			Description: feedEntrySummary(e),
+		})
+	}
+	return feed
+}
+
+// requestBaseURL is how the client reached us, for links back to the server
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// Handler
+func feedHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	format := p.ByName("format")
+	if format != "atom" && format != "rss" {
+		http.Error(w, "feeds are atom or rss", http.StatusNotFound)
+		return
+	}
+	id, err := strconv.Atoi(p.ByName("id"))
+	tableModel, found := model.lookupTableModelByID(id)
+	if err != nil || !found {
+		http.Error(w, "no such table", http.StatusNotFound)
+		return
+	}
+
+	var rows, cols []int
+	var titleParts []string
+	if s := p.ByName("row"); s != "" {
+		row, err := strconv.Atoi(s)
+		if err != nil || row < 0 || row >= len(tableModel.SideHeadings) {
+			http.Error(w, "no such row", http.StatusNotFound)
+			return
+		}
+		rows = []int{row}
+		titleParts = append(titleParts, tableModel.SideHeadings[row])
+	}
+	if s := p.ByName("col"); s != "" {
+		col, err := strconv.Atoi(s)
+		if err != nil || col < 0 || col >= len(tableModel.TopHeadings) {
+			http.Error(w, "no such column", http.StatusNotFound)
+			return
+		}
+		cols = []int{col}
+		titleParts = append(titleParts, tableModel.TopHeadings[col])
+	}
+
+	title := strings.TrimSpace(tableModel.Name)
+	if len(titleParts) > 0 {
+		title += ": " + strings.Join(titleParts, " in ")
+	}
+	base := requestBaseURL(r)
+	pageURL := fmt.Sprintf("%s/html/table/%d", base, tableModel.ID)
+	entries := collectFeedEntries(tableModel, rows, cols)
+
+	var feed interface{}
+	contentType := "application/rss+xml; charset=utf-8"
+	if format == "atom" {
+		feed = makeAtomFeed(title, base+r.URL.Path, pageURL, entries, time.Now())
+		contentType = "application/atom+xml; charset=utf-8"
+	} else {
+		feed = makeRSSFeed(title, pageURL, entries)
+	}
+
+	contents, err := xml.MarshalIndent(feed, "", "  ")
+	fatal(err)
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(xml.Header))
+	w.Write(contents)
+}
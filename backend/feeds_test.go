@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func getFeed(path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	return rec
+}
+
+// setUpFeedTable is table 0 with rows desk and chair, refreshed twice
+// against a stub so the second listing is the newest
+func setUpFeedTable(t *testing.T) {
+	stub := setUpStubTable(t, Listing{ID: "1001", Title: "Oak desk", URL: "https://sfbay.craigslist.org/d/oak-desk/1001.html", Price: 120, HasPrice: true})
+	editTableModelField(0, 0, "desk", "side")
+	addSideField(0)
+	editTableModelField(0, 1, "chair", "side")
+
+	updateTableData(0)
+	stub.listings = append(stub.listings, Listing{Title: "Pine chair", URL: "https://sfbay.craigslist.org/d/pine-chair/1002.html"})
+	updateTableData(0)
+}
+
+func Test_feeds_atomTable_newestFirstWithoutRepeats(t *testing.T) {
+	setUpFeedTable(t)
+
+	rec := getFeed("/feeds/atom/table/0")
+	expectStatus(t, rec, http.StatusOK)
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "application/atom+xml") {
+		t.Fatalf("content type %s", rec.Header().Get("Content-Type"))
+	}
+
+	var feed atomFeed
+	if err := xml.Unmarshal(rec.Body.Bytes(), &feed); err != nil {
+		t.Fatal(err)
+	}
+	// both cells saw both listings, each should be in the feed once
+	if len(feed.Entries) != 2 {
+		t.Fatalf("expected 2 entries, got %+v", feed.Entries)
+	}
+	if feed.Entries[0].Title != "Pine chair" || feed.Entries[1].Title != "Oak desk" {
+		t.Fatalf("expected newest first, got %s, %s", feed.Entries[0].Title, feed.Entries[1].Title)
+	}
+	if feed.Entries[0].ID != "urn:craigsmatrix:listing:1002" || feed.Entries[1].ID != "urn:craigsmatrix:listing:1001" {
+		t.Fatalf("entry IDs should come from the posting ID: %s %s", feed.Entries[0].ID, feed.Entries[1].ID)
+	}
+	if feed.Entries[1].Summary != "$120, desk in TopHeading" || feed.Entries[1].Link.Href != "https://sfbay.craigslist.org/d/oak-desk/1001.html" {
+		t.Fatalf("entry not filled in: %+v", feed.Entries[1])
+	}
+	if feed.ID != "http://example.com/feeds/atom/table/0" {
+		t.Fatalf("feed id should be its own URL, got %s", feed.ID)
+	}
+}
+
+func Test_feeds_rssRowColAndCell(t *testing.T) {
+	setUpFeedTable(t)
+
+	for path, expectedTitle := range map[string]string{
+		"/feeds/rss/table/0/row/1":     "chair",
+		"/feeds/rss/table/0/col/0":     "TopHeading",
+		"/feeds/rss/table/0/cell/1/0":  "chair in TopHeading",
+		"/feeds/rss/table/0/cell/0/0":  "desk in TopHeading",
+		"/feeds/atom/table/0/cell/1/0": "",
+		"/feeds/atom/table/0/row/0":    "",
+		"/feeds/atom/table/0/col/0":    "",
+		"/feeds/rss/table/0":           "",
+	} {
+		rec := getFeed(path)
+		expectStatus(t, rec, http.StatusOK)
+		if expectedTitle == "" {
+			continue
+		}
+		var feed rssFeed
+		if err := xml.Unmarshal(rec.Body.Bytes(), &feed); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(feed.Channel.Title, ": "+expectedTitle) {
+			t.Fatalf("%s: title %q", path, feed.Channel.Title)
+		}
+		if len(feed.Channel.Items) != 2 || feed.Channel.Items[0].GUID.Value != "urn:craigsmatrix:listing:1002" || feed.Channel.Items[0].GUID.IsPermaLink {
+			t.Fatalf("%s: items %+v", path, feed.Channel.Items)
+		}
+	}
+}
+
+func Test_feeds_notFound(t *testing.T) {
+	setUpFeedTable(t)
+	for _, path := range []string{
+		"/feeds/json/table/0",
+		"/feeds/atom/table/9",
+		"/feeds/atom/table/0/row/5",
+		"/feeds/atom/table/0/col/x",
+		"/feeds/rss/table/0/cell/0/9",
+	} {
+		expectStatus(t, getFeed(path), http.StatusNotFound)
+	}
+}
+
+func Test_refreshCell_keepsRecentListingsNewestFirst(t *testing.T) {
+	resetModelForAPITest()
+	cell := makeNewCellModel()
+	stub := &stubSource{name: "stub"}
+	registerStubSource(t, stub)
+	tableModel := TableModel{Source: "stub"}
+
+	defer func(n int) { maxRecentListingsPerCell = n }(maxRecentListingsPerCell)
+	maxRecentListingsPerCell = 2
+
+	for _, title := range []string{"a", "b", "c"} {
+		stub.listings = append(stub.listings, Listing{Title: title, URL: "https://stub.example/" + title})
+		if _, err := refreshCell(tableModel, &cell); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(cell.Recent) != 2 || cell.Recent[0].Title != "c" || cell.Recent[1].Title != "b" {
+		t.Fatalf("expected c, b, got %+v", cell.Recent)
+	}
+}
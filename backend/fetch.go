@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FetchSettings controls timeouts and retries for outbound scraping
+type FetchSettings struct {
+	Timeout     time.Duration
+	MaxRetries  int
+	BackoffBase time.Duration
+	BackoffMax  time.Duration
+}
+
+func defaultFetchSettings() FetchSettings {
+	return FetchSettings{
+		Timeout:     3 * time.Second,
+		MaxRetries:  3,
+		BackoffBase: 500 * time.Millisecond,
+		BackoffMax:  10 * time.Second,
+	}
+}
+
+var fetchSettings = defaultFetchSettings()
+
+func setFetchSettings(s FetchSettings) {
+	fetchSettings = s
+}
+
+var scrapeTransport http.RoundTripper = newNetworkTransport(nil)
+
+func setScrapeTransport(t http.RoundTripper) {
+	scrapeTransport = t
+}
+
+// fetchTransport is the RoundTripper every outbound scrape goes through,
+// which is makeRequest and so every source.
+func fetchTransport() http.RoundTripper {
+	return scrapeTransport
+}
+
+type fetchTimeoutKey struct{}
+
+// withFetchTimeout gives each request made with ctx d to finish, counted
+// from when it reaches networkTransport, so time spent waiting on the
+// rate limiter doesn't use it up
+func withFetchTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, fetchTimeoutKey{}, d)
+}
+
+// startFetchTimeout puts req's fetch timeout, if it has one, on its
+// context.  cancel is for when the response body is done with.
+func startFetchTimeout(req *http.Request) (*http.Request, context.CancelFunc) {
+	d, found := req.Context().Value(fetchTimeoutKey{}).(time.Duration)
+	if !found || d <= 0 {
+		return req, func() {}
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), d)
+	return req.WithContext(ctx), cancel
+}
+
+// fetchTimeoutBody ends a response's fetch timeout when it is closed, and
+// reports a read cut short by the timeout as a timeout
+type fetchTimeoutBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (b fetchTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && b.ctx.Err() == context.DeadlineExceeded {
+		err = b.ctx.Err()
+	}
+	return n, err
+}
+
+func (b fetchTimeoutBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// setupScrapeTransport builds the chain from the current settings:
+// the cache in front, so cache hits cost nothing, then the rate limiter
+// and robots.txt check, then the proxies if any, then the network.
+func setupScrapeTransport() {
+	setProxies(nil)
+	if len(proxySettings.URLs) > 0 {
+		p, err := newProxyTransport(proxySettings)
+		fatal(err, "proxy settings")
+		setProxies(p)
+	}
+	network := newNetworkTransport(proxies)
+
+	polite := newPoliteTransport(politenessSettings, network)
+	setHTTPCache(newHTTPCache(defaulthttpcachedir, defaulthttpcachettl, polite))
+	setScrapeTransport(httpCache)
+}
+
+// FetchErrorKind says why a fetch failed
+type FetchErrorKind string
+
+const (
+	FetchErrorDNS         FetchErrorKind = "dns"
+	FetchErrorTimeout     FetchErrorKind = "timeout"
+	FetchErrorNetwork     FetchErrorKind = "network"
+	FetchErrorClient      FetchErrorKind = "client"
+	FetchErrorServer      FetchErrorKind = "server"
+	FetchErrorRateLimited FetchErrorKind = "rate_limited"
+	FetchErrorBlocked     FetchErrorKind = "blocked"
+	FetchErrorDisallowed  FetchErrorKind = "disallowed"
+)
+
+// FetchError is returned by makeRequest for anything that isn't a 2xx page
+type FetchError struct {
+	Kind       FetchErrorKind
+	URL        string
+	StatusCode int
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *FetchError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("%s: HTTP %d: %s", e.Kind, e.StatusCode, e.URL)
+	}
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %v", e.Kind, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Kind, e.URL)
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+// Retryable is true for failures that may go away if we wait and try again
+func (e *FetchError) Retryable() bool {
+	switch e.Kind {
+	case FetchErrorTimeout, FetchErrorNetwork, FetchErrorServer, FetchErrorRateLimited:
+		return true
+	}
+	return false
+}
+
+// craigslist serves this page, with a 403, when it has blocked our IP
+var craigslistBlockedMarker = "This IP has been automatically blocked"
+
+func classifyTransportError(url string, err error) *FetchError {
+	var fetchErr *FetchError
+	if errors.As(err, &fetchErr) {
+		return fetchErr
+	}
+	var refusal *PageProxyRefusal
+	if errors.As(err, &refusal) {
+		return &FetchError{Kind: FetchErrorDisallowed, URL: url, Err: refusal}
+	}
+
+	kind := FetchErrorNetwork
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	if errors.As(err, &dnsErr) {
+		kind = FetchErrorDNS
+	} else if errors.As(err, &netErr) && netErr.Timeout() {
+		kind = FetchErrorTimeout
+	}
+	return &FetchError{Kind: kind, URL: url, Err: err}
+}
+
+func classifyResponse(url string, resp *http.Response, body string) *FetchError {
+	code := resp.StatusCode
+	if code >= 200 && code < 300 {
+		if strings.Contains(body, craigslistBlockedMarker) {
+			return &FetchError{Kind: FetchErrorBlocked, URL: url, StatusCode: code}
+		}
+		return nil
+	}
+
+	fetchErr := &FetchError{URL: url, StatusCode: code}
+	switch {
+	case code == http.StatusTooManyRequests:
+		fetchErr.Kind = FetchErrorRateLimited
+		fetchErr.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+	case code == http.StatusForbidden || strings.Contains(body, craigslistBlockedMarker):
+		fetchErr.Kind = FetchErrorBlocked
+	case code >= 500:
+		fetchErr.Kind = FetchErrorServer
+	default:
+		fetchErr.Kind = FetchErrorClient
+	}
+	return fetchErr
+}
+
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		return time.Until(when)
+	}
+	return 0
+}
+
+// backoffDelay is exponential backoff with jitter, in [d/2, d)
+func backoffDelay(attempt int, s FetchSettings) time.Duration {
+	d := s.BackoffBase << uint(attempt)
+	if d <= 0 || d > s.BackoffMax {
+		d = s.BackoffMax
+	}
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
+
+// withRetries calls try until it succeeds, fails with something that is
+// not retryable, or runs out of attempts.  The error is a *FetchError, or
+// a plain nil, never a nil *FetchError, so err != nil can be trusted.
+func withRetries(s FetchSettings, try func() (int, *FetchError)) (int, error) {
+	var statusCode int
+	var err error
+
+	for attempt := 0; attempt <= s.MaxRetries; attempt++ {
+		var fetchErr *FetchError
+		statusCode, fetchErr = try()
+		if fetchErr == nil {
+			return statusCode, nil
+		}
+		err = fetchErr
+		if !fetchErr.Retryable() || attempt == s.MaxRetries {
+			break
+		}
+
+		delay := backoffDelay(attempt, s)
+		if fetchErr.RetryAfter > delay {
+			delay = fetchErr.RetryAfter
+			if delay > s.BackoffMax {
+				delay = s.BackoffMax
+			}
+		}
+		printf("fetch: %v, retrying in %v\n", fetchErr, delay)
+		time.Sleep(delay)
+	}
+	return statusCode, err
+}
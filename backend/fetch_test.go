@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func fastFetchSettings() FetchSettings {
+	return FetchSettings{
+		Timeout:     time.Second,
+		MaxRetries:  2,
+		BackoffBase: time.Millisecond,
+		BackoffMax:  2 * time.Millisecond,
+	}
+}
+
+func Test_classifyResponse_statusCodes(t *testing.T) {
+	cases := map[int]FetchErrorKind{
+		http.StatusNotFound:            FetchErrorClient,
+		http.StatusForbidden:           FetchErrorBlocked,
+		http.StatusTooManyRequests:     FetchErrorRateLimited,
+		http.StatusInternalServerError: FetchErrorServer,
+		http.StatusBadGateway:          FetchErrorServer,
+	}
+	for code, kind := range cases {
+		resp := &http.Response{StatusCode: code, Header: http.Header{}}
+		fetchErr := classifyResponse("http://x", resp, "")
+		if fetchErr == nil || fetchErr.Kind != kind || fetchErr.StatusCode != code {
+			t.Fatalf("status %d: expected %s, got %v", code, kind, fetchErr)
+		}
+	}
+
+	ok := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+	if classifyResponse("http://x", ok, "<html></html>") != nil {
+		t.Fatalf("200 should not be an error")
+	}
+	if fetchErr := classifyResponse("http://x", ok, craigslistBlockedMarker); fetchErr == nil || fetchErr.Kind != FetchErrorBlocked {
+		t.Fatalf("the craigslist block page should be classified as blocked")
+	}
+}
+
+func Test_classifyTransportError_dnsFailure(t *testing.T) {
+	client := http.Client{Timeout: time.Second}
+	_, err := client.Get("http://nonexistent.invalid/")
+	if err == nil {
+		t.Skip("resolver answered for .invalid")
+	}
+	if fetchErr := classifyTransportError("http://nonexistent.invalid/", err); fetchErr.Kind != FetchErrorDNS {
+		t.Fatalf("expected dns, got %s", fetchErr.Kind)
+	}
+}
+
+func Test_withRetries_retriesServerErrors_untilSuccess(t *testing.T) {
+	attempts := 0
+	code, err := withRetries(fastFetchSettings(), func() (int, *FetchError) {
+		attempts++
+		if attempts < 3 {
+			return 503, &FetchError{Kind: FetchErrorServer, StatusCode: 503}
+		}
+		return 200, nil
+	})
+
+	if err != nil || code != 200 || attempts != 3 {
+		t.Fatalf("expected success on the third attempt, got %d %v after %d", code, err, attempts)
+	}
+}
+
+func Test_withRetries_doesNotRetryClientErrors(t *testing.T) {
+	attempts := 0
+	code, err := withRetries(fastFetchSettings(), func() (int, *FetchError) {
+		attempts++
+		return 404, &FetchError{Kind: FetchErrorClient, StatusCode: 404}
+	})
+
+	if err == nil || code != 404 || attempts != 1 {
+		t.Fatalf("a 404 should fail without retrying, got %d %v after %d", code, err, attempts)
+	}
+}
+
+func Test_withRetries_noAttemptsIsAPlainNil(t *testing.T) {
+	s := fastFetchSettings()
+	s.MaxRetries = -1
+	_, err := withRetries(s, func() (int, *FetchError) {
+		t.Fatal("shouldn't be called")
+		return 0, nil
+	})
+	if err != nil {
+		t.Fatalf("expected a nil error, got %#v", err)
+	}
+}
+
+func Test_makeRequest_passesStatusCodeUp(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	_, code, err := makeRequest(server.URL)
+
+	fetchErr, ok := err.(*FetchError)
+	if !ok || fetchErr.Kind != FetchErrorClient || code != http.StatusNotFound {
+		t.Fatalf("expected a client FetchError with 404, got %d %v", code, err)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// the built frontend, see webroot/README.txt
+//go:embed webroot
+var embeddedWebroot embed.FS
+
+var frontendPrefix = "/app"
+
+// frontendFileSystem is the embedded frontend, or dir on disk when set so
+// changes show up on reload without rebuilding the binary
+func frontendFileSystem(dir string) http.FileSystem {
+	if dir != "" {
+		return http.Dir(dir)
+	}
+	sub, err := fs.Sub(embeddedWebroot, "webroot")
+	fatal(err)
+	return http.FS(sub)
+}
+
+func frontendHandler(dir string) http.Handler {
+	fileServer := http.StripPrefix(frontendPrefix, http.FileServer(frontendFileSystem(dir)))
+	if dir == "" {
+		return fileServer
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+		fileServer.ServeHTTP(w, r)
+	})
+}
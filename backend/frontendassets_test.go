@@ -0,0 +1,32 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_frontendHandler_servesEmbeddedFiles(t *testing.T) {
+	rec := httptest.NewRecorder()
+	frontendHandler("").ServeHTTP(rec, httptest.NewRequest("GET", "/app/README.txt", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the embedded README, got %d", rec.Code)
+	}
+}
+
+func Test_frontendHandler_devDirIsNotCached(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "webroot")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "main.js"), []byte("live"), 0644)
+
+	rec := httptest.NewRecorder()
+	frontendHandler(dir).ServeHTTP(rec, httptest.NewRequest("GET", "/app/main.js", nil))
+
+	if rec.Body.String() != "live" || rec.Header().Get("Cache-Control") != "no-cache" {
+		t.Fatalf("expected main.js from disk with no-cache, got %d %q", rec.Code, rec.Body.String())
+	}
+}
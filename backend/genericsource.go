@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/andybalholm/cascadia"
+)
+
+// SourceConfig defines a source in the sources: section of the config file.
+// Either URL is an HTML search page picked apart with the CSS selectors, or
+// RSS is a feed.  {side} and {top} in either are replaced by the cell's
+// headings.
+type SourceConfig struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	RSS  string `yaml:"rss"`
+
+	// Result matches one listing on the page, the others are looked for
+	// inside it.  An empty Title or Link uses the result itself.
+	Result     string `yaml:"result"`
+	Title      string `yaml:"title"`
+	Link       string `yaml:"link"`
+	Price      string `yaml:"price"`
+	Date       string `yaml:"date"`
+	DateFormat string `yaml:"dateFormat"` // Go layout, as well as RFC 3339 and 2006-01-02 15:04
+}
+
+// validate returns one message per problem, prefixed with where it is
+func (s SourceConfig) validate(where string) []string {
+	var errs []string
+	addErr := func(format string, a ...interface{}) {
+		errs = append(errs, where+": "+fmt.Sprintf(format, a...))
+	}
+
+	if s.Name == "" {
+		addErr("name: must not be empty")
+	}
+	template := s.URL
+	switch {
+	case s.URL != "" && s.RSS != "":
+		addErr("give url or rss, not both")
+	case s.URL != "":
+		if s.Result == "" {
+			addErr("result: a selector for each listing is needed with url")
+		}
+		for _, sel := range []string{s.Result, s.Title, s.Link, s.Price, s.Date} {
+			if _, err := cascadia.Compile(sel); sel != "" && err != nil {
+				addErr("%q is not a CSS selector: %v", sel, err)
+			}
+		}
+	case s.RSS != "":
+		template = s.RSS
+	default:
+		addErr("url or rss is needed")
+	}
+	if template != "" && !strings.Contains(template, "{side}") && !strings.Contains(template, "{top}") {
+		addErr("%q should contain {side} or {top}", template)
+	}
+	return errs
+}
+
+func newConfiguredSource(c SourceConfig) Source {
+	if c.RSS != "" {
+		return feedSource{c}
+	}
+	return selectorSource{c}
+}
+
+// expandSourceTemplate fills {side} and {top} into a URL template
+func expandSourceTemplate(template, side, top string) string {
+	return strings.NewReplacer("{side}", url.QueryEscape(side), "{top}", url.QueryEscape(top)).Replace(template)
+}
+
+// selectorSource scrapes an HTML page with CSS selectors
+type selectorSource struct {
+	cfg SourceConfig
+}
+
+func (s selectorSource) Name() string {
+	return s.cfg.Name
+}
+
+func (s selectorSource) QueryURL(side, top string, filters SourceFilters) string {
+	return expandSourceTemplate(s.cfg.URL, side, top)
+}
+
+func (s selectorSource) Listings(queryURL string) ([]Listing, error) {
+	rawHTML, _, err := makeRequest(queryURL)
+	if err != nil {
+		return nil, err
+	}
+	return s.parse(rawHTML, queryURL)
+}
+
+func (s selectorSource) parse(rawHTML, pageURL string) ([]Listing, error) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(rawHTML))
+	if err != nil {
+		return nil, err
+	}
+	base, _ := url.Parse(pageURL)
+
+	listings := []Listing{}
+	doc.Find(s.cfg.Result).Each(func(_ int, result *goquery.Selection) {
+		link := selectWithin(result, s.cfg.Link)
+		if !link.Is("a") {
+			link = link.Find("a").First()
+		}
+		href, _ := link.Attr("href")
+		abs, ok := absoluteURL(base, href)
+		if href == "" || !ok {
+			return
+		}
+
+		listing := Listing{
+			ID:    abs,
+			Title: strings.Join(strings.Fields(selectWithin(result, s.cfg.Title).First().Text()), " "),
+			URL:   abs,
+		}
+		if s.cfg.Price != "" {
+			listing.Price, listing.HasPrice = parsePrice(result.Find(s.cfg.Price).First().Text())
+		}
+		if s.cfg.Date != "" {
+			date := result.Find(s.cfg.Date).First()
+			value, found := date.Attr("datetime")
+			if !found {
+				value = strings.TrimSpace(date.Text())
+			}
+			listing.Date = parseSourceDate(value, s.cfg.DateFormat)
+		}
+		listings = append(listings, listing)
+	})
+	return listings, nil
+}
+
+// selectWithin is sel inside result, or result itself when sel is empty
+func selectWithin(result *goquery.Selection, sel string) *goquery.Selection {
+	if sel == "" {
+		return result
+	}
+	return result.Find(sel)
+}
+
+func parseSourceDate(value, layout string) time.Time {
+	if layout != "" {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t
+		}
+	}
+	return parseCraigslistDate(value)
+}
+
+// feedSource reads an RSS 2.0 or Atom feed
+type feedSource struct {
+	cfg SourceConfig
+}
+
+func (s feedSource) Name() string {
+	return s.cfg.Name
+}
+
+func (s feedSource) QueryURL(side, top string, filters SourceFilters) string {
+	return expandSourceTemplate(s.cfg.RSS, side, top)
+}
+
+func (s feedSource) Listings(queryURL string) ([]Listing, error) {
+	body, _, err := makeRequest(queryURL)
+	if err != nil {
+		return nil, err
+	}
+	return parseFeedListings(body, queryURL)
+}
+
+// just enough of RSS 2.0 and Atom to get listings out of either
+type feedDocument struct {
+	XMLName xml.Name
+	Items   []struct {
+		Title   string `xml:"title"`
+		Link    string `xml:"link"`
+		GUID    string `xml:"guid"`
+		PubDate string `xml:"pubDate"`
+	} `xml:"channel>item"`
+	Entries []struct {
+		Title string `xml:"title"`
+		Links []struct {
+			Href string `xml:"href,attr"`
+			Rel  string `xml:"rel,attr"`
+		} `xml:"link"`
+		ID        string `xml:"id"`
+		Published string `xml:"published"`
+		Updated   string `xml:"updated"`
+	} `xml:"entry"`
+}
+
+var feedDateLayouts = []string{time.RFC1123Z, time.RFC1123, time.RFC3339}
+
+func parseFeedListings(body, feedURL string) ([]Listing, error) {
+	var doc feedDocument
+	if err := xml.Unmarshal([]byte(body), &doc); err != nil {
+		return nil, fmt.Errorf("%s is not an RSS or Atom feed: %v", feedURL, err)
+	}
+	base, _ := url.Parse(feedURL)
+
+	listings := []Listing{}
+	add := func(id, title, link, date string) {
+		abs, ok := absoluteURL(base, link)
+		if link == "" || !ok {
+			return
+		}
+		if id == "" {
+			id = abs
+		}
+		listing := Listing{ID: id, Title: strings.TrimSpace(title), URL: abs}
+		if i := strings.Index(title, "$"); i >= 0 {
+			listing.Price, listing.HasPrice = parsePrice(title[i:])
+		}
+		for _, layout := range feedDateLayouts {
+			if t, err := time.Parse(layout, strings.TrimSpace(date)); err == nil {
+				listing.Date = t
+				break
+			}
+		}
+		listings = append(listings, listing)
+	}
+
+	for _, item := range doc.Items {
+		add(item.GUID, item.Title, strings.TrimSpace(item.Link), item.PubDate)
+	}
+	for _, entry := range doc.Entries {
+		var link string
+		for _, l := range entry.Links {
+			if l.Rel == "" || l.Rel == "alternate" {
+				link = l.Href
+				break
+			}
+		}
+		date := entry.Published
+		if date == "" {
+			date = entry.Updated
+		}
+		add(entry.ID, entry.Title, link, date)
+	}
+	return listings, nil
+}
+
+// configuredSourceNames remembers what the config registered, so applying
+// the config again replaces them
+var configuredSourceNames []string
+
+func setConfiguredSources(configs []SourceConfig) {
+	for _, name := range configuredSourceNames {
+		delete(sources, name)
+	}
+	configuredSourceNames = nil
+	for _, c := range configs {
+		registerSource(newConfiguredSource(c))
+		configuredSourceNames = append(configuredSourceNames, c.Name)
+	}
+}
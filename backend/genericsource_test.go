@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var sampleBoardPage = `<html><body>
+<div class="listing">
+  <a class="listing-title" href="/item/1">Oak   desk</a>
+  <span class="price">$1,200</span>
+  <time datetime="2021-01-20 10:30">yesterday</time>
+</div>
+<div class="listing">
+  <a class="listing-title" href="https://elsewhere.example/item/2">Pine desk</a>
+  <span class="date">Jan 21, 2021</span>
+</div>
+<div class="listing">no link here</div>
+</body></html>`
+
+var sampleBoardFeed = `<?xml version="1.0"?>
+<rss version="2.0"><channel>
+  <item><title>Oak desk - $120</title><link>/item/1</link><guid>board-1</guid>
+    <pubDate>Wed, 20 Jan 2021 10:30:00 +0000</pubDate></item>
+  <item><title>Free chair</title><link>https://board.example/item/2</link></item>
+</channel></rss>`
+
+var sampleBoardAtom = `<?xml version="1.0"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+  <entry><title>Oak desk</title><id>tag:board,1</id>
+    <link rel="alternate" href="https://board.example/item/1"/>
+    <updated>2021-01-20T10:30:00Z</updated></entry>
+</feed>`
+
+func Test_selectorSource_parse(t *testing.T) {
+	s := selectorSource{SourceConfig{
+		Name: "board", URL: "https://board.example/{top}?q={side}",
+		Result: ".listing", Title: ".listing-title", Link: "a", Price: ".price", Date: "time, .date",
+		DateFormat: "Jan 2, 2006",
+	}}
+
+	listings, err := s.parse(sampleBoardPage, "https://board.example/sf?q=desk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listings) != 2 {
+		t.Fatalf("expected 2 listings, got %+v", listings)
+	}
+
+	oak := listings[0]
+	if oak.Title != "Oak desk" || oak.URL != "https://board.example/item/1" || oak.Price != 1200 || !oak.HasPrice {
+		t.Fatalf("oak desk parsed wrong: %+v", oak)
+	}
+	if oak.Date.Day() != 20 || oak.Date.Hour() != 10 {
+		t.Fatalf("datetime attribute not used: %v", oak.Date)
+	}
+
+	pine := listings[1]
+	if pine.URL != "https://elsewhere.example/item/2" || pine.HasPrice || pine.Date.Day() != 21 {
+		t.Fatalf("pine desk parsed wrong: %+v", pine)
+	}
+}
+
+func Test_parseFeedListings_rssAndAtom(t *testing.T) {
+	listings, err := parseFeedListings(sampleBoardFeed, "https://board.example/sf/feed.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listings) != 2 {
+		t.Fatalf("expected 2 items, got %+v", listings)
+	}
+	if listings[0].ID != "board-1" || listings[0].URL != "https://board.example/item/1" || listings[0].Price != 120 || listings[0].Date.IsZero() {
+		t.Fatalf("rss item parsed wrong: %+v", listings[0])
+	}
+	if listings[1].ID != "https://board.example/item/2" || listings[1].HasPrice {
+		t.Fatalf("an item without a guid should use its link: %+v", listings[1])
+	}
+
+	listings, err = parseFeedListings(sampleBoardAtom, "https://board.example/feed")
+	if err != nil || len(listings) != 1 || listings[0].ID != "tag:board,1" || listings[0].Date.IsZero() {
+		t.Fatalf("atom entry parsed wrong: %+v %v", listings, err)
+	}
+
+	if _, err := parseFeedListings("<html>", "https://board.example/feed"); err == nil {
+		t.Fatal("expected an error for something that isn't a feed")
+	}
+}
+
+func Test_configuredSources_refreshATable(t *testing.T) {
+	resetModelForAPITest()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".xml") {
+			fmt.Fprint(w, sampleBoardFeed)
+			return
+		}
+		fmt.Fprint(w, sampleBoardPage)
+	}))
+	defer server.Close()
+
+	setConfiguredSources([]SourceConfig{
+		{Name: "board", URL: server.URL + "/{top}?q={side}", Result: ".listing", Title: ".listing-title"},
+		{Name: "boardfeed", RSS: server.URL + "/{top}/feed.xml?q={side}"},
+	})
+	defer setConfiguredSources(nil)
+
+	if err := updateTableSource(0, "board"); err != nil {
+		t.Fatal(err)
+	}
+	editTableModelField(0, 0, "oak desk", "side")
+	if err := updateCellSource(0, 0, 0, "boardfeed"); err != nil {
+		t.Fatal(err)
+	}
+	addTopField(0)
+	editTableModelField(0, 1, "sf", "top")
+
+	updateTableData(0)
+
+	feedCell, _ := model.lookupCell(0, 0, 0)
+	if feedCell.PageURL != server.URL+"/TopHeading/feed.xml?q=oak+desk" || feedCell.Hits != 2 {
+		t.Fatalf("feed cell not refreshed: %+v", feedCell)
+	}
+	pageCell, _ := model.lookupCell(0, 0, 1)
+	if pageCell.PageURL != server.URL+"/sf?q=oak+desk" || pageCell.Hits != 2 || pageCell.Status != cellStatusOK {
+		t.Fatalf("page cell not refreshed: %+v", pageCell)
+	}
+
+	setConfiguredSources(nil)
+	if _, err := lookupSource("board"); err == nil {
+		t.Fatal("configured sources should be replaced when the config is applied again")
+	}
+}
+
+func Test_loadConfig_validatesSources(t *testing.T) {
+	path, cleanup := writeTestConfig(t, `sources:
+  - name: craigslist
+    rss: "https://x.example/feed"
+  - name: board
+    url: "https://x.example/{side}"
+    result: "div["
+  - name: both
+    url: "https://x.example/{side}"
+    rss: "https://x.example/{side}"
+`)
+	defer cleanup()
+
+	_, err := loadConfig([]string{"-config", path})
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+	for _, expected := range []string{
+		"sources[0]: name \"craigslist\" is already taken",
+		"sources[0]: \"https://x.example/feed\" should contain {side} or {top}",
+		"sources[1]: \"div[\" is not a CSS selector",
+		"sources[2]: give url or rss, not both",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q in %v", expected, err)
+		}
+	}
+}
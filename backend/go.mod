@@ -1,18 +1,13 @@
 module craigsmatrix
 
-go 1.15
+go 1.16
 
 require (
-	github.com/PuerkitoBio/goquery v1.6.1 // indirect
-	github.com/antchfx/htmlquery v1.2.3 // indirect
-	github.com/antchfx/xmlquery v1.3.3 // indirect
-	github.com/gobwas/glob v0.2.3 // indirect
-	github.com/gocolly/colly v1.2.0
+	github.com/PuerkitoBio/goquery v1.6.1
+	github.com/andybalholm/cascadia v1.1.0
 	github.com/julienschmidt/httprouter v1.3.0
-	github.com/kennygrant/sanitize v1.2.4 // indirect
 	github.com/pkg/errors v0.9.1
-	github.com/saintfish/chardet v0.0.0-20120816061221-3af4cd4741ca // indirect
-	github.com/temoto/robotstxt v1.1.1 // indirect
+	github.com/temoto/robotstxt v1.1.1
 	golang.org/x/net v0.0.0-20210119194325-5f4716e94777
-	google.golang.org/appengine v1.6.7 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
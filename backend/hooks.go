@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HooksConfig is the hooks: section of the config file.  Each command is
+// run with the event as JSON on stdin.
+type HooksConfig struct {
+	Timeout  duration     `yaml:"timeout"`
+	Commands []HookConfig `yaml:"commands"`
+}
+
+// HookConfig is one command and the event that runs it
+type HookConfig struct {
+	On      string   `yaml:"on"`      // refresh or new_listings
+	Command []string `yaml:"command"` // program and arguments, no shell
+}
+
+// events hooks can run on
+const (
+	hookEventRefresh     = "refresh"
+	hookEventNewListings = "new_listings"
+)
+
+func defaultHooksConfig() HooksConfig {
+	return HooksConfig{Timeout: duration(30 * time.Second)}
+}
+
+// validate returns one message per problem
+func (c HooksConfig) validate() []string {
+	var errs []string
+	if c.Timeout <= 0 {
+		errs = append(errs, "hooks.timeout: must be positive")
+	}
+	for i, h := range c.Commands {
+		if h.On != hookEventRefresh && h.On != hookEventNewListings {
+			errs = append(errs, fmt.Sprintf("hooks.commands[%d].on: %q should be refresh or new_listings", i, h.On))
+		}
+		if len(h.Command) == 0 || h.Command[0] == "" {
+			errs = append(errs, fmt.Sprintf("hooks.commands[%d].command: must name a program", i))
+		}
+	}
+	return errs
+}
+
+// HookEvent is what a hook gets on stdin
+type HookEvent struct {
+	Event     string        `json:"event"`
+	TableID   int           `json:"tableId"`
+	TableName string        `json:"tableName"`
+	Time      time.Time     `json:"time"`
+	Cells     []CellRefresh `json:"cells"`
+}
+
+// HookRun is one entry of the hook log
+type HookRun struct {
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	Command    string    `json:"command"`
+	TableID    int       `json:"tableId"`
+	DurationMs int64     `json:"durationMs"`
+	ExitCode   int       `json:"exitCode"`
+	OK         bool      `json:"ok"`
+	Error      string    `json:"error,omitempty"`
+	Output     string    `json:"output"`
+}
+
+var maxHookLog = 200
+
+// a hook's stdout and stderr are kept up to this many bytes
+var maxHookOutput = 16 * 1024
+
+// HookRunner runs the configured hooks in the background, so a slow or
+// broken hook never holds up or takes down a refresh
+type HookRunner struct {
+	hooks   []HookConfig
+	timeout time.Duration
+
+	mu  sync.Mutex
+	log []HookRun
+	wg  sync.WaitGroup
+}
+
+func newHookRunner(c HooksConfig) *HookRunner {
+	return &HookRunner{hooks: c.Commands, timeout: time.Duration(c.Timeout)}
+}
+
+var hookRunner *HookRunner
+
+// setHookRunner makes h the one that runs on refreshes, nil for none
+func setHookRunner(h *HookRunner) {
+	hookRunner = h
+	if h == nil || len(h.hooks) == 0 {
+		setRefreshListener("hooks", nil)
+		return
+	}
+	setRefreshListener("hooks", h.onRefresh)
+}
+
+func (h *HookRunner) onRefresh(r TableRefresh) {
+	events := map[string]HookEvent{
+		hookEventRefresh: {Event: hookEventRefresh, TableID: r.TableID, TableName: r.TableName, Time: r.Time, Cells: r.Cells},
+	}
+	if r.newListingCount() > 0 {
+		events[hookEventNewListings] = HookEvent{Event: hookEventNewListings, TableID: r.TableID, TableName: r.TableName, Time: r.Time, Cells: r.cellsWithNewListings()}
+	}
+
+	for _, hook := range h.hooks {
+		event, found := events[hook.On]
+		if !found {
+			continue
+		}
+		h.wg.Add(1)
+		go func(hook HookConfig) {
+			defer h.wg.Done()
+			h.run(hook, event)
+		}(hook)
+	}
+}
+
+// wait blocks until every hook started so far has finished
+func (h *HookRunner) wait() {
+	h.wg.Wait()
+}
+
+// limitedBuffer keeps the first max bytes written to it and drops the rest
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.buf.Len(); room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *limitedBuffer) String() string {
+	if b.truncated {
+		return b.buf.String() + "\n[output truncated]"
+	}
+	return b.buf.String()
+}
+
+func (h *HookRunner) run(hook HookConfig, event HookEvent) {
+	entry := HookRun{Time: time.Now(), Event: event.Event, Command: strings.Join(hook.Command, " "), TableID: event.TableID}
+	defer func() {
+		if r := recover(); r != nil {
+			entry.Error = fmt.Sprintf("hook panicked: %v", r)
+			entry.OK = false
+		}
+		h.record(entry)
+	}()
+
+	stdin, err := json.Marshal(event)
+	if err != nil {
+		entry.Error = err.Error()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	cmd := exec.Command(hook.Command[0], hook.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	output := &limitedBuffer{max: maxHookOutput}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	setHookProcessGroup(cmd)
+
+	start := time.Now()
+	err = cmd.Start()
+	if err == nil {
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+			killHookProcess(cmd)
+			err = <-done
+		}
+	}
+	entry.DurationMs = int64(time.Since(start) / time.Millisecond)
+	entry.Output = output.String()
+	if cmd.ProcessState != nil {
+		entry.ExitCode = cmd.ProcessState.ExitCode()
+	}
+
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		entry.Error = fmt.Sprintf("killed after %v", h.timeout)
+	case err != nil:
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			entry.ExitCode = -1
+		}
+		entry.Error = err.Error()
+	default:
+		entry.OK = true
+	}
+}
+
+func (h *HookRunner) record(entry HookRun) {
+	if entry.OK {
+		debugf("hook %s on %s: ok in %dms\n", entry.Command, entry.Event, entry.DurationMs)
+	} else {
+		warnf("hook %s on %s: %s\n", entry.Command, entry.Event, entry.Error)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.log = append(h.log, entry)
+	if len(h.log) > maxHookLog {
+		h.log = h.log[len(h.log)-maxHookLog:]
+	}
+}
+
+// runs is the hook log, newest first
+func (h *HookRunner) runs() []HookRun {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	log := make([]HookRun, len(h.log))
+	for i, r := range h.log {
+		log[len(h.log)-1-i] = r
+	}
+	return log
+}
@@ -0,0 +1,13 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package main
+
+import "os/exec"
+
+// without process groups only the hook itself can be killed
+func setHookProcessGroup(cmd *exec.Cmd) {}
+
+func killHookProcess(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
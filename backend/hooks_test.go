@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_hooks_getTheEventOnStdin(t *testing.T) {
+	stub := setUpStubTable(t, Listing{Title: "Oak desk", URL: "https://stub.example/1"})
+
+	c := defaultHooksConfig()
+	c.Commands = []HookConfig{
+		{On: "refresh", Command: []string{"cat"}},
+		{On: "new_listings", Command: []string{"sh", "-c", "cat; echo oops >&2; exit 3"}},
+	}
+	setHookRunner(newHookRunner(c))
+	defer setHookRunner(nil)
+
+	updateTableData(0) // first fetch: a refresh but nothing new
+	hookRunner.wait()
+	stub.listings = append(stub.listings, Listing{Title: "Pine desk", URL: "https://stub.example/2"})
+	updateTableData(0)
+	hookRunner.wait()
+
+	runs := hookRunner.runs()
+	if len(runs) != 3 {
+		t.Fatalf("expected two refresh runs and one new_listings run, got %+v", runs)
+	}
+
+	var newListingsRun HookRun
+	for _, r := range runs {
+		if r.Event == "new_listings" {
+			newListingsRun = r
+		} else if !r.OK || r.ExitCode != 0 {
+			t.Fatalf("cat should have succeeded: %+v", r)
+		}
+	}
+	if newListingsRun.OK || newListingsRun.ExitCode != 3 || !strings.HasSuffix(newListingsRun.Output, "oops\n") {
+		t.Fatalf("failing hook not logged: %+v", newListingsRun)
+	}
+
+	var event HookEvent
+	if err := json.NewDecoder(strings.NewReader(newListingsRun.Output)).Decode(&event); err != nil {
+		t.Fatalf("hook didn't get JSON on stdin: %v\n%s", err, newListingsRun.Output)
+	}
+	if event.Event != "new_listings" || len(event.Cells) != 1 || event.Cells[0].NewListings[0].Title != "Pine desk" {
+		t.Fatalf("wrong event: %+v", event)
+	}
+
+	rec := postAPI("/api/admin/hooks", `{}`)
+	expectStatus(t, rec, http.StatusOK)
+	var log []HookRun
+	if err := json.Unmarshal(rec.Body.Bytes(), &log); err != nil || len(log) != 3 {
+		t.Fatalf("hook log not served: %s", rec.Body.String())
+	}
+}
+
+func Test_hooks_timeoutsAndMissingProgramsDontBlock(t *testing.T) {
+	c := defaultHooksConfig()
+	c.Timeout = duration(100 * time.Millisecond)
+	c.Commands = []HookConfig{
+		// the shell's children hold the output pipe, so they have to go too
+		{On: "refresh", Command: []string{"sh", "-c", "sleep 5"}},
+		{On: "refresh", Command: []string{"sh", "-c", "sleep 5; echo woke"}},
+		{On: "refresh", Command: []string{"sh", "-c", "sleep 5 & echo started"}},
+		{On: "refresh", Command: []string{"/no/such/program"}},
+	}
+	h := newHookRunner(c)
+
+	start := time.Now()
+	h.onRefresh(TableRefresh{TableID: 1, Time: time.Now()})
+	if time.Since(start) > 50*time.Millisecond {
+		t.Fatal("starting hooks shouldn't wait for them")
+	}
+	h.wait()
+	if time.Since(start) > 3*time.Second {
+		t.Fatal("the sleeping hook should have been killed")
+	}
+
+	for _, r := range h.runs() {
+		if r.OK {
+			t.Fatalf("both hooks should have failed: %+v", r)
+		}
+		if strings.HasPrefix(r.Command, "sh") && !strings.Contains(r.Error, "killed after") {
+			t.Fatalf("expected a timeout: %+v", r)
+		}
+		if strings.HasPrefix(r.Command, "/no/such") && r.ExitCode != -1 {
+			t.Fatalf("expected exit code -1 for a missing program: %+v", r)
+		}
+	}
+}
+
+func Test_limitedBuffer_truncates(t *testing.T) {
+	b := &limitedBuffer{max: 4}
+	b.Write([]byte("abc"))
+	b.Write([]byte("def"))
+	if b.String() != "abcd\n[output truncated]" {
+		t.Fatalf("got %q", b.String())
+	}
+}
+
+func Test_HooksConfig_validate(t *testing.T) {
+	c := defaultHooksConfig()
+	c.Commands = []HookConfig{{On: "startup", Command: []string{}}}
+	errs := strings.Join(c.validate(), "\n")
+	if !strings.Contains(errs, "hooks.commands[0].on") || !strings.Contains(errs, "hooks.commands[0].command") {
+		t.Fatalf("expected both problems, got %s", errs)
+	}
+}
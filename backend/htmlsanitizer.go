@@ -0,0 +1,220 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// class added to result rows whose listing hasn't been seen before
+var newListingClass = "craigsmatrix-new"
+
+// elements that are kept, with the attributes they may keep
+var sanitizerAllowedElements = map[string][]string{
+	"ul":     {"class"},
+	"ol":     {"class"},
+	"li":     {"class", "data-pid"},
+	"div":    {"class"},
+	"p":      {"class"},
+	"span":   {"class"},
+	"h3":     {"class"},
+	"a":      {"class", "href"},
+	"img":    {"class", "src", "alt"},
+	"time":   {"class", "datetime", "title"},
+	"b":      {},
+	"i":      {},
+	"strong": {},
+	"em":     {},
+	"small":  {},
+	"br":     {},
+}
+
+// elements dropped together with everything inside them.
+// Anything else that isn't allowed is unwrapped, keeping its children.
+var sanitizerDroppedElements = map[string]bool{
+	"script":   true,
+	"style":    true,
+	"iframe":   true,
+	"object":   true,
+	"embed":    true,
+	"form":     true,
+	"input":    true,
+	"button":   true,
+	"select":   true,
+	"textarea": true,
+	"noscript": true,
+	"svg":      true,
+	"link":     true,
+	"meta":     true,
+}
+
+// images are only shown from craigslist itself, which drops tracking pixels
+var sanitizerImageHosts = []string{"craigslist.org"}
+
+// sanitizeResultRows rewrites the tree under n in place: it strips anything
+// not on the allowlist, makes links and images absolute against base, and
+// marks rows whose listing is in newLinks or not in seen.
+func sanitizeResultRows(n *html.Node, base *url.URL, seen, newLinks []string) {
+	var next *html.Node
+	for c := n.FirstChild; c != nil; c = next {
+		next = c.NextSibling
+
+		switch c.Type {
+		case html.CommentNode, html.DoctypeNode:
+			n.RemoveChild(c)
+			continue
+		case html.ElementNode:
+		default:
+			continue
+		}
+
+		if sanitizerDroppedElements[c.Data] {
+			n.RemoveChild(c)
+			continue
+		}
+
+		allowedAttrs, allowed := sanitizerAllowedElements[c.Data]
+		if !allowed {
+			// unwrap: move the children up and carry on from the first of them
+			firstChild := c.FirstChild
+			for gc := c.FirstChild; gc != nil; gc = c.FirstChild {
+				c.RemoveChild(gc)
+				n.InsertBefore(gc, c)
+			}
+			n.RemoveChild(c)
+			if firstChild != nil {
+				next = firstChild
+			}
+			continue
+		}
+
+		c.Attr = sanitizeAttributes(c, allowedAttrs, base)
+		if c.Data == "img" && attributeValue(c, "src") == "" {
+			n.RemoveChild(c)
+			continue
+		}
+		if c.Data == "li" && hasClass(c, "result-row") {
+			link := resultRowLink(c, base)
+			if link != "" && (sliceContains(newLinks, link) || !sliceContains(seen, link)) {
+				addClass(c, newListingClass)
+			}
+		}
+
+		sanitizeResultRows(c, base, seen, newLinks)
+	}
+}
+
+func sanitizeAttributes(n *html.Node, allowed []string, base *url.URL) []html.Attribute {
+	var attrs []html.Attribute
+	hasHref := false
+	for _, attr := range n.Attr {
+		if attr.Namespace != "" || !sliceContains(allowed, attr.Key) {
+			continue
+		}
+		switch attr.Key {
+		case "href":
+			abs, ok := absoluteURL(base, attr.Val)
+			if !ok {
+				continue
+			}
+			attr.Val = abs
+			hasHref = true
+		case "src":
+			abs, ok := absoluteURL(base, attr.Val)
+			if !ok || !imageHostAllowed(abs) {
+				continue
+			}
+			attr.Val = abs
+		}
+		attrs = append(attrs, attr)
+	}
+
+	if n.Data == "a" && hasHref {
+		attrs = append(attrs,
+			html.Attribute{Key: "target", Val: "_blank"},
+			html.Attribute{Key: "rel", Val: "noopener noreferrer"})
+	}
+	return attrs
+}
+
+// resolveListingLink is href as LinksAlreadySeen holds it: absolute, or as it is if it won't resolve
+func resolveListingLink(base *url.URL, href string) string {
+	if abs, ok := absoluteURL(base, href); ok {
+		return abs
+	}
+	return href
+}
+
+// absoluteURL resolves ref against base and only lets http(s) through,
+// which gets rid of javascript: and data: links
+func absoluteURL(base *url.URL, ref string) (string, bool) {
+	u, err := url.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return "", false
+	}
+	if base != nil {
+		u = base.ResolveReference(u)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", false
+	}
+	return u.String(), true
+}
+
+func imageHostAllowed(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	return hostAllowed(u.Hostname(), sanitizerImageHosts)
+}
+
+func attributeValue(n *html.Node, key string) string {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+func hasClass(n *html.Node, class string) bool {
+	for _, c := range strings.Fields(attributeValue(n, "class")) {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+func addClass(n *html.Node, class string) {
+	for i := range n.Attr {
+		if n.Attr[i].Key == "class" {
+			n.Attr[i].Val = strings.TrimSpace(n.Attr[i].Val + " " + class)
+			return
+		}
+	}
+	n.Attr = append(n.Attr, html.Attribute{Key: "class", Val: class})
+}
+
+// resultRowLink is the listing URL of a result row, the href of its
+// .result-title link
+func resultRowLink(row *html.Node, base *url.URL) string {
+	var link string
+	var f func(*html.Node)
+	f = func(n *html.Node) {
+		if link != "" {
+			return
+		}
+		if n.Type == html.ElementNode && n.Data == "a" && hasClass(n, "result-title") {
+			link = resolveListingLink(base, attributeValue(n, "href"))
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			f(c)
+		}
+	}
+	f(row)
+	return link
+}
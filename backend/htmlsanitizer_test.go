@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+var sampleResultsPage = `<html><head><script>alert(1)</script></head><body>
+<ul class="rows" onclick="steal()">
+  <li class="result-row" data-pid="1" onmouseover="track()">
+    <a href="/eby/tls/d/saw/1.html" class="result-title hdrlnk">Table saw</a>
+    <img src="https://images.craigslist.org/abc_300x300.jpg">
+    <img src="https://tracker.example.com/pixel.gif" width="1" height="1">
+    <span class="result-price">$100</span>
+    <script>evil()</script>
+    <button class="fav">fav</button>
+  </li>
+  <li class="result-row" data-pid="2">
+    <a href="https://sfbay.craigslist.org/eby/tls/d/drill/2.html" class="result-title hdrlnk">Drill</a>
+    <a href="javascript:alert(1)">bad link</a>
+    <custom-tag><b>kept text</b></custom-tag>
+  </li>
+</ul></body></html>`
+
+func Test_extractCraigslistResultRows_sanitizes(t *testing.T) {
+	out := extractCraigslistResultRows(sampleResultsPage, "https://sfbay.craigslist.org/search/tls?query=saw", nil, nil)
+
+	for _, bad := range []string{"<script", "onclick", "onmouseover", "tracker.example.com", "javascript:", "<button", "custom-tag"} {
+		if strings.Contains(out, bad) {
+			t.Fatalf("%q should have been removed:\n%s", bad, out)
+		}
+	}
+	for _, good := range []string{
+		`href="https://sfbay.craigslist.org/eby/tls/d/saw/1.html"`,
+		`src="https://images.craigslist.org/abc_300x300.jpg"`,
+		`target="_blank"`,
+		`<b>kept text</b>`,
+		`$100`,
+	} {
+		if !strings.Contains(out, good) {
+			t.Fatalf("expected %q in:\n%s", good, out)
+		}
+	}
+}
+
+func Test_extractCraigslistResultRows_marksNewListings(t *testing.T) {
+	// the page has relative hrefs; cells remember the listing URLs
+	seen := []string{"https://sfbay.craigslist.org/eby/tls/d/saw/1.html"}
+	out := extractCraigslistResultRows(sampleResultsPage, "https://sfbay.craigslist.org/search/tls", seen, nil)
+
+	rows := strings.Split(out, "<li")
+	if strings.Contains(rows[1], newListingClass) || !strings.Contains(rows[2], newListingClass) {
+		t.Fatalf("only the drill should be marked new:\n%s", out)
+	}
+
+	out = extractCraigslistResultRows(sampleResultsPage, "https://sfbay.craigslist.org/search/tls", seen, seen)
+	if strings.Count(out, newListingClass) != 2 {
+		t.Fatalf("links that were new at the last refresh should stay marked:\n%s", out)
+	}
+}
+
+func Test_extractCraigslistResultRows_noResults(t *testing.T) {
+	out := extractCraigslistResultRows("<html><body>nothing here</body></html>", "https://sfbay.craigslist.org/search/tls", nil, nil)
+	if !strings.Contains(out, "No results") {
+		t.Fatalf("expected a no results message, got %q", out)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// The no-javascript UI under /html/.  Everything is a plain link or a form
+// POST that redirects back to the table.
+
+//go:embed templates
+var templateFiles embed.FS
+
+var htmlTemplateFuncs = template.FuncMap{
+	"cellAt":    htmlCellAt,
+	"cellClass": htmlCellClass,
+	"cellLabel": htmlCellLabel,
+}
+
+var htmlPages = map[string]*template.Template{
+	"tables": parseHTMLPage("tables.html"),
+	"table":  parseHTMLPage("table.html"),
+	"cell":   parseHTMLPage("cell.html"),
+}
+
+func parseHTMLPage(name string) *template.Template {
+	return template.Must(template.New(name).Funcs(htmlTemplateFuncs).
+		ParseFS(templateFiles, "templates/layout.html", "templates/"+name))
+}
+
+func addHTMLRoutes(router *httprouter.Router) {
+	router.GET("/html/", lockModel(htmlTablesHandler))
+	router.GET("/html/table/:id", lockModel(htmlTableHandler))
+	router.GET("/html/table/:id/cell/:row/:col", htmlCellHandler)
+	router.POST("/html/addtable", sameOriginOnly(lockModel(htmlAddTableHandler)))
+	router.POST("/html/table/:id/:action", sameOriginOnly(htmlTableActionHandler))
+}
+
+func renderHTMLPage(w http.ResponseWriter, page string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := htmlPages[page].ExecuteTemplate(w, "layout", data); err != nil {
+		errorf("html %s: %v\n", page, err)
+	}
+}
+
+func htmlTableFromParams(w http.ResponseWriter, p httprouter.Params) (TableModel, bool) {
+	id, err := strconv.Atoi(p.ByName("id"))
+	if err == nil {
+		if tableModel, found := model.lookupTableModelByID(id); found {
+			return tableModel, true
+		}
+	}
+	http.Error(w, "no such table", http.StatusNotFound)
+	return TableModel{}, false
+}
+
+// Handler
+func htmlTablesHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	renderHTMLPage(w, "tables", map[string]interface{}{
+		"Title":     "tables",
+		"Tables":    model.TableModels,
+		"Templates": tableTemplates,
+	})
+}
+
+// Handler
+func htmlTableHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	tableModel, found := htmlTableFromParams(w, p)
+	if !found {
+		return
+	}
+
+	var categories []string
+	for category := range categoryCodes {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+
+	renderHTMLPage(w, "table", map[string]interface{}{
+		"Title":      tableModel.Name,
+		"Table":      tableModel,
+		"Categories": categories,
+	})
+}
+
+type htmlSortOption struct {
+	Value string
+	Label string
+}
+
+var htmlSortOptions = []htmlSortOption{
+	{"-date", "newest first"},
+	{"date", "oldest first"},
+	{"price", "cheapest first"},
+	{"-price", "most expensive first"},
+	{"title", "title"},
+}
+
+// Handler.  It fetches, so it locks the model only to look the cell up.
+func htmlCellHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id, err := strconv.Atoi(p.ByName("id"))
+	row, _ := strconv.Atoi(p.ByName("row"))
+	col, _ := strconv.Atoi(p.ByName("col"))
+	var tableModel TableModel
+	var cell CellModel
+	tableFound, cellFound := false, false
+	withModel(func() {
+		tableModel, tableFound = model.lookupTableModelByID(id)
+		cell, cellFound = model.lookupCell(id, row, col)
+	})
+	if err != nil || !tableFound {
+		http.Error(w, "no such table", http.StatusNotFound)
+		return
+	}
+	if !cellFound {
+		http.Error(w, "no such cell", http.StatusNotFound)
+		return
+	}
+
+	form := r.URL.Query()
+	query := ListingQuery{
+		Sort:       form.Get("sort"),
+		Text:       form.Get("text"),
+		UnseenOnly: form.Get("unseenOnly") == "true",
+	}
+	if query.Sort == "" {
+		query.Sort = "-date"
+	}
+	if n, err := strconv.Atoi(form.Get("minPrice")); err == nil {
+		query.MinPrice = &n
+	}
+	if n, err := strconv.Atoi(form.Get("maxPrice")); err == nil {
+		query.MaxPrice = &n
+	}
+	query.Page, _ = strconv.Atoi(form.Get("page"))
+
+	data := map[string]interface{}{
+		"Title":       tableModel.SideHeadings[row] + " in " + tableModel.TopHeadings[col],
+		"Table":       tableModel,
+		"Cell":        cell,
+		"Side":        tableModel.SideHeadings[row],
+		"Top":         tableModel.TopHeadings[col],
+		"Query":       query,
+		"MinPrice":    form.Get("minPrice"),
+		"MaxPrice":    form.Get("maxPrice"),
+		"SortOptions": htmlSortOptions,
+	}
+
+	listings, err := cellListings(tableModel, cell)
+	var page ListingPage
+	if err == nil {
+		page, err = applyListingQuery(listings, query)
+	}
+	if err != nil {
+		data["Error"] = err.Error()
+	} else {
+		data["Page"] = page
+		if page.Page > 1 {
+			data["PrevPage"] = htmlPageQuery(form, page.Page-1)
+		}
+		if page.Page*page.PageSize < page.Total {
+			data["NextPage"] = htmlPageQuery(form, page.Page+1)
+		}
+	}
+
+	renderHTMLPage(w, "cell", data)
+}
+
+// htmlPageQuery is the current query string pointed at another page
+func htmlPageQuery(form url.Values, page int) template.URL {
+	q := url.Values{}
+	for k, v := range form {
+		q[k] = v
+	}
+	q.Set("page", strconv.Itoa(page))
+	return template.URL(q.Encode())
+}
+
+// Handler
+func htmlAddTableHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if template := r.FormValue("template"); template != "" {
+		if _, err := addTableFromTemplate(template); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/html/table/%d", getActiveTableID()), http.StatusSeeOther)
+		return
+	}
+	addTable()
+	http.Redirect(w, r, fmt.Sprintf("/html/table/%d", getActiveTableID()), http.StatusSeeOther)
+}
+
+// Handler.  A refresh fetches, so only that locks the model as it goes;
+// every other action is model work, done with it locked.
+func htmlTableActionHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if p.ByName("action") == "refresh" {
+		htmlRefreshTableHandler(w, r, p)
+		return
+	}
+	lockModel(htmlEditTableHandler)(w, r, p)
+}
+
+func htmlRefreshTableHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id, err := strconv.Atoi(p.ByName("id"))
+	found := false
+	withModel(func() {
+		_, found = model.lookupTableModelByID(id)
+	})
+	if err != nil || !found {
+		http.Error(w, "no such table", http.StatusNotFound)
+		return
+	}
+	updateTableData(id)
+	http.Redirect(w, r, fmt.Sprintf("/html/table/%d", id), http.StatusSeeOther)
+}
+
+func htmlEditTableHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	tableModel, found := htmlTableFromParams(w, p)
+	if !found {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id := tableModel.ID
+
+	switch p.ByName("action") {
+	case "rename":
+		setActiveTableModelID(id)
+		updateTableName(r.FormValue("name"))
+	case "category":
+		if _, ok := categoryCodes[r.FormValue("category")]; !ok {
+			http.Error(w, "unknown category", http.StatusBadRequest)
+			return
+		}
+		setActiveTableModelID(id)
+		updateTableCategory(r.FormValue("category"))
+	case "heading":
+		fieldType := r.FormValue("fieldType")
+		fieldIndex, err := strconv.Atoi(r.FormValue("fieldIndex"))
+		headings := tableModel.TopHeadings
+		if fieldType == "side" {
+			headings = tableModel.SideHeadings
+		}
+		if err != nil || (fieldType != "top" && fieldType != "side") || fieldIndex < 0 || fieldIndex >= len(headings) {
+			http.Error(w, "bad heading", http.StatusBadRequest)
+			return
+		}
+		editTableModelField(id, fieldIndex, r.FormValue("fieldValue"), fieldType)
+	case "headings":
+		if err := updateHeadingsInBulk(id, r.FormValue("axis"), r.FormValue("mode"), r.FormValue("text")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case "addtop":
+		addTopField(id)
+	case "addside":
+		addSideField(id)
+	case "deletetop":
+		if len(tableModel.TopHeadings) > 0 {
+			deleteTopField(id)
+		}
+	case "deleteside":
+		if len(tableModel.SideHeadings) > 0 {
+			deleteSideField(id)
+		}
+	case "clone":
+		cloneID := cloneTable(id, r.FormValue("history") != "", r.FormValue("name"))
+		http.Redirect(w, r, fmt.Sprintf("/html/table/%d", cloneID), http.StatusSeeOther)
+		return
+	case "delete":
+		if len(model.TableModels) > 1 {
+			setActiveTableModelID(id)
+			deleteTable()
+		}
+		http.Redirect(w, r, "/html/", http.StatusSeeOther)
+		return
+	default:
+		http.Error(w, "unknown action", http.StatusNotFound)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/html/table/%d", id), http.StatusSeeOther)
+}
+
+func htmlCellAt(tableModel TableModel, row, col int) *CellModel {
+	if row >= len(tableModel.Rows) || col >= len(tableModel.Rows[row]) {
+		return nil
+	}
+	return &tableModel.Rows[row][col]
+}
+
+func htmlCellClass(cell *CellModel) string {
+	switch {
+	case cell.Status == cellStatusError:
+		return "error"
+	case cell.Status == cellStatusPending || cell.Status == "":
+		return "pending"
+	case cell.Hits > 0:
+		return "hits"
+	}
+	return ""
+}
+
+func htmlCellLabel(cell *CellModel) string {
+	switch cell.Status {
+	case cellStatusError:
+		return "error"
+	case cellStatusOK:
+		return fmt.Sprintf("%d new / %d", cell.Hits, cell.ResultCount)
+	}
+	return "not fetched"
+}
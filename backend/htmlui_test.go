@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func makeHTMLTestRouter() *httprouter.Router {
+	router := httprouter.New()
+	addHTMLRoutes(router)
+	return router
+}
+
+func Test_htmlTableHandler_rendersMatrix(t *testing.T) {
+	clearModel_andSetMockModelDiskWriter()
+	setModel(makeNewModel())
+	model.TableModels[0].Rows = [][]CellModel{{{Status: cellStatusOK, Hits: 3, ResultCount: 10}}}
+
+	rec := httptest.NewRecorder()
+	makeHTMLTestRouter().ServeHTTP(rec, httptest.NewRequest("GET", "/html/table/0", nil))
+
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK || !strings.Contains(body, "3 new / 10") || !strings.Contains(body, "SideHeading") {
+		t.Fatalf("matrix not rendered: %d\n%s", rec.Code, body)
+	}
+}
+
+func Test_htmlTableHandler_unknownTableIs404(t *testing.T) {
+	clearModel_andSetMockModelDiskWriter()
+	setModel(makeNewModel())
+
+	rec := httptest.NewRecorder()
+	makeHTMLTestRouter().ServeHTTP(rec, httptest.NewRequest("GET", "/html/table/42", nil))
+
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", rec.Code)
+	}
+}
+
+func Test_htmlTableActionHandler_editsHeadingAndRedirects(t *testing.T) {
+	clearModel_andSetMockModelDiskWriter()
+	setModel(makeNewModel())
+
+	form := url.Values{"fieldType": {"top"}, "fieldIndex": {"0"}, "fieldValue": {"sfbay"}}
+	req := httptest.NewRequest("POST", "/html/table/0/heading", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	makeHTMLTestRouter().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/html/table/0" {
+		t.Fatalf("expected a redirect back to the table, got %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+	if model.TableModels[0].TopHeadings[0] != "sfbay" || !mockModelDiskWriter.isWriteCalled() {
+		t.Fatalf("heading not saved: %v", model.TableModels[0].TopHeadings)
+	}
+}
+
+func Test_htmlForms_refuseOtherSites(t *testing.T) {
+	clearModel_andSetMockModelDiskWriter()
+	setModel(makeNewModel())
+
+	post := func(path string, headers map[string]string) int {
+		form := url.Values{"fieldType": {"top"}, "fieldIndex": {"0"}, "fieldValue": {"evil"}}
+		req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		makeHTMLTestRouter().ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for _, headers := range []map[string]string{
+		{"Origin": "https://evil.example"},
+		{"Origin": "null"},
+		{"Referer": "https://evil.example/page.html"},
+		{"Origin": "https://evil.example", "Referer": "http://example.com/html/table/0"},
+	} {
+		for _, path := range []string{"/html/table/0/heading", "/html/addtable"} {
+			if code := post(path, headers); code != http.StatusForbidden {
+				t.Fatalf("%s from %v: expected 403, got %d", path, headers, code)
+			}
+		}
+	}
+	if model.TableModels[0].TopHeadings[0] == "evil" || len(model.TableModels) != 1 {
+		t.Fatal("a refused form shouldn't change anything")
+	}
+
+	// httptest requests are to example.com
+	if code := post("/html/table/0/heading", map[string]string{"Origin": "http://example.com"}); code != http.StatusSeeOther {
+		t.Fatalf("a form from this site should work, got %d", code)
+	}
+	if code := post("/html/table/0/heading", map[string]string{"Referer": "http://example.com/html/table/0"}); code != http.StatusSeeOther {
+		t.Fatalf("a form from this site should work, got %d", code)
+	}
+}
+
+func Test_htmlCellHandler_listsListings(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(sampleListingsPage))
+	}))
+	defer server.Close()
+	allowLocalPages(t)
+
+	clearModel_andSetMockModelDiskWriter()
+	setModel(makeNewModel())
+	model.TableModels[0].Rows = [][]CellModel{{{PageURL: server.URL + "/search/fuo", Status: cellStatusOK}}}
+
+	rec := httptest.NewRecorder()
+	makeHTMLTestRouter().ServeHTTP(rec, httptest.NewRequest("GET", "/html/table/0/cell/0/0?maxPrice=500", nil))
+
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK || !strings.Contains(body, "2 listings") || !strings.Contains(body, "Oak desk") {
+		t.Fatalf("listings not rendered: %d\n%s", rec.Code, body)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var defaulthttpcachedir = "./data/httpcache"
+var defaulthttpcachettl = 10 * time.Minute
+
+var httpCache *HTTPCache
+
+func setHTTPCache(c *HTTPCache) {
+	httpCache = c
+}
+
+// HTTPCache is an on-disk cache of GET responses.
+// Entries younger than the TTL are served without touching the network,
+// older ones are revalidated with If-None-Match / If-Modified-Since.
+type HTTPCache struct {
+	dir  string
+	ttl  time.Duration
+	next http.RoundTripper
+
+	mu          sync.Mutex
+	hits        int
+	misses      int
+	revalidated int
+}
+
+type httpCacheEntry struct {
+	URL        string      `json:"url"`
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+	FetchedAt  time.Time   `json:"fetchedAt"`
+}
+
+// HTTPCacheEntryInfo describes one cached URL for the admin endpoint
+type HTTPCacheEntryInfo struct {
+	URL          string    `json:"url"`
+	FetchedAt    time.Time `json:"fetchedAt"`
+	AgeSeconds   int       `json:"ageSeconds"`
+	Fresh        bool      `json:"fresh"`
+	Size         int       `json:"size"`
+	ETag         string    `json:"etag"`
+	LastModified string    `json:"lastModified"`
+}
+
+// HTTPCacheInfo is what the admin endpoint returns
+type HTTPCacheInfo struct {
+	Dir         string               `json:"dir"`
+	TTLSeconds  int                  `json:"ttlSeconds"`
+	Hits        int                  `json:"hits"`
+	Misses      int                  `json:"misses"`
+	Revalidated int                  `json:"revalidated"`
+	Entries     []HTTPCacheEntryInfo `json:"entries"`
+}
+
+func newHTTPCache(dir string, ttl time.Duration, next http.RoundTripper) *HTTPCache {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &HTTPCache{dir: dir, ttl: ttl, next: next}
+}
+
+// RoundTrip implements http.RoundTripper
+func (c *HTTPCache) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return c.next.RoundTrip(req)
+	}
+
+	key := req.URL.String()
+	entry, found := c.load(key)
+
+	if found && time.Since(entry.FetchedAt) < c.ttl {
+		c.count(&c.hits)
+		return entry.response(req), nil
+	}
+
+	outreq := req
+	if found {
+		outreq = req.Clone(req.Context())
+		if etag := entry.Header.Get("ETag"); etag != "" {
+			outreq.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := entry.Header.Get("Last-Modified"); lastModified != "" {
+			outreq.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	resp, err := c.next.RoundTrip(outreq)
+	if err != nil {
+		return nil, err
+	}
+
+	if found && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		c.count(&c.revalidated)
+		entry.FetchedAt = time.Now()
+		c.save(entry)
+		return entry.response(req), nil
+	}
+
+	c.count(&c.misses)
+	if resp.StatusCode != http.StatusOK {
+		return resp, nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	entry = httpCacheEntry{
+		URL:        key,
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       body,
+		FetchedAt:  time.Now(),
+	}
+	c.save(entry)
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+func (c *HTTPCache) count(counter *int) {
+	c.mu.Lock()
+	*counter++
+	c.mu.Unlock()
+}
+
+func (c *HTTPCache) pathFor(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (c *HTTPCache) load(url string) (httpCacheEntry, bool) {
+	var entry httpCacheEntry
+
+	c.mu.Lock()
+	b, err := ioutil.ReadFile(c.pathFor(url))
+	c.mu.Unlock()
+	if err != nil {
+		return entry, false
+	}
+	if err := json.Unmarshal(b, &entry); err != nil || entry.URL != url {
+		return entry, false
+	}
+	return entry, true
+}
+
+func (c *HTTPCache) save(entry httpCacheEntry) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		printf("httpcache: %v\n", err)
+		return
+	}
+	if err := ioutil.WriteFile(c.pathFor(entry.URL), b, 0644); err != nil {
+		printf("httpcache: %v\n", err)
+	}
+}
+
+func (c *HTTPCache) info() HTTPCacheInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info := HTTPCacheInfo{
+		Dir:         c.dir,
+		TTLSeconds:  int(c.ttl / time.Second),
+		Hits:        c.hits,
+		Misses:      c.misses,
+		Revalidated: c.revalidated,
+		Entries:     []HTTPCacheEntryInfo{},
+	}
+
+	files, _ := ioutil.ReadDir(c.dir)
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(c.dir, f.Name()))
+		if err != nil {
+			continue
+		}
+		var entry httpCacheEntry
+		if json.Unmarshal(b, &entry) != nil {
+			continue
+		}
+		age := time.Since(entry.FetchedAt)
+		info.Entries = append(info.Entries, HTTPCacheEntryInfo{
+			URL:          entry.URL,
+			FetchedAt:    entry.FetchedAt,
+			AgeSeconds:   int(age / time.Second),
+			Fresh:        age < c.ttl,
+			Size:         len(entry.Body),
+			ETag:         entry.Header.Get("ETag"),
+			LastModified: entry.Header.Get("Last-Modified"),
+		})
+	}
+
+	sort.Slice(info.Entries, func(i, j int) bool {
+		return info.Entries[i].FetchedAt.After(info.Entries[j].FetchedAt)
+	})
+	return info
+}
+
+func (c *HTTPCache) clear() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	files, _ := ioutil.ReadDir(c.dir)
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		if os.Remove(filepath.Join(c.dir, f.Name())) == nil {
+			removed++
+		}
+	}
+	c.hits, c.misses, c.revalidated = 0, 0, 0
+	return removed
+}
+
+func (e httpCacheEntry) response(req *http.Request) *http.Response {
+	header := e.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("X-Craigsmatrix-Cache", "HIT")
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode)),
+		StatusCode:    e.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func makeTestHTTPCache(t *testing.T, ttl time.Duration) (*HTTPCache, func()) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newHTTPCache(dir, ttl, http.DefaultTransport), func() { os.RemoveAll(dir) }
+}
+
+func getThroughCache(t *testing.T, c *HTTPCache, url string) string {
+	client := http.Client{Transport: c}
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	return string(b)
+}
+
+func Test_httpCache_freshEntry_doesNotHitNetwork(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	c, cleanup := makeTestHTTPCache(t, time.Minute)
+	defer cleanup()
+
+	first := getThroughCache(t, c, server.URL)
+	second := getThroughCache(t, c, server.URL)
+
+	if first != "hello" || second != "hello" {
+		t.Fatalf("wrong bodies: %q %q", first, second)
+	}
+	if requests != 1 {
+		t.Fatalf("expected 1 request to the server, got %d", requests)
+	}
+}
+
+func Test_httpCache_staleEntry_isRevalidatedWithETag(t *testing.T) {
+	conditional := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			conditional++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	c, cleanup := makeTestHTTPCache(t, 0)
+	defer cleanup()
+
+	getThroughCache(t, c, server.URL)
+	second := getThroughCache(t, c, server.URL)
+
+	if second != "hello" {
+		t.Fatalf("revalidated response should come from the cache, got %q", second)
+	}
+	if conditional != 1 || c.info().Revalidated != 1 {
+		t.Fatalf("expected one conditional request, got %d", conditional)
+	}
+}
+
+func Test_httpCache_clear_removesEntries(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	c, cleanup := makeTestHTTPCache(t, time.Minute)
+	defer cleanup()
+
+	getThroughCache(t, c, server.URL+"/a")
+	getThroughCache(t, c, server.URL+"/b")
+
+	if len(c.info().Entries) != 2 {
+		t.Fatalf("expected 2 entries")
+	}
+	if removed := c.clear(); removed != 2 {
+		t.Fatalf("expected 2 removed, got %d", removed)
+	}
+	if len(c.info().Entries) != 0 {
+		t.Fatalf("expected no entries after clear")
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// Listing is one search result, as returned by /api/listings
+type Listing struct {
+	ID          string    `json:"id"`
+	Title       string    `json:"title"`
+	URL         string    `json:"url"`
+	Price       int       `json:"price"`
+	HasPrice    bool      `json:"hasPrice"`
+	Date        time.Time `json:"date"`
+	Hood        string    `json:"hood"`
+	Seen        bool      `json:"seen"`
+	Duplicate   bool      `json:"duplicate"`
+	DuplicateOf string    `json:"duplicateOf"`
+}
+
+// ListingQuery is how the client asks for a sorted, filtered page of listings
+type ListingQuery struct {
+	Sort       string `json:"sort"` // date, -date, price, -price, title, -title
+	MinPrice   *int   `json:"minPrice"`
+	MaxPrice   *int   `json:"maxPrice"`
+	Text       string `json:"text"`
+	UnseenOnly bool   `json:"unseenOnly"`
+	HideDups   bool   `json:"hideDuplicates"`
+	Page       int    `json:"page"`
+	PageSize   int    `json:"pageSize"`
+}
+
+// ListingPage is one page of results
+type ListingPage struct {
+	Total    int       `json:"total"`
+	Page     int       `json:"page"`
+	PageSize int       `json:"pageSize"`
+	Listings []Listing `json:"listings"`
+}
+
+var defaultListingPageSize = 25
+var maxListingPageSize = 100
+
+var priceRegexp = regexp.MustCompile(`[0-9][0-9,]*`)
+
+// craigslist result dates look like 2021-01-20 10:30
+var craigslistDateLayouts = []string{"2006-01-02 15:04", time.RFC3339}
+
+// parseCraigslistListings pulls the result rows out of a search page
+func parseCraigslistListings(rawHTML, pageURL string) []Listing {
+	listings := []Listing{}
+
+	doc, err := html.Parse(strings.NewReader(rawHTML))
+	if err != nil {
+		return listings
+	}
+	base, _ := url.Parse(pageURL)
+
+	var f func(*html.Node)
+	f = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "li" && hasClass(n, "result-row") {
+			if listing, ok := parseResultRow(n, base); ok {
+				listings = append(listings, listing)
+			}
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			f(c)
+		}
+	}
+	f(doc)
+	return listings
+}
+
+func parseResultRow(row *html.Node, base *url.URL) (Listing, bool) {
+	listing := Listing{ID: attributeValue(row, "data-pid")}
+
+	var f func(*html.Node)
+	f = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch {
+			case n.Data == "a" && hasClass(n, "result-title") && listing.URL == "":
+				listing.Title = strings.TrimSpace(nodeText(n))
+				listing.URL = resolveListingLink(base, attributeValue(n, "href"))
+			case n.Data == "span" && hasClass(n, "result-price") && !listing.HasPrice:
+				listing.Price, listing.HasPrice = parsePrice(nodeText(n))
+			case n.Data == "span" && hasClass(n, "result-hood"):
+				listing.Hood = strings.Trim(strings.TrimSpace(nodeText(n)), "()")
+			case n.Data == "time" && listing.Date.IsZero():
+				listing.Date = parseCraigslistDate(attributeValue(n, "datetime"))
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			f(c)
+		}
+	}
+	f(row)
+
+	if listing.URL == "" {
+		return listing, false
+	}
+	if listing.ID == "" {
+		listing.ID = postingIDFromURL(listing.URL)
+	}
+	return listing, true
+}
+
+func nodeText(n *html.Node) string {
+	var sb strings.Builder
+	var f func(*html.Node)
+	f = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			sb.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			f(c)
+		}
+	}
+	f(n)
+	return sb.String()
+}
+
+func parsePrice(s string) (int, bool) {
+	digits := strings.Replace(priceRegexp.FindString(s), ",", "", -1)
+	if digits == "" {
+		return 0, false
+	}
+	price, err := strconv.Atoi(digits)
+	return price, err == nil
+}
+
+func parseCraigslistDate(s string) time.Time {
+	for _, layout := range craigslistDateLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// postingIDFromURL gets 7263123456 out of .../d/some-title/7263123456.html
+func postingIDFromURL(listingURL string) string {
+	u, err := url.Parse(listingURL)
+	if err != nil {
+		return listingURL
+	}
+	last := u.Path[strings.LastIndex(u.Path, "/")+1:]
+	return strings.TrimSuffix(last, ".html")
+}
+
+// markListings sets Seen from the cell's history and flags reposts: a
+// listing with the same title and price as an earlier one is a duplicate
+func markListings(listings []Listing, cell CellModel) {
+	firstByKey := map[string]string{}
+	for i := range listings {
+		l := &listings[i]
+		l.Seen = sliceContains(cell.LinksAlreadySeen, l.URL) && !sliceContains(cell.NewLinks, l.URL)
+
+		key := strings.ToLower(strings.Join(strings.Fields(l.Title), " ")) + "|" + strconv.Itoa(l.Price)
+		if first, found := firstByKey[key]; found {
+			l.Duplicate = true
+			l.DuplicateOf = first
+		} else {
+			firstByKey[key] = l.URL
+		}
+	}
+}
+
+// applyListingQuery filters, sorts and pages listings
+func applyListingQuery(listings []Listing, q ListingQuery) (ListingPage, error) {
+	words := strings.Fields(strings.ToLower(q.Text))
+
+	filtered := []Listing{}
+	for _, l := range listings {
+		if q.UnseenOnly && l.Seen {
+			continue
+		}
+		if q.HideDups && l.Duplicate {
+			continue
+		}
+		if (q.MinPrice != nil || q.MaxPrice != nil) && !l.HasPrice {
+			continue
+		}
+		if q.MinPrice != nil && l.Price < *q.MinPrice {
+			continue
+		}
+		if q.MaxPrice != nil && l.Price > *q.MaxPrice {
+			continue
+		}
+		if !containsAllWords(strings.ToLower(l.Title+" "+l.Hood), words) {
+			continue
+		}
+		filtered = append(filtered, l)
+	}
+
+	less, err := listingLess(q.Sort)
+	if err != nil {
+		return ListingPage{}, err
+	}
+	sort.SliceStable(filtered, func(i, j int) bool { return less(filtered[i], filtered[j]) })
+
+	pageSize := q.PageSize
+	if pageSize <= 0 {
+		pageSize = defaultListingPageSize
+	}
+	if pageSize > maxListingPageSize {
+		pageSize = maxListingPageSize
+	}
+	page := q.Page
+	if page < 1 {
+		page = 1
+	}
+
+	start := (page - 1) * pageSize
+	if start > len(filtered) {
+		start = len(filtered)
+	}
+	end := start + pageSize
+	if end > len(filtered) {
+		end = len(filtered)
+	}
+
+	return ListingPage{
+		Total:    len(filtered),
+		Page:     page,
+		PageSize: pageSize,
+		Listings: filtered[start:end],
+	}, nil
+}
+
+func containsAllWords(s string, words []string) bool {
+	for _, w := range words {
+		if !strings.Contains(s, w) {
+			return false
+		}
+	}
+	return true
+}
+
+func listingLess(sortBy string) (func(a, b Listing) bool, error) {
+	desc := strings.HasPrefix(sortBy, "-")
+	field := strings.TrimPrefix(sortBy, "-")
+
+	var less func(a, b Listing) bool
+	switch field {
+	case "", "date":
+		// newest first unless asked otherwise
+		if sortBy == "" {
+			desc = true
+		}
+		less = func(a, b Listing) bool { return a.Date.Before(b.Date) }
+	case "price":
+		less = func(a, b Listing) bool { return a.Price < b.Price }
+	case "title":
+		less = func(a, b Listing) bool { return strings.ToLower(a.Title) < strings.ToLower(b.Title) }
+	default:
+		return nil, fmt.Errorf("can't sort by %q, use date, price or title", sortBy)
+	}
+
+	if desc {
+		return func(a, b Listing) bool { return less(b, a) }, nil
+	}
+	return less, nil
+}
+
+// cellListings fetches the cell's search page from its source and returns
+// its listings
+func cellListings(tableModel TableModel, cell CellModel) ([]Listing, error) {
+	source, err := lookupSource(tableModel.cellSourceName(cell))
+	if err != nil {
+		return nil, err
+	}
+	listings, err := source.Listings(cell.PageURL)
+	if err != nil {
+		return nil, err
+	}
+	markListings(listings, cell)
+	return listings, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+)
+
+var sampleListingsPage = `<html><body><ul class="rows">
+<li class="result-row" data-pid="101">
+  <time class="result-date" datetime="2021-01-20 10:30">Jan 20</time>
+  <a href="https://sfbay.craigslist.org/eby/fuo/d/oak-desk/101.html" class="result-title hdrlnk">Oak desk</a>
+  <span class="result-meta"><span class="result-price">$120</span><span class="result-hood"> (oakland)</span></span>
+</li>
+<li class="result-row" data-pid="102">
+  <time class="result-date" datetime="2021-01-21 09:00">Jan 21</time>
+  <a href="/eby/fuo/d/standing-desk/102.html" class="result-title hdrlnk">Standing desk</a>
+  <span class="result-meta"><span class="result-price">$1,050</span></span>
+</li>
+<li class="result-row" data-pid="103">
+  <time class="result-date" datetime="2021-01-22 08:00">Jan 22</time>
+  <a href="https://sfbay.craigslist.org/eby/fuo/d/oak-desk/103.html" class="result-title hdrlnk">Oak  Desk</a>
+  <span class="result-meta"><span class="result-price">$120</span></span>
+</li>
+<li class="result-row" data-pid="104">
+  <time class="result-date" datetime="2021-01-19 08:00">Jan 19</time>
+  <a href="https://sfbay.craigslist.org/eby/fuo/d/chair/104.html" class="result-title hdrlnk">Free chair</a>
+</li>
+</ul></body></html>`
+
+func parseSampleListings() []Listing {
+	listings := parseCraigslistListings(sampleListingsPage, "https://sfbay.craigslist.org/search/fuo?query=desk")
+	markListings(listings, CellModel{
+		LinksAlreadySeen: []string{"https://sfbay.craigslist.org/eby/fuo/d/oak-desk/101.html", "/eby/fuo/d/standing-desk/102.html"},
+		NewLinks:         []string{"/eby/fuo/d/standing-desk/102.html"},
+	})
+	return listings
+}
+
+func Test_parseCraigslistListings_fields(t *testing.T) {
+	listings := parseSampleListings()
+	if len(listings) != 4 {
+		t.Fatalf("expected 4 listings, got %d", len(listings))
+	}
+
+	desk := listings[1]
+	if desk.ID != "102" || desk.Title != "Standing desk" || desk.Price != 1050 || !desk.HasPrice {
+		t.Fatalf("fields not parsed: %+v", desk)
+	}
+	if desk.URL != "https://sfbay.craigslist.org/eby/fuo/d/standing-desk/102.html" {
+		t.Fatalf("relative URL not made absolute: %s", desk.URL)
+	}
+	if desk.Date.Day() != 21 || listings[0].Hood != "oakland" {
+		t.Fatalf("date or hood not parsed: %+v %+v", desk, listings[0])
+	}
+	if listings[3].HasPrice {
+		t.Fatalf("a listing with no price should say so")
+	}
+}
+
+func Test_markListings_seenAndDuplicates(t *testing.T) {
+	listings := parseSampleListings()
+
+	if !listings[0].Seen || listings[1].Seen || listings[2].Seen {
+		t.Fatalf("seen flags wrong: %v %v %v", listings[0].Seen, listings[1].Seen, listings[2].Seen)
+	}
+	if !listings[2].Duplicate || listings[2].DuplicateOf != listings[0].URL || listings[0].Duplicate {
+		t.Fatalf("the repost of the oak desk should be a duplicate of the first")
+	}
+}
+
+func Test_applyListingQuery_filterSortPage(t *testing.T) {
+	listings := parseSampleListings()
+
+	maxPrice := 500
+	page, err := applyListingQuery(listings, ListingQuery{MaxPrice: &maxPrice, Sort: "-date"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 2 || page.Listings[0].ID != "103" || page.Listings[1].ID != "101" {
+		t.Fatalf("expected the two cheap desks newest first, got %+v", page.Listings)
+	}
+
+	page, _ = applyListingQuery(listings, ListingQuery{Text: "desk", UnseenOnly: true, HideDups: true})
+	if page.Total != 1 || page.Listings[0].ID != "102" {
+		t.Fatalf("expected only the standing desk, got %+v", page.Listings)
+	}
+
+	page, _ = applyListingQuery(listings, ListingQuery{Sort: "price", PageSize: 2, Page: 2})
+	if page.Total != 4 || len(page.Listings) != 2 || page.Listings[1].ID != "102" {
+		t.Fatalf("second page by price should end with the most expensive, got %+v", page.Listings)
+	}
+
+	if _, err := applyListingQuery(listings, ListingQuery{Sort: "color"}); err == nil {
+		t.Fatalf("unknown sort should be an error")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	logLevelDebug = iota
+	logLevelInfo
+	logLevelWarn
+	logLevelError
+)
+
+var logLevels = map[string]int{
+	"debug": logLevelDebug,
+	"info":  logLevelInfo,
+	"warn":  logLevelWarn,
+	"error": logLevelError,
+}
+
+var logLevel = logLevelInfo
+
+func setLogLevel(name string) {
+	if level, ok := logLevels[name]; ok {
+		logLevel = level
+	}
+}
+
+// logf prints at level and above, ending the line if s doesn't
+func logf(level int, s string, a ...interface{}) {
+	if level >= logLevel {
+		if !strings.HasSuffix(s, "\n") {
+			s += "\n"
+		}
+		fmt.Printf(s, a...)
+	}
+}
+
+func debugf(s string, a ...interface{}) {
+	logf(logLevelDebug, s, a...)
+}
+
+func warnf(s string, a ...interface{}) {
+	logf(logLevelWarn, s, a...)
+}
+
+func errorf(s string, a ...interface{}) {
+	logf(logLevelError, s, a...)
+}
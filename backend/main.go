@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"net/http"
-	//"net/url"
+	"net/url"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/pkg/errors"
@@ -13,6 +18,9 @@ import (
 
 var debug = false
 
+var listenAddress = ":8080"
+var staticDir = ""
+
 var err error
 
 type tableModelRequest struct {
@@ -62,6 +70,80 @@ type fieldEditRequest struct {
 	FieldType  string `json:"fieldType"`
 }
 
+type listingsRequest struct {
+	TableID int `json:"tableId"`
+	Row     int `json:"row"`
+	Col     int `json:"col"`
+	ListingQuery
+}
+
+type updateSourceRequest struct {
+	TableID int    `json:"tableId"`
+	Source  string `json:"source"`
+}
+
+type bulkHeadingsRequest struct {
+	TableID int    `json:"tableId"`
+	Axis    string `json:"axis"` // top or side
+	Mode    string `json:"mode"` // set or append
+	Text    string `json:"text"` // one per line, comma separated or CSV
+}
+
+type cloneTableRequest struct {
+	TableID int    `json:"tableId"`
+	History bool   `json:"history"`
+	Name    string `json:"name"` // "Copy of ..." when empty
+}
+
+type addTableFromTemplateRequest struct {
+	Template string `json:"template"`
+}
+
+type exportTableRequest struct {
+	TableID int    `json:"tableId"`
+	Format  string `json:"format"` // json or yaml
+	History bool   `json:"history"`
+}
+
+type importTableRequest struct {
+	Format   string `json:"format"` // json or yaml, or empty to guess
+	Document string `json:"document"`
+}
+
+type updateCellSourceRequest struct {
+	TableID int    `json:"tableId"`
+	Row     int    `json:"row"`
+	Col     int    `json:"col"`
+	Source  string `json:"source"`
+}
+
+type updateFiltersRequest struct {
+	TableID  int `json:"tableId"`
+	MinPrice int `json:"minPrice"`
+	MaxPrice int `json:"maxPrice"`
+}
+
+type updateDigestRequest struct {
+	TableID    int      `json:"tableId"`
+	Recipients []string `json:"recipients"`
+	Schedule   string   `json:"schedule"`
+}
+
+type sendDigestRequest struct {
+	TableID int `json:"tableId"`
+}
+
+type alertRulesRequest struct {
+	TableID int         `json:"tableId"`
+	Rules   []AlertRule `json:"rules"`
+}
+
+type alertsRequest struct {
+	TableID int       `json:"tableId"`
+	Since   time.Time `json:"since"`
+	Limit   int       `json:"limit"`
+}
+
 type requestCraigslistPageRequest struct {
 	SearchURL string `json:"searchURL"`
 }
@@ -70,35 +152,159 @@ type requestCraigslistPageResponse struct {
 }
 
 func main() {
+	cfg, err := loadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err == nil {
+		err = applyConfig(cfg)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
 	fmt.Println("craigsmatrix version blah blah blah")
 
 	setModelDiskWriter(RealModelDiskWriter{})
 	setModel(loadModelDataFile())
+	setupScrapeTransport()
+	if smtpSettings.Host != "" {
+		startDigestScheduler(time.Minute)
+	}
 
-	router := httprouter.New()
-	router.ServeFiles("/*filepath", http.Dir("./"))
-
-	router.POST("/api/", requestCraigslistPageHandler)
-	router.POST("/api/table", tableModelHandler)
-	router.POST("/api/alltablenamesandids", allTableNamesAndIDsHandler)
-	router.POST("/api/fieldedit", fieldEditHandler)
-	router.POST("/api/addtopfield", addTopFieldHandler)
-	router.POST("/api/addsidefield", addSideFieldHandler)
-	router.POST("/api/deletetopfield", deleteTopFieldHandler)
-	router.POST("/api/deletesidefield", deleteSideFieldHandler)
-	router.POST("/api/updatetabledata", updateTableDataHandler)
-	router.POST("/api/addtable", addTableHandler)
-	router.POST("/api/deletetable", deleteTableHandler)
-	router.POST("/api/activetable", activeTableRequestHandler)
-	router.POST("/api/updatetablename", updateTableNameHandler)
-	router.POST("/api/updatecategory", updateCategoryHandler)
+	router := newRouter()
 
 	//browser.OpenURL("http://localhost:8080/frontend/index.html")
 
-	fmt.Println("\nserving on 8080")
-	fmt.Println("Point your browser to http://localhost:8080")
+	fmt.Println("\nserving on " + listenAddress)
+	fmt.Println("Point your browser to http://localhost" + listenAddress[strings.LastIndex(listenAddress, ":"):])
+	fmt.Println("or, without javascript, http://localhost" + listenAddress[strings.LastIndex(listenAddress, ":"):] + "/html/")
 
-	http.ListenAndServe(":8080", router)
+	err = http.ListenAndServe(listenAddress, router)
+	fatal(err)
+}
+
+// newRouter registers every route the server answers
+func newRouter() *httprouter.Router {
+	router := httprouter.New()
+	router.Handler("GET", frontendPrefix+"/*filepath", frontendHandler(staticDir))
+	router.GET("/", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		http.Redirect(w, r, frontendPrefix+"/", http.StatusFound)
+	})
+
+	router.POST("/api/", sameOriginOnly(requestCraigslistPageHandler))
+	router.POST("/api/table", sameOriginOnly(lockModel(tableModelHandler)))
+	router.POST("/api/alltablenamesandids", sameOriginOnly(lockModel(allTableNamesAndIDsHandler)))
+	router.POST("/api/fieldedit", sameOriginOnly(lockModel(fieldEditHandler)))
+	router.POST("/api/addtopfield", sameOriginOnly(lockModel(addTopFieldHandler)))
+	router.POST("/api/addsidefield", sameOriginOnly(lockModel(addSideFieldHandler)))
+	router.POST("/api/deletetopfield", sameOriginOnly(lockModel(deleteTopFieldHandler)))
+	router.POST("/api/deletesidefield", sameOriginOnly(lockModel(deleteSideFieldHandler)))
+	router.POST("/api/bulkheadings", sameOriginOnly(lockModel(bulkHeadingsHandler)))
+	router.POST("/api/updatetabledata", sameOriginOnly(updateTableDataHandler))
+	router.POST("/api/addtable", sameOriginOnly(lockModel(addTableHandler)))
+	router.POST("/api/deletetable", sameOriginOnly(lockModel(deleteTableHandler)))
+	router.POST("/api/activetable", sameOriginOnly(lockModel(activeTableRequestHandler)))
+	router.POST("/api/updatetablename", sameOriginOnly(lockModel(updateTableNameHandler)))
+	router.POST("/api/updatecategory", sameOriginOnly(lockModel(updateCategoryHandler)))
+	router.POST("/api/listings", sameOriginOnly(listingsHandler))
+	router.POST("/api/sources", sameOriginOnly(sourcesHandler))
+	router.POST("/api/updatesource", sameOriginOnly(lockModel(updateSourceHandler)))
+	router.POST("/api/updatecellsource", sameOriginOnly(lockModel(updateCellSourceHandler)))
+	router.POST("/api/updatefilters", sameOriginOnly(lockModel(updateFiltersHandler)))
+	router.POST("/api/updatedigest", sameOriginOnly(lockModel(updateDigestHandler)))
+	router.POST("/api/senddigest", sameOriginOnly(sendDigestHandler))
+	router.POST("/api/alertrules", sameOriginOnly(lockModel(alertRulesHandler)))
+	router.POST("/api/clonetable", sameOriginOnly(lockModel(cloneTableHandler)))
+	router.POST("/api/tabletemplates", sameOriginOnly(tableTemplatesHandler))
+	router.POST("/api/addtablefromtemplate", sameOriginOnly(lockModel(addTableFromTemplateHandler)))
+	router.POST("/api/exporttable", sameOriginOnly(lockModel(exportTableHandler)))
+	router.POST("/api/importtable", sameOriginOnly(lockModel(importTableHandler)))
+	router.POST("/api/alerts", sameOriginOnly(lockModel(alertsHandler)))
+	router.POST("/api/admin/httpcache", sameOriginOnly(httpCacheInfoHandler))
+	router.POST("/api/admin/httpcache/clear", sameOriginOnly(httpCacheClearHandler))
+	router.POST("/api/admin/proxies", sameOriginOnly(proxyHealthHandler))
+	router.POST("/api/admin/notifications", sameOriginOnly(notificationLogHandler))
+	router.POST("/api/admin/hooks", sameOriginOnly(hookLogHandler))
+	router.POST("/api/admin/mqtt", sameOriginOnly(mqttStatusHandler))
+	addHTMLRoutes(router)
+	addFeedRoutes(router)
+	addExportRoutes(router)
+	router.PanicHandler = apiPanicHandler
+
+	return router
+}
+
+// sameOriginOnly refuses a POST made from another site, which a page
+// anywhere on the web could otherwise have the browser send.  Browsers say
+// where a POST came from in Origin, or failing that Referer; a request
+// with neither didn't come from a page.
+func sameOriginOnly(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		from := r.Header.Get("Origin")
+		if from == "" {
+			from = r.Header.Get("Referer")
+		}
+		if from != "" {
+			u, err := url.Parse(from)
+			if err != nil || u.Host != r.Host {
+				http.Error(w, "requests can only be made from this site", http.StatusForbidden)
+				return
+			}
+		}
+		h(w, r, p)
+	}
+}
+
+// lockModel holds modelMu for the whole of a handler that only works on
+// the model.  Its response is buffered and sent once the lock is let go,
+// so a slow client holds nobody up.  Handlers that fetch or send anything
+// lock the model themselves, around their reads and writes.
+func lockModel(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		buffered := newBufferedResponse()
+		withModel(func() {
+			h(buffered, r, p)
+		})
+		buffered.sendTo(w)
+	}
+}
+
+// bufferedResponse is an http.ResponseWriter that keeps the response
+// until sendTo
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: http.Header{}}
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponse) sendTo(w http.ResponseWriter) {
+	for k, v := range b.header {
+		w.Header()[k] = v
+	}
+	b.WriteHeader(http.StatusOK)
+	w.WriteHeader(b.status)
+	w.Write(b.body.Bytes())
 }
 
 // Handler
@@ -116,7 +322,7 @@ func tableModelHandler(w http.ResponseWriter, r *http.Request, p httprouter.Para
 func parseTableModelRequest(requestBody io.Reader) tableModelRequest {
 	var req tableModelRequest
 	err := json.NewDecoder(requestBody).Decode(&req)
-	fatal(err)
+	badRequest(err)
 	return req
 }
 
@@ -146,7 +352,7 @@ func fieldEditHandler(w http.ResponseWriter, r *http.Request, p httprouter.Param
 func parseFieldEditRequestBody(requestBody io.Reader) fieldEditRequest {
 	var req fieldEditRequest
 	err := json.NewDecoder(requestBody).Decode(&req)
-	fatal(err)
+	badRequest(err)
 	return req
 }
 
@@ -166,7 +372,7 @@ func addTopFieldHandler(w http.ResponseWriter, r *http.Request, p httprouter.Par
 func parseAddTopFieldRequestBody(requestBody io.Reader) addTopFieldRequest {
 	var req addTopFieldRequest
 	err := json.NewDecoder(requestBody).Decode(&req)
-	fatal(err)
+	badRequest(err)
 	return req
 }
 
@@ -186,7 +392,7 @@ func addSideFieldHandler(w http.ResponseWriter, r *http.Request, p httprouter.Pa
 func parseAddSideFieldRequestBody(requestBody io.Reader) addSideFieldRequest {
 	var req addSideFieldRequest
 	err := json.NewDecoder(requestBody).Decode(&req)
-	fatal(err)
+	badRequest(err)
 	return req
 }
 
@@ -206,7 +412,7 @@ func deleteTopFieldHandler(w http.ResponseWriter, r *http.Request, p httprouter.
 func parseDeleteTopFieldRequestBody(requestBody io.Reader) deleteTopFieldRequest {
 	var req deleteTopFieldRequest
 	err := json.NewDecoder(requestBody).Decode(&req)
-	fatal(err)
+	badRequest(err)
 	return req
 }
 
@@ -226,7 +432,7 @@ func deleteSideFieldHandler(w http.ResponseWriter, r *http.Request, p httprouter
 func parseDeleteSideFieldRequestBody(requestBody io.Reader) deleteSideFieldRequest {
 	var req deleteSideFieldRequest
 	err := json.NewDecoder(requestBody).Decode(&req)
-	fatal(err)
+	badRequest(err)
 	return req
 }
 
@@ -245,7 +451,7 @@ func updateTableNameHandler(w http.ResponseWriter, r *http.Request, p httprouter
 func parseUpdateTableNameRequestBody(requestBody io.Reader) updateTableNameRequest {
 	var req updateTableNameRequest
 	err := json.NewDecoder(requestBody).Decode(&req)
-	fatal(err)
+	badRequest(err)
 	return req
 }
 
@@ -253,10 +459,13 @@ func parseUpdateTableNameRequestBody(requestBody io.Reader) updateTableNameReque
 func updateTableDataHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	req := parseUpdateTableDataRequestBody(r.Body)
 
-	fmt.Printf("updateTableDataHandler: TableID: %v\n", req.TableID)
+	debugf("updateTableDataHandler: TableID: %v\n", req.TableID)
 	updateTableData(req.TableID)
 
-	contents := modelToJSONBytes(req.TableID)
+	var contents []byte
+	withModel(func() {
+		contents = modelToJSONBytes(req.TableID)
+	})
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -266,7 +475,7 @@ func updateTableDataHandler(w http.ResponseWriter, r *http.Request, p httprouter
 func parseUpdateTableDataRequestBody(requestBody io.Reader) updateTableDataRequest {
 	var req updateTableDataRequest
 	err := json.NewDecoder(requestBody).Decode(&req)
-	fatal(err)
+	badRequest(err)
 	return req
 }
 
@@ -282,7 +491,7 @@ func updateCategoryHandler(w http.ResponseWriter, r *http.Request, p httprouter.
 func parseUpdateCategoryRequestBody(requestBody io.Reader) updateCategoryRequest {
 	var req updateCategoryRequest
 	err := json.NewDecoder(requestBody).Decode(&req)
-	fatal(err)
+	badRequest(err)
 	return req
 }
 
@@ -291,8 +500,19 @@ func requestCraigslistPageHandler(w http.ResponseWriter, r *http.Request, p http
 
 	req := parseRequestCraigslistPageRequestBody(r.Body)
 
+	if err := checkPageProxyURL(req.SearchURL, pageProxySettings); err != nil {
+		writeJSONError(w, http.StatusForbidden, err)
+		return
+	}
+
+	pageHTML, err := fetchCraigslistQuery(req.SearchURL)
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, err)
+		return
+	}
+
 	var resp requestCraigslistPageResponse
-	resp.ResponseHTML = fetchCraigslistQuery(req.SearchURL)
+	resp.ResponseHTML = pageHTML
 
 	jsonOut, err := json.Marshal(resp)
 	fatal(err)
@@ -305,7 +525,7 @@ func requestCraigslistPageHandler(w http.ResponseWriter, r *http.Request, p http
 func parseRequestCraigslistPageRequestBody(requestBody io.Reader) requestCraigslistPageRequest {
 	var req requestCraigslistPageRequest
 	err := json.NewDecoder(requestBody).Decode(&req)
-	fatal(err)
+	badRequest(err)
 
 	// do I need this or not?
 	//req.SearchURL, err = url.QueryUnescape(req.SearchURL)
@@ -314,6 +534,268 @@ func parseRequestCraigslistPageRequestBody(requestBody io.Reader) requestCraigsl
 	return req
 }
 
+// Handler
+func listingsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var req listingsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var cell CellModel
+	var tableModel TableModel
+	var found bool
+	withModel(func() {
+		cell, found = model.lookupCell(req.TableID, req.Row, req.Col)
+		tableModel, _ = model.lookupTableModelByID(req.TableID)
+	})
+	if !found {
+		writeJSONError(w, http.StatusNotFound,
+			fmt.Errorf("no cell at row %d col %d of table %d", req.Row, req.Col, req.TableID))
+		return
+	}
+
+	listings, err := cellListings(tableModel, cell)
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	page, err := applyListingQuery(listings, req.ListingQuery)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	contents, err := json.MarshalIndent(page, "", "  ")
+	fatal(err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(contents)
+}
+
+// Handler
+func sourcesHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+
+	contents, err := json.MarshalIndent(sourceNames(), "", "  ")
+	fatal(err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(contents)
+}
+
+// Handler
+func updateSourceHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var req updateSourceRequest
+	badRequest(json.NewDecoder(r.Body).Decode(&req))
+
+	if err := updateTableSource(req.TableID, req.Source); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	contents := modelToJSONBytes(req.TableID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(contents)
+}
+
+// Handler
+func updateCellSourceHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var req updateCellSourceRequest
+	badRequest(json.NewDecoder(r.Body).Decode(&req))
+
+	if err := updateCellSource(req.TableID, req.Row, req.Col, req.Source); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	contents := modelToJSONBytes(req.TableID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(contents)
+}
+
+// Handler
+func updateFiltersHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var req updateFiltersRequest
+	badRequest(json.NewDecoder(r.Body).Decode(&req))
+
+	if req.MinPrice < 0 || req.MaxPrice < 0 || (req.MaxPrice > 0 && req.MinPrice > req.MaxPrice) {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("bad price range %d-%d", req.MinPrice, req.MaxPrice))
+		return
+	}
+	updateTableFilters(req.TableID, req.MinPrice, req.MaxPrice)
+	contents := modelToJSONBytes(req.TableID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(contents)
+}
+
+// Handler
+func updateDigestHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var req updateDigestRequest
+	badRequest(json.NewDecoder(r.Body).Decode(&req))
+
+	if err := updateTableDigest(req.TableID, req.Recipients, req.Schedule); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	contents := modelToJSONBytes(req.TableID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(contents)
+}
+
+// Handler
+func sendDigestHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var req sendDigestRequest
+	badRequest(json.NewDecoder(r.Body).Decode(&req))
+
+	sent, err := sendTableDigest(req.TableID)
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	contents, err := json.Marshal(map[string]int{"sent": sent})
+	fatal(err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(contents)
+}
+
+// Handler
+func alertRulesHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var req alertRulesRequest
+	badRequest(json.NewDecoder(r.Body).Decode(&req))
+
+	if req.Rules == nil {
+		req.Rules = []AlertRule{}
+	}
+	if err := updateAlertRules(req.TableID, req.Rules); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	contents := modelToJSONBytes(req.TableID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(contents)
+}
+
+// Handler
+func alertsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var req alertsRequest
+	badRequest(json.NewDecoder(r.Body).Decode(&req))
+
+	contents, err := json.MarshalIndent(alertHistory(req.TableID, req.Since, req.Limit), "", "  ")
+	fatal(err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(contents)
+}
+
+// Handler
+func bulkHeadingsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var req bulkHeadingsRequest
+	badRequest(json.NewDecoder(r.Body).Decode(&req))
+
+	if err := updateHeadingsInBulk(req.TableID, req.Axis, req.Mode, req.Text); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	contents := modelToJSONBytes(req.TableID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(contents)
+}
+
+// Handler
+func cloneTableHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var req cloneTableRequest
+	badRequest(json.NewDecoder(r.Body).Decode(&req))
+
+	tableID := cloneTable(req.TableID, req.History, req.Name)
+	contents := modelToJSONBytes(tableID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(contents)
+}
+
+// Handler
+func tableTemplatesHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+
+	contents, err := json.MarshalIndent(tableTemplates, "", "  ")
+	fatal(err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(contents)
+}
+
+// Handler
+func addTableFromTemplateHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var req addTableFromTemplateRequest
+	badRequest(json.NewDecoder(r.Body).Decode(&req))
+
+	tableID, err := addTableFromTemplate(req.Template)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, err)
+		return
+	}
+	contents := modelToJSONBytes(tableID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(contents)
+}
+
+// Handler
+func exportTableHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var req exportTableRequest
+	badRequest(json.NewDecoder(r.Body).Decode(&req))
+
+	tableModel := model.getTableModelByID(req.TableID)
+	contents, err := marshalTableDefinition(makeTableDefinition(tableModel, req.History), req.Format)
+	badRequest(err)
+
+	contentType := "application/json"
+	if req.Format == "yaml" {
+		contentType = "application/yaml"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(contents)
+}
+
+// Handler
+func importTableHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var req importTableRequest
+	badRequest(json.NewDecoder(r.Body).Decode(&req))
+
+	definition, err := parseTableDefinition([]byte(req.Document), req.Format)
+	badRequest(err)
+	tableID, err := importTableDefinition(definition)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	contents := modelToJSONBytes(tableID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(contents)
+}
+
 // Handler
 func addTableHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 
@@ -341,7 +823,7 @@ func activeTableRequestHandler(w http.ResponseWriter, r *http.Request, p httprou
 
 	activeTableID := getActiveTableID()
 
-	fmt.Printf("ACTIVE TABVLEID IS : %d", activeTableID)
+	debugf("active table id is %d\n", activeTableID)
 	contents := modelToJSONBytes(activeTableID)
 
 	w.Header().Set("Content-Type", "application/json")
@@ -349,6 +831,148 @@ func activeTableRequestHandler(w http.ResponseWriter, r *http.Request, p httprou
 	w.Write(contents)
 }
 
+// Handler
+func httpCacheInfoHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+
+	info := HTTPCacheInfo{Entries: []HTTPCacheEntryInfo{}}
+	if httpCache != nil {
+		info = httpCache.info()
+	}
+
+	contents, err := json.MarshalIndent(info, "", "  ")
+	fatal(err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(contents)
+}
+
+// Handler
+func httpCacheClearHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+
+	removed := 0
+	if httpCache != nil {
+		removed = httpCache.clear()
+	}
+
+	contents, err := json.Marshal(map[string]int{"removed": removed})
+	fatal(err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(contents)
+}
+
+// Handler
+func proxyHealthHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+
+	health := []ProxyHealth{}
+	if proxies != nil {
+		health = proxies.health()
+	}
+
+	contents, err := json.MarshalIndent(health, "", "  ")
+	fatal(err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(contents)
+}
+
+// Handler
+func notificationLogHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+
+	log := []Delivery{}
+	if notifier != nil {
+		log = notifier.deliveries()
+	}
+
+	contents, err := json.MarshalIndent(log, "", "  ")
+	fatal(err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(contents)
+}
+
+// Handler
+func hookLogHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+
+	log := []HookRun{}
+	if hookRunner != nil {
+		log = hookRunner.runs()
+	}
+
+	contents, err := json.MarshalIndent(log, "", "  ")
+	fatal(err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(contents)
+}
+
+// Handler
+func mqttStatusHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+
+	status := MQTTStatus{}
+	if mqttPublisher != nil {
+		status = mqttPublisher.status()
+	}
+
+	contents, err := json.MarshalIndent(status, "", "  ")
+	fatal(err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(contents)
+}
+
+// badRequestError is panicked when a request body can't be decoded,
+// apiPanicHandler turns it into a 400
+type badRequestError struct {
+	err error
+}
+
+func (e badRequestError) Error() string {
+	return "bad request: " + e.err.Error()
+}
+
+func badRequest(err error) {
+	if err != nil {
+		panic(badRequestError{err})
+	}
+}
+
+// apiPanicHandler answers with a JSON error instead of dropping the
+// connection when a handler panics
+func apiPanicHandler(w http.ResponseWriter, r *http.Request, v interface{}) {
+	status := http.StatusInternalServerError
+	var err error
+	switch e := v.(type) {
+	case badRequestError:
+		status, err = http.StatusBadRequest, e
+	case tableNotFoundError:
+		status, err = http.StatusNotFound, e
+	case error:
+		err = e
+	default:
+		err = fmt.Errorf("%v", e)
+	}
+	errorf("%s %s: %v\n", r.Method, r.URL.Path, err)
+	writeJSONError(w, status, err)
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	contents, _ := json.Marshal(errorResponse{err.Error()})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(contents)
+}
 
 func fatal(err error, msgs ...string) {
 	if err != nil {
@@ -362,5 +986,5 @@ func fatal(err error, msgs ...string) {
 }
 
 func printf(s string, a ...interface{}) {
-	fmt.Printf(s, a...)
+	logf(logLevelInfo, s, a...)
 }
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func resetModelForAPITest() {
+	clearModel_andSetMockModelDiskWriter()
+	setModel(makeNewModel())
+}
+
+func postAPI(path, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	newRouter().ServeHTTP(rec, req)
+	return rec
+}
+
+func expectStatus(t *testing.T, rec *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if rec.Code != status {
+		t.Fatalf("expected status %d, got %d: %s", status, rec.Code, rec.Body.String())
+	}
+}
+
+func expectDiskWrite(t *testing.T, expected bool) {
+	t.Helper()
+	if mockModelDiskWriter.isWriteCalled() != expected {
+		t.Fatalf("expected disk write to be %v", expected)
+	}
+}
+
+// decodeElmTableModel checks the body has the shape tableModelDecoder in
+// Main.elm expects and returns it
+func decodeElmTableModel(t *testing.T, rec *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+	if rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("expected JSON, got %s", rec.Header().Get("Content-Type"))
+	}
+
+	var table map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &table); err != nil {
+		t.Fatalf("not JSON: %v\n%s", err, rec.Body.String())
+	}
+	if _, ok := table["name"].(string); !ok {
+		t.Fatalf("name should be a string: %v", table["name"])
+	}
+	if _, ok := table["id"].(float64); !ok {
+		t.Fatalf("id should be an int: %v", table["id"])
+	}
+	for _, key := range []string{"topHeadings", "sideHeadings", "rows"} {
+		if _, ok := table[key].([]interface{}); !ok {
+			t.Fatalf("%s should be a list: %v", key, table[key])
+		}
+	}
+	for _, row := range table["rows"].([]interface{}) {
+		for _, cell := range row.([]interface{}) {
+			c := cell.(map[string]interface{})
+			_, pageOk := c["pageUrl"].(string)
+			_, feedOk := c["feedUrl"].(string)
+			_, hitsOk := c["hits"].(float64)
+			if !pageOk || !feedOk || !hitsOk {
+				t.Fatalf("cell should have pageUrl, feedUrl and hits: %v", c)
+			}
+		}
+	}
+	return table
+}
+
+// decodeElmTableNamesAndIDs checks the body is what tableNamesAndIdsDecoder expects
+func decodeElmTableNamesAndIDs(t *testing.T, rec *httptest.ResponseRecorder) []TableNameAndID {
+	t.Helper()
+	var raw []map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &raw); err != nil {
+		t.Fatalf("not a JSON list: %v\n%s", err, rec.Body.String())
+	}
+	var namesAndIDs []TableNameAndID
+	for _, entry := range raw {
+		name, nameOk := entry["name"].(string)
+		id, idOk := entry["id"].(float64)
+		if !nameOk || !idOk {
+			t.Fatalf("entry should have name and id: %v", entry)
+		}
+		namesAndIDs = append(namesAndIDs, TableNameAndID{int(id), name})
+	}
+	return namesAndIDs
+}
+
+func Test_api_table_returnsTable_andMakesItActive(t *testing.T) {
+	resetModelForAPITest()
+	addTable()
+	mockModelDiskWriter.isCalled = false
+
+	rec := postAPI("/api/table", `{"tableId":0}`)
+
+	expectStatus(t, rec, http.StatusOK)
+	table := decodeElmTableModel(t, rec)
+	if table["id"].(float64) != 0 || getActiveTableID() != 0 {
+		t.Fatalf("table 0 should be returned and made active")
+	}
+	expectDiskWrite(t, true)
+}
+
+func Test_api_table_badBody_is400(t *testing.T) {
+	resetModelForAPITest()
+
+	rec := postAPI("/api/table", `{"tableId":`)
+
+	expectStatus(t, rec, http.StatusBadRequest)
+	expectDiskWrite(t, false)
+}
+
+func Test_api_table_unknownTable_is404(t *testing.T) {
+	resetModelForAPITest()
+
+	rec := postAPI("/api/table", `{"tableId":99}`)
+
+	expectStatus(t, rec, http.StatusNotFound)
+}
+
+func Test_api_alltablenamesandids(t *testing.T) {
+	resetModelForAPITest()
+	addTable()
+	mockModelDiskWriter.isCalled = false
+
+	rec := postAPI("/api/alltablenamesandids", ``)
+
+	expectStatus(t, rec, http.StatusOK)
+	if namesAndIDs := decodeElmTableNamesAndIDs(t, rec); len(namesAndIDs) != 2 {
+		t.Fatalf("expected 2 tables, got %v", namesAndIDs)
+	}
+	expectDiskWrite(t, false)
+}
+
+func Test_api_fieldedit_renamesHeading_andRebuildsRows(t *testing.T) {
+	resetModelForAPITest()
+	model.TableModels[0].Category = "jobs"
+
+	rec := postAPI("/api/fieldedit", `{"tableId":0,"fieldIndex":0,"fieldValue":"sfbay","fieldType":"top"}`)
+
+	expectStatus(t, rec, http.StatusOK)
+	table := decodeElmTableModel(t, rec)
+	if table["topHeadings"].([]interface{})[0] != "sfbay" {
+		t.Fatalf("heading not renamed: %v", table["topHeadings"])
+	}
+	cell := table["rows"].([]interface{})[0].([]interface{})[0].(map[string]interface{})
+	if cell["pageUrl"] != "https://sfbay.craigslist.org/search/jjj?query=SideHeading" || cell["hits"].(float64) != -1 {
+		t.Fatalf("cell not rebuilt: %v", cell)
+	}
+	expectDiskWrite(t, true)
+}
+
+func Test_api_addtopfield_and_deletetopfield(t *testing.T) {
+	resetModelForAPITest()
+
+	rec := postAPI("/api/addtopfield", `{"tableId":0}`)
+	expectStatus(t, rec, http.StatusOK)
+	if len(decodeElmTableModel(t, rec)["topHeadings"].([]interface{})) != 2 {
+		t.Fatalf("expected 2 top headings")
+	}
+	expectDiskWrite(t, true)
+
+	mockModelDiskWriter.isCalled = false
+	rec = postAPI("/api/deletetopfield", `{"tableId":0}`)
+	expectStatus(t, rec, http.StatusOK)
+	if len(decodeElmTableModel(t, rec)["topHeadings"].([]interface{})) != 1 {
+		t.Fatalf("expected 1 top heading")
+	}
+	expectDiskWrite(t, true)
+}
+
+func Test_api_addsidefield_and_deletesidefield(t *testing.T) {
+	resetModelForAPITest()
+
+	rec := postAPI("/api/addsidefield", `{"tableId":0}`)
+	expectStatus(t, rec, http.StatusOK)
+	table := decodeElmTableModel(t, rec)
+	if len(table["sideHeadings"].([]interface{})) != 2 || len(table["rows"].([]interface{})) != 1 {
+		t.Fatalf("expected 2 side headings and a new row: %v", table)
+	}
+	expectDiskWrite(t, true)
+
+	mockModelDiskWriter.isCalled = false
+	rec = postAPI("/api/deletesidefield", `{"tableId":0}`)
+	expectStatus(t, rec, http.StatusOK)
+	if len(decodeElmTableModel(t, rec)["sideHeadings"].([]interface{})) != 1 {
+		t.Fatalf("expected 1 side heading")
+	}
+	expectDiskWrite(t, true)
+}
+
+func Test_api_updatetabledata_againstFakeCraigslist(t *testing.T) {
+	fake, cleanup := setUpFakeCraigslistTable(t)
+	defer cleanup()
+	fake.addPosting("sfbay", "sss", "desk", "Oak desk", 120)
+	mockModelDiskWriter.isCalled = false
+
+	rec := postAPI("/api/updatetabledata", `{"tableId":0}`)
+
+	expectStatus(t, rec, http.StatusOK)
+	table := decodeElmTableModel(t, rec)
+	cell := table["rows"].([]interface{})[0].([]interface{})[0].(map[string]interface{})
+	if cell["hits"].(float64) != 1 || cell["status"] != cellStatusOK {
+		t.Fatalf("expected one hit: %v", cell)
+	}
+	expectDiskWrite(t, true)
+}
+
+func Test_api_addtable_and_deletetable(t *testing.T) {
+	resetModelForAPITest()
+
+	rec := postAPI("/api/addtable", ``)
+	expectStatus(t, rec, http.StatusOK)
+	if len(decodeElmTableNamesAndIDs(t, rec)) != 2 {
+		t.Fatalf("expected 2 tables")
+	}
+	expectDiskWrite(t, true)
+
+	mockModelDiskWriter.isCalled = false
+	rec = postAPI("/api/deletetable", ``)
+	expectStatus(t, rec, http.StatusOK)
+	if namesAndIDs := decodeElmTableNamesAndIDs(t, rec); len(namesAndIDs) != 1 || namesAndIDs[0].ID != 0 {
+		t.Fatalf("expected the new, active table to be deleted: %v", namesAndIDs)
+	}
+	expectDiskWrite(t, true)
+}
+
+func Test_api_activetable(t *testing.T) {
+	resetModelForAPITest()
+	addTable()
+
+	rec := postAPI("/api/activetable", ``)
+
+	expectStatus(t, rec, http.StatusOK)
+	if decodeElmTableModel(t, rec)["id"].(float64) != float64(getActiveTableID()) {
+		t.Fatalf("expected the active table")
+	}
+}
+
+func Test_api_updatetablename(t *testing.T) {
+	resetModelForAPITest()
+
+	rec := postAPI("/api/updatetablename", `{"name":"Bay Area desks"}`)
+
+	expectStatus(t, rec, http.StatusOK)
+	if namesAndIDs := decodeElmTableNamesAndIDs(t, rec); namesAndIDs[0].Name != "Bay Area desks" {
+		t.Fatalf("name not updated: %v", namesAndIDs)
+	}
+	expectDiskWrite(t, true)
+}
+
+func Test_api_updatecategory(t *testing.T) {
+	resetModelForAPITest()
+
+	rec := postAPI("/api/updatecategory", `{"category":"for sale"}`)
+
+	expectStatus(t, rec, http.StatusOK)
+	if model.TableModels[0].Category != "for sale" {
+		t.Fatalf("category not updated")
+	}
+	expectDiskWrite(t, true)
+}
+
+func Test_api_page_refusesNonCraigslistURL(t *testing.T) {
+	resetModelForAPITest()
+
+	rec := postAPI("/api/", `{"searchURL":"http://127.0.0.1:8080/data/themodel.json"}`)
+
+	expectStatus(t, rec, http.StatusForbidden)
+	var resp errorResponse
+	if json.Unmarshal(rec.Body.Bytes(), &resp) != nil || resp.Error == "" {
+		t.Fatalf("expected a JSON error, got %s", rec.Body.String())
+	}
+}
+
+func Test_api_page_returnsResultRows(t *testing.T) {
+	fake, cleanup := setUpFakeCraigslistTable(t)
+	defer cleanup()
+	fake.addPosting("sfbay", "sss", "desk", "Oak desk", 120)
+
+	cell, _ := model.lookupCell(0, 0, 0)
+	body, _ := json.Marshal(requestCraigslistPageRequest{SearchURL: cell.PageURL})
+	rec := postAPI("/api/", string(body))
+
+	expectStatus(t, rec, http.StatusOK)
+	var resp requestCraigslistPageResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || !strings.Contains(resp.ResponseHTML, "Oak desk") {
+		t.Fatalf("expected {\"response\": ...} with the listing, got %s", rec.Body.String())
+	}
+}
+
+func Test_api_listings(t *testing.T) {
+	fake, cleanup := setUpFakeCraigslistTable(t)
+	defer cleanup()
+	fake.addPosting("sfbay", "sss", "desk", "Oak desk", 120)
+	fake.addPosting("sfbay", "sss", "desk", "Pine desk", 60)
+
+	rec := postAPI("/api/listings", `{"tableId":0,"row":0,"col":0,"sort":"price"}`)
+
+	expectStatus(t, rec, http.StatusOK)
+	var page ListingPage
+	if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil || page.Total != 2 || page.Listings[0].Title != "Pine desk" {
+		t.Fatalf("expected both desks, cheapest first: %s", rec.Body.String())
+	}
+
+	expectStatus(t, postAPI("/api/listings", `{"tableId":0,"row":5,"col":0}`), http.StatusNotFound)
+	expectStatus(t, postAPI("/api/listings", `{"tableId":0,"row":0,"col":0,"sort":"color"}`), http.StatusBadRequest)
+}
+
+func Test_api_admin_endpoints(t *testing.T) {
+	resetModelForAPITest()
+
+	for _, path := range []string{"/api/admin/httpcache", "/api/admin/httpcache/clear", "/api/admin/proxies"} {
+		rec := postAPI(path, ``)
+		expectStatus(t, rec, http.StatusOK)
+		if !json.Valid(rec.Body.Bytes()) {
+			t.Fatalf("%s: not JSON: %s", path, rec.Body.String())
+		}
+	}
+}
+
+func Test_api_refusesPostsFromOtherSites(t *testing.T) {
+	resetModelForAPITest()
+
+	post := func(path, body, origin string) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "text/plain")
+		req.Header.Set("Origin", origin)
+		newRouter().ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := post("/api/updatetablename", `{"name": "evil"}`, "https://evil.example"); code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", code)
+	}
+	if code := post("/api/addtable", ``, "https://evil.example"); code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", code)
+	}
+	if model.TableModels[0].Name == "evil" || len(model.TableModels) != 1 {
+		t.Fatal("a refused request shouldn't change anything")
+	}
+
+	// httptest requests are to example.com
+	if code := post("/api/updatetablename", `{"name": "mine"}`, "http://example.com"); code != http.StatusOK {
+		t.Fatalf("a request from this site should work, got %d", code)
+	}
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MQTTConfig is the mqtt: section of the config file.  After every refresh
+// each cell's counts are published, retained, to Topic, and each new
+// listing to Topic + "/listings".  Counts that don't reach the broker are
+// sent after the next refresh that does; listings are sent at most once.
+type MQTTConfig struct {
+	Broker   string   `yaml:"broker"` // tcp://host:1883 or tls://host:8883, empty for none
+	ClientID string   `yaml:"clientID"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	Topic    string   `yaml:"topic"` // {table}, {row} and {col} are filled in
+	QoS      int      `yaml:"qos"`   // 0 or 1
+	Timeout  duration `yaml:"timeout"`
+}
+
+func defaultMQTTConfig() MQTTConfig {
+	return MQTTConfig{
+		ClientID: "craigsmatrix",
+		Topic:    "craigsmatrix/{table}/{row}/{col}",
+		Timeout:  duration(10 * time.Second),
+	}
+}
+
+// validate returns one message per problem.  No broker means no MQTT.
+func (c MQTTConfig) validate() []string {
+	var errs []string
+	if c.Broker == "" {
+		return errs
+	}
+	if _, _, err := mqttBrokerAddress(c.Broker); err != nil {
+		errs = append(errs, "mqtt.broker: "+err.Error())
+	}
+	if c.ClientID == "" {
+		errs = append(errs, "mqtt.clientID: must not be empty")
+	}
+	if c.Topic == "" || strings.ContainsAny(c.Topic, "+#") {
+		errs = append(errs, fmt.Sprintf("mqtt.topic: %q must be a topic without wildcards", c.Topic))
+	}
+	if c.QoS != 0 && c.QoS != 1 {
+		errs = append(errs, "mqtt.qos: must be 0 or 1")
+	}
+	if c.Timeout <= 0 {
+		errs = append(errs, "mqtt.timeout: must be positive")
+	}
+	return errs
+}
+
+// mqttBrokerAddress splits tcp://host:port or tls://host:port
+func mqttBrokerAddress(broker string) (addr string, useTLS bool, err error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return "", false, err
+	}
+	port := u.Port()
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		if port == "" {
+			port = "1883"
+		}
+	case "tls", "ssl", "mqtts":
+		useTLS = true
+		if port == "" {
+			port = "8883"
+		}
+	default:
+		return "", false, fmt.Errorf("%q should look like tcp://host:1883 or tls://host:8883", broker)
+	}
+	if u.Hostname() == "" {
+		return "", false, fmt.Errorf("%q has no host", broker)
+	}
+	return net.JoinHostPort(u.Hostname(), port), useTLS, nil
+}
+
+// MQTT 3.1.1 control packet types, already shifted into the high nibble
+const (
+	mqttConnect    = 0x10
+	mqttConnack    = 0x20
+	mqttPublish    = 0x30
+	mqttPuback     = 0x40
+	mqttDisconnect = 0xE0
+)
+
+// mqttClient is just enough of MQTT 3.1.1 to connect, publish at QoS 0 or 1
+// and disconnect.  Each packet gets timeout to be written or read in.
+type mqttClient struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+	nextID  uint16
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+func appendMQTTLength(b []byte, n int) []byte {
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+func (c *mqttClient) writePacket(header byte, body []byte) error {
+	packet := appendMQTTLength([]byte{header}, len(body))
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	_, err := c.conn.Write(append(packet, body...))
+	return err
+}
+
+func (c *mqttClient) readPacket() (byte, []byte, error) {
+	c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+	return readMQTTPacket(c.r)
+}
+
+// readPacket returns the next packet's first byte and body
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7f) * multiplier
+		if digit&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, nil, errors.New("mqtt: malformed remaining length")
+		}
+		multiplier *= 128
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
+
+func dialMQTT(c MQTTConfig) (*mqttClient, error) {
+	addr, useTLS, err := mqttBrokerAddress(c.Broker)
+	if err != nil {
+		return nil, err
+	}
+	timeout := time.Duration(c.Timeout)
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	if useTLS {
+		host, _, _ := net.SplitHostPort(addr)
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	client := &mqttClient{conn: conn, r: bufio.NewReader(conn), timeout: timeout}
+
+	flags := byte(0x02) // clean session
+	if c.Username != "" {
+		flags |= 0x80
+		if c.Password != "" {
+			flags |= 0x40
+		}
+	}
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, 4, flags, 0, 60) // protocol level 4, keep alive 60s
+	body = appendMQTTString(body, c.ClientID)
+	if c.Username != "" {
+		body = appendMQTTString(body, c.Username)
+		if c.Password != "" {
+			body = appendMQTTString(body, c.Password)
+		}
+	}
+	if err := client.writePacket(mqttConnect, body); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	header, ack, err := client.readPacket()
+	if err == nil && (header != mqttConnack || len(ack) != 2) {
+		err = fmt.Errorf("mqtt: expected CONNACK, got packet type %#x", header)
+	}
+	if err == nil && ack[1] != 0 {
+		err = fmt.Errorf("mqtt: broker refused the connection, return code %d", ack[1])
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+func (c *mqttClient) publish(topic string, payload []byte, qos int, retain bool) error {
+	header := byte(mqttPublish | qos<<1)
+	if retain {
+		header |= 0x01
+	}
+	body := appendMQTTString(nil, topic)
+	var id uint16
+	if qos > 0 {
+		c.nextID++
+		if c.nextID == 0 {
+			c.nextID = 1
+		}
+		id = c.nextID
+		body = append(body, byte(id>>8), byte(id))
+	}
+	if err := c.writePacket(header, append(body, payload...)); err != nil {
+		return err
+	}
+	if qos == 0 {
+		return nil
+	}
+
+	packetType, ack, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	if packetType&0xf0 != mqttPuback || len(ack) != 2 || binary.BigEndian.Uint16(ack) != id {
+		return fmt.Errorf("mqtt: expected PUBACK for %d, got packet type %#x", id, packetType)
+	}
+	return nil
+}
+
+func (c *mqttClient) disconnect() {
+	c.writePacket(mqttDisconnect, nil)
+	c.conn.Close()
+}
+
+// mqttCellState is the retained message for a cell
+type mqttCellState struct {
+	TableID     int       `json:"tableId"`
+	TableName   string    `json:"tableName"`
+	Side        string    `json:"side"`
+	Top         string    `json:"top"`
+	Hits        int       `json:"hits"`
+	ResultCount int       `json:"resultCount"`
+	Error       string    `json:"error,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// mqttListingEvent is published once for each new listing
+type mqttListingEvent struct {
+	TableID int       `json:"tableId"`
+	Side    string    `json:"side"`
+	Top     string    `json:"top"`
+	Listing Listing   `json:"listing"`
+	Time    time.Time `json:"time"`
+}
+
+// MQTTPublisher publishes refreshes in the background, so a missing broker
+// never holds up a refresh.  One goroutine at a time works through the
+// queue over one connection: a broker drops a session when another
+// connects with the same client ID.
+type MQTTPublisher struct {
+	cfg MQTTConfig
+
+	mu        sync.Mutex
+	queue     []TableRefresh
+	running   bool
+	lastError string
+	published int
+	// the newest counts of each cell, by topic, that didn't reach the broker
+	unsent map[string][]byte
+	wg     sync.WaitGroup
+}
+
+// refreshes beyond this waiting for the broker are dropped, oldest first
+var maxQueuedMQTTRefreshes = 100
+
+var mqttPublisher *MQTTPublisher
+
+// setMQTTPublisher makes p the one that hears about refreshes, nil for none
+func setMQTTPublisher(p *MQTTPublisher) {
+	mqttPublisher = p
+	if p == nil {
+		setRefreshListener("mqtt", nil)
+		return
+	}
+	setRefreshListener("mqtt", p.onRefresh)
+}
+
+func newMQTTPublisher(c MQTTConfig) *MQTTPublisher {
+	if c.Broker == "" {
+		return nil
+	}
+	return &MQTTPublisher{cfg: c}
+}
+
+// cellTopic fills the table ID and cell position into the topic template
+func (p *MQTTPublisher) cellTopic(tableID, row, col int) string {
+	return strings.NewReplacer(
+		"{table}", strconv.Itoa(tableID),
+		"{row}", strconv.Itoa(row),
+		"{col}", strconv.Itoa(col),
+	).Replace(p.cfg.Topic)
+}
+
+func (p *MQTTPublisher) onRefresh(r TableRefresh) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.queue = append(p.queue, r)
+	if extra := len(p.queue) - maxQueuedMQTTRefreshes; extra > 0 {
+		warnf("mqtt: dropping %d refreshes the broker hasn't taken\n", extra)
+		p.queue = p.queue[extra:]
+	}
+	if !p.running {
+		p.running = true
+		p.wg.Add(1)
+		go p.publishQueue()
+	}
+}
+
+// publishQueue publishes queued refreshes until there are none left,
+// keeping the connection open between them and redialling after an error.
+// Only one runs at a time, and it has hung up before another can start.
+func (p *MQTTPublisher) publishQueue() {
+	defer p.wg.Done()
+	var client *mqttClient
+	for {
+		p.mu.Lock()
+		if len(p.queue) == 0 && client != nil {
+			// hang up before saying we're done, then look again
+			p.mu.Unlock()
+			client.disconnect()
+			client = nil
+			continue
+		}
+		if len(p.queue) == 0 {
+			p.running = false
+			p.mu.Unlock()
+			return
+		}
+		r := p.queue[0]
+		p.queue = p.queue[1:]
+		p.mu.Unlock()
+
+		var err error
+		if client == nil {
+			client, err = dialMQTT(p.cfg)
+		}
+		if err == nil {
+			err = p.publishUnsent(client, r)
+		}
+		if err == nil {
+			err = p.publishRefresh(client, r)
+		}
+		if err != nil {
+			p.keepUnsent(r)
+		}
+		if err != nil && client != nil {
+			client.conn.Close()
+			client = nil
+		}
+
+		p.mu.Lock()
+		if err != nil {
+			p.lastError = err.Error()
+			warnf("mqtt: %v\n", err)
+		} else {
+			p.lastError = ""
+		}
+		p.mu.Unlock()
+	}
+}
+
+// wait blocks until every publish started so far is done
+func (p *MQTTPublisher) wait() {
+	p.wg.Wait()
+}
+
+func cellState(r TableRefresh, c CellRefresh) []byte {
+	state, _ := json.Marshal(mqttCellState{
+		TableID: r.TableID, TableName: r.TableName, Side: c.Side, Top: c.Top,
+		Hits: c.Hits, ResultCount: c.ResultCount, Error: c.Error, Time: r.Time,
+	})
+	return state
+}
+
+// keepUnsent remembers the counts of a refresh that didn't get through,
+// replacing older ones for the same cells
+func (p *MQTTPublisher) keepUnsent(r TableRefresh) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.unsent == nil {
+		p.unsent = map[string][]byte{}
+	}
+	for _, c := range r.Cells {
+		p.unsent[p.cellTopic(r.TableID, c.Row, c.Col)] = cellState(r, c)
+	}
+}
+
+// publishUnsent sends the counts kept from failed refreshes, except for
+// the cells r is about to publish anyway
+func (p *MQTTPublisher) publishUnsent(client *mqttClient, r TableRefresh) error {
+	p.mu.Lock()
+	topics := make([]string, 0, len(p.unsent))
+	for topic := range p.unsent {
+		topics = append(topics, topic)
+	}
+	p.mu.Unlock()
+	sort.Strings(topics)
+
+	covered := map[string]bool{}
+	for _, c := range r.Cells {
+		covered[p.cellTopic(r.TableID, c.Row, c.Col)] = true
+	}
+	for _, topic := range topics {
+		p.mu.Lock()
+		state := p.unsent[topic]
+		p.mu.Unlock()
+		if !covered[topic] {
+			if err := client.publish(topic, state, p.cfg.QoS, true); err != nil {
+				return err
+			}
+		}
+		p.mu.Lock()
+		delete(p.unsent, topic)
+		if !covered[topic] {
+			p.published++
+		}
+		p.mu.Unlock()
+	}
+	return nil
+}
+
+func (p *MQTTPublisher) publishRefresh(client *mqttClient, r TableRefresh) error {
+	count := 0
+	for _, c := range r.Cells {
+		topic := p.cellTopic(r.TableID, c.Row, c.Col)
+		state := cellState(r, c)
+		if err := client.publish(topic, state, p.cfg.QoS, true); err != nil {
+			return err
+		}
+		count++
+
+		if c.FirstFetch {
+			continue
+		}
+		for _, l := range c.NewListings {
+			event, _ := json.Marshal(mqttListingEvent{TableID: r.TableID, Side: c.Side, Top: c.Top, Listing: l, Time: r.Time})
+			if err := client.publish(topic+"/listings", event, p.cfg.QoS, false); err != nil {
+				return err
+			}
+			count++
+		}
+	}
+
+	p.mu.Lock()
+	p.published += count
+	p.mu.Unlock()
+	debugf("mqtt: published %d messages for table %d\n", count, r.TableID)
+	return nil
+}
+
+// MQTTStatus is what /api/admin/mqtt reports
+type MQTTStatus struct {
+	Broker    string `json:"broker"`
+	Published int    `json:"published"`
+	LastError string `json:"lastError"`
+	// cells whose latest counts are waiting for the broker
+	Unsent int `json:"unsent"`
+}
+
+func (p *MQTTPublisher) status() MQTTStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return MQTTStatus{Broker: p.cfg.Broker, Published: p.published, LastError: p.lastError, Unsent: len(p.unsent)}
+}
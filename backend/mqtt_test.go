@@ -0,0 +1,513 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mqttMessage is a PUBLISH the fake broker received
+type mqttMessage struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+// brokerPacket is a control packet as the test side reads it, without
+// using the client's own code
+type brokerPacket struct {
+	kind  byte // the high nibble of the first byte
+	flags byte // the low nibble
+	body  []byte
+}
+
+func readBrokerPacket(r io.Reader) (brokerPacket, error) {
+	var first [1]byte
+	if _, err := io.ReadFull(r, first[:]); err != nil {
+		return brokerPacket{}, err
+	}
+	// remaining length: seven bits a byte, least significant first
+	length := 0
+	for shift := uint(0); ; shift += 7 {
+		if shift > 21 {
+			return brokerPacket{}, fmt.Errorf("remaining length longer than four bytes")
+		}
+		var b [1]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return brokerPacket{}, err
+		}
+		length |= int(b[0]&0x7f) << shift
+		if b[0] < 0x80 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return brokerPacket{}, err
+	}
+	return brokerPacket{kind: first[0] >> 4, flags: first[0] & 0x0f, body: body}, nil
+}
+
+// brokerFields reads length-prefixed strings off the front of a body
+type brokerFields struct {
+	rest []byte
+	err  error
+}
+
+func (f *brokerFields) bytes(n int) []byte {
+	if f.err != nil || len(f.rest) < n {
+		f.err = fmt.Errorf("packet too short")
+		return nil
+	}
+	b := f.rest[:n]
+	f.rest = f.rest[n:]
+	return b
+}
+
+func (f *brokerFields) string() string {
+	n := f.bytes(2)
+	if n == nil {
+		return ""
+	}
+	return string(f.bytes(int(n[0])<<8 | int(n[1])))
+}
+
+func brokerPacketBytes(firstByte byte, body []byte) []byte {
+	packet := []byte{firstByte}
+	n := len(body)
+	for {
+		b := byte(n & 0x7f)
+		n >>= 7
+		if n > 0 {
+			packet = append(packet, b|0x80)
+			continue
+		}
+		packet = append(packet, b)
+		break
+	}
+	return append(packet, body...)
+}
+
+func brokerString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+// fakeBroker speaks enough MQTT 3.1.1 to accept connections and record what
+// is published, acknowledging QoS 1 messages.  Like a real broker, a second
+// connection with the same client ID closes the first.
+type fakeBroker struct {
+	listener net.Listener
+	// how long to sit on each PUBACK
+	pubackDelay time.Duration
+
+	mu          sync.Mutex
+	unavailable bool // refuse connections as "server unavailable"
+	clientID    string
+	username    string
+	password    string
+	connections int
+	takeovers   int
+	sessions    map[string]net.Conn
+	messages    []mqttMessage
+	problems    []string
+}
+
+func startFakeBroker(t *testing.T) *fakeBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{listener: listener, sessions: map[string]net.Conn{}}
+	t.Cleanup(func() {
+		listener.Close()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		for _, problem := range b.problems {
+			t.Error("broker: " + problem)
+		}
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *fakeBroker) url() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+func (b *fakeBroker) problem(format string, a ...interface{}) {
+	b.mu.Lock()
+	b.problems = append(b.problems, fmt.Sprintf(format, a...))
+	b.mu.Unlock()
+}
+
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	clientID := ""
+	defer func() {
+		b.mu.Lock()
+		if b.sessions[clientID] == conn {
+			delete(b.sessions, clientID)
+		}
+		b.mu.Unlock()
+	}()
+
+	for first := true; ; first = false {
+		packet, err := readBrokerPacket(conn)
+		if err != nil {
+			return
+		}
+		if first != (packet.kind == 1) {
+			b.problem("the first packet, and only the first, must be CONNECT: got type %d", packet.kind)
+			return
+		}
+		switch packet.kind {
+		case 1: // CONNECT
+			f := &brokerFields{rest: packet.body}
+			protocol := f.string()
+			level := f.bytes(1)
+			flags := f.bytes(1)
+			f.bytes(2) // keep alive
+			clientID = f.string()
+			var username, password string
+			if f.err == nil && flags[0]&0x80 != 0 {
+				username = f.string()
+			}
+			if f.err == nil && flags[0]&0x40 != 0 {
+				password = f.string()
+			}
+			if f.err != nil || protocol != "MQTT" || level[0] != 4 || len(f.rest) != 0 || clientID == "" {
+				b.problem("bad CONNECT % x", packet.body)
+				return
+			}
+			b.mu.Lock()
+			if b.unavailable {
+				b.mu.Unlock()
+				conn.Write(brokerPacketBytes(0x20, []byte{0, 3}))
+				return
+			}
+			b.connections++
+			b.clientID, b.username, b.password = clientID, username, password
+			if old, found := b.sessions[clientID]; found {
+				b.takeovers++
+				old.Close()
+			}
+			b.sessions[clientID] = conn
+			b.mu.Unlock()
+			conn.Write(brokerPacketBytes(0x20, []byte{0, 0}))
+		case 3: // PUBLISH
+			qos := packet.flags >> 1 & 3
+			f := &brokerFields{rest: packet.body}
+			topic := f.string()
+			id := []byte{}
+			if qos > 0 {
+				id = f.bytes(2)
+			}
+			if f.err != nil || qos > 1 {
+				b.problem("bad PUBLISH %x % x", packet.flags, packet.body)
+				return
+			}
+			b.mu.Lock()
+			b.messages = append(b.messages, mqttMessage{topic: topic, payload: f.rest, retain: packet.flags&1 != 0})
+			b.mu.Unlock()
+			if qos == 1 {
+				time.Sleep(b.pubackDelay)
+				conn.Write(brokerPacketBytes(0x40, id))
+			}
+		case 14: // DISCONNECT
+			return
+		default:
+			b.problem("unexpected packet type %d", packet.kind)
+			return
+		}
+	}
+}
+
+func (b *fakeBroker) received() []mqttMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]mqttMessage(nil), b.messages...)
+}
+
+func Test_mqtt_publishesCountsAndNewListings(t *testing.T) {
+	stub := setUpStubTable(t, Listing{Title: "Oak desk", URL: "https://stub.example/1"})
+
+	broker := startFakeBroker(t)
+	c := defaultMQTTConfig()
+	c.Broker = broker.url()
+	c.Username = "matrix"
+	c.QoS = 1
+	if errs := c.validate(); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	setMQTTPublisher(newMQTTPublisher(c))
+	defer setMQTTPublisher(nil)
+
+	updateTableData(0) // first fetch: counts only
+	mqttPublisher.wait()
+	cells := len(model.getTableModelByID(0).Rows) * len(model.getTableModelByID(0).Rows[0])
+	messages := broker.received()
+	if len(messages) != cells {
+		t.Fatalf("expected one retained count per cell, got %d messages for %d cells", len(messages), cells)
+	}
+	for _, m := range messages {
+		if !m.retain || strings.HasSuffix(m.topic, "/listings") {
+			t.Fatalf("first fetch should only publish retained counts: %+v", m)
+		}
+	}
+	if messages[0].topic != "craigsmatrix/0/0/0" {
+		t.Fatalf("topic template not filled in: %q", messages[0].topic)
+	}
+	var state mqttCellState
+	if err := json.Unmarshal(messages[0].payload, &state); err != nil || state.Hits != 1 || state.ResultCount != 1 || state.Side != "SideHeading" {
+		t.Fatalf("wrong count message: %s", messages[0].payload)
+	}
+
+	stub.listings = append(stub.listings, Listing{Title: "Pine desk", URL: "https://stub.example/2"})
+	updateTableData(0)
+	mqttPublisher.wait()
+
+	var events []mqttListingEvent
+	for _, m := range broker.received()[cells:] {
+		if strings.HasSuffix(m.topic, "/listings") {
+			if m.retain {
+				t.Fatalf("listing events shouldn't be retained: %+v", m)
+			}
+			var e mqttListingEvent
+			json.Unmarshal(m.payload, &e)
+			events = append(events, e)
+		}
+	}
+	if len(events) != cells || events[0].Listing.Title != "Pine desk" {
+		t.Fatalf("expected a Pine desk event per cell, got %+v", events)
+	}
+
+	broker.mu.Lock()
+	if broker.clientID != "craigsmatrix" || broker.username != "matrix" || broker.password != "" {
+		t.Fatalf("wrong login: %q %q %q", broker.clientID, broker.username, broker.password)
+	}
+	broker.mu.Unlock()
+
+	rec := postAPI("/api/admin/mqtt", `{}`)
+	expectStatus(t, rec, http.StatusOK)
+	var status MQTTStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil || status.Published != len(broker.received()) || status.LastError != "" {
+		t.Fatalf("wrong status: %s", rec.Body.String())
+	}
+}
+
+// manyCellRefresh is a refresh of a table with n cells
+func manyCellRefresh(n int) TableRefresh {
+	r := TableRefresh{TableID: 3, TableName: "Big", Time: time.Now()}
+	for i := 0; i < n; i++ {
+		r.Cells = append(r.Cells, CellRefresh{Row: i, Hits: i})
+	}
+	return r
+}
+
+func Test_mqtt_overlappingRefreshesShareOneSession(t *testing.T) {
+	broker := startFakeBroker(t)
+	broker.pubackDelay = 5 * time.Millisecond
+	c := defaultMQTTConfig()
+	c.Broker = broker.url()
+	c.QoS = 1
+	p := newMQTTPublisher(c)
+
+	// each refresh takes a while to publish, so they pile up
+	for i := 0; i < 5; i++ {
+		p.onRefresh(manyCellRefresh(4))
+	}
+	p.wait()
+
+	broker.mu.Lock()
+	takeovers, connections := broker.takeovers, broker.connections
+	broker.mu.Unlock()
+	if takeovers != 0 || len(broker.received()) != 20 || p.status().LastError != "" {
+		t.Fatalf("%d takeovers, %d messages, error %q", takeovers, len(broker.received()), p.status().LastError)
+	}
+	if connections != 1 {
+		t.Fatalf("queued refreshes should go over one connection, used %d", connections)
+	}
+
+	// with nothing queued it hangs up, and the next refresh dials again
+	p.onRefresh(manyCellRefresh(1))
+	p.wait()
+	if len(broker.received()) != 21 || p.status().LastError != "" {
+		t.Fatalf("the refresh after hanging up wasn't published: %q", p.status().LastError)
+	}
+}
+
+func Test_mqtt_timeoutIsPerPacket(t *testing.T) {
+	broker := startFakeBroker(t)
+	broker.pubackDelay = 20 * time.Millisecond
+	c := defaultMQTTConfig()
+	c.Broker = broker.url()
+	c.QoS = 1
+	c.Timeout = duration(100 * time.Millisecond)
+	p := newMQTTPublisher(c)
+
+	// 20 acknowledgements take far longer than the timeout all together
+	p.onRefresh(manyCellRefresh(20))
+	p.wait()
+	if len(broker.received()) != 20 || p.status().LastError != "" {
+		t.Fatalf("a big table shouldn't time out: %d messages, %q", len(broker.received()), p.status().LastError)
+	}
+}
+
+// Test_mqtt_realBroker publishes to the broker in
+// CRAIGSMATRIX_TEST_MQTT_BROKER, e.g. tcp://localhost:1883, and reads it
+// back with a subscription
+func Test_mqtt_realBroker(t *testing.T) {
+	broker := os.Getenv("CRAIGSMATRIX_TEST_MQTT_BROKER")
+	if broker == "" {
+		t.Skip("set CRAIGSMATRIX_TEST_MQTT_BROKER to test against a real broker")
+	}
+	addr, _, err := mqttBrokerAddress(broker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := fmt.Sprintf("craigsmatrix-test/%d", time.Now().UnixNano())
+
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	connect := append(brokerString("MQTT"), 4, 0x02, 0, 30)
+	conn.Write(brokerPacketBytes(0x10, append(connect, brokerString(prefix+"-subscriber")...)))
+	if packet, err := readBrokerPacket(conn); err != nil || packet.kind != 2 || packet.body[1] != 0 {
+		t.Fatalf("subscriber not connected: %+v %v", packet, err)
+	}
+	subscribe := append([]byte{0, 1}, brokerString(prefix+"/#")...)
+	conn.Write(brokerPacketBytes(0x82, append(subscribe, 0)))
+	if packet, err := readBrokerPacket(conn); err != nil || packet.kind != 9 {
+		t.Fatalf("not subscribed: %+v %v", packet, err)
+	}
+
+	c := defaultMQTTConfig()
+	c.Broker = broker
+	c.Topic = prefix + "/{table}/{row}/{col}"
+	c.QoS = 1
+	p := newMQTTPublisher(c)
+	r := manyCellRefresh(3)
+	r.Cells[1].NewListings = []Listing{{Title: "Oak desk", URL: "https://stub.example/1"}}
+	p.onRefresh(r)
+	p.onRefresh(r)
+	p.wait()
+	if p.status().LastError != "" {
+		t.Fatal(p.status().LastError)
+	}
+
+	topics := map[string]int{}
+	for n := 0; n < 8; n++ {
+		packet, err := readBrokerPacket(conn)
+		if err != nil {
+			t.Fatalf("got %v, then %v", topics, err)
+		}
+		if packet.kind == 3 {
+			f := &brokerFields{rest: packet.body}
+			topics[f.string()]++
+		}
+	}
+	if topics[prefix+"/3/1/0"] != 2 || topics[prefix+"/3/1/0/listings"] != 2 {
+		t.Fatalf("wrong messages: %v", topics)
+	}
+
+	// clear the retained counts
+	for topic := range topics {
+		if !strings.HasSuffix(topic, "/listings") {
+			conn.Write(brokerPacketBytes(0x31, brokerString(topic)))
+		}
+	}
+}
+
+func Test_mqtt_countsAreSentOnceTheBrokerIsBack(t *testing.T) {
+	broker := startFakeBroker(t)
+	broker.unavailable = true
+	c := defaultMQTTConfig()
+	c.Broker = broker.url()
+	c.QoS = 1
+	p := newMQTTPublisher(c)
+
+	missed := manyCellRefresh(2)
+	missed.Cells[1].NewListings = []Listing{{Title: "Oak desk"}}
+	p.onRefresh(missed)
+	p.wait()
+	if status := p.status(); status.LastError == "" || status.Unsent != 2 {
+		t.Fatalf("expected an error and 2 cells waiting: %+v", status)
+	}
+
+	broker.mu.Lock()
+	broker.unavailable = false
+	broker.mu.Unlock()
+	// a refresh of another table, and a newer one of the first cell
+	other := manyCellRefresh(1)
+	other.TableID = 4
+	p.onRefresh(other)
+	newer := manyCellRefresh(1)
+	newer.Cells[0].Hits = 7
+	p.onRefresh(newer)
+	p.wait()
+
+	states := map[string]int{}
+	for _, m := range broker.received() {
+		if strings.HasSuffix(m.topic, "/listings") {
+			t.Fatalf("missed listings aren't sent later: %+v", m)
+		}
+		var state mqttCellState
+		json.Unmarshal(m.payload, &state)
+		states[m.topic] = state.Hits
+	}
+	if len(states) != 3 || states["craigsmatrix/3/1/0"] != 1 || states["craigsmatrix/3/0/0"] != 7 || states["craigsmatrix/4/0/0"] != 0 {
+		t.Fatalf("expected the missed counts, then the newer ones: %v", states)
+	}
+	if status := p.status(); status.LastError != "" || status.Unsent != 0 {
+		t.Fatalf("nothing should be waiting: %+v", status)
+	}
+}
+
+func Test_mqtt_unreachableBrokerIsReported(t *testing.T) {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := listener.Addr().String()
+	listener.Close()
+
+	c := defaultMQTTConfig()
+	c.Broker = "tcp://" + addr
+	p := newMQTTPublisher(c)
+	p.onRefresh(TableRefresh{TableID: 1, Cells: []CellRefresh{{Hits: 1}}})
+	p.wait()
+	if p.status().LastError == "" {
+		t.Fatal("a failed connection should be recorded")
+	}
+}
+
+func Test_MQTTConfig_validate(t *testing.T) {
+	if errs := defaultMQTTConfig().validate(); len(errs) > 0 {
+		t.Fatalf("no broker means no checks: %v", errs)
+	}
+	c := defaultMQTTConfig()
+	c.Broker = "http://localhost"
+	c.Topic = "craigsmatrix/#"
+	c.QoS = 2
+	errs := strings.Join(c.validate(), "\n")
+	for _, field := range []string{"mqtt.broker", "mqtt.topic", "mqtt.qos"} {
+		if !strings.Contains(errs, field) {
+			t.Errorf("expected a problem with %s, got %s", field, errs)
+		}
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NotifyConfig is the notify: section of the config file.  Every webhook
+// and push endpoint hears about each refresh that finds new listings.
+type NotifyConfig struct {
+	Timeout     duration        `yaml:"timeout"`
+	Retries     int             `yaml:"retries"`
+	BackoffBase duration        `yaml:"backoffBase"`
+	Webhooks    []WebhookConfig `yaml:"webhooks"`
+	Push        []PushConfig    `yaml:"push"`
+}
+
+// WebhookConfig is a URL that gets the refresh as JSON.  With a secret the
+// body is signed, X-Craigsmatrix-Signature: sha256=<hex HMAC of the body>.
+type WebhookConfig struct {
+	URL    string `yaml:"url"`
+	Secret string `yaml:"secret"`
+}
+
+// PushConfig is an ntfy topic URL or a gotify server
+type PushConfig struct {
+	Kind     string `yaml:"kind"` // ntfy or gotify
+	URL      string `yaml:"url"`
+	Token    string `yaml:"token"`
+	Priority int    `yaml:"priority"`
+}
+
+func defaultNotifyConfig() NotifyConfig {
+	return NotifyConfig{
+		Timeout:     duration(10 * time.Second),
+		Retries:     3,
+		BackoffBase: duration(2 * time.Second),
+	}
+}
+
+// validate returns one message per problem
+func (c NotifyConfig) validate() []string {
+	var errs []string
+	addErr := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, a...))
+	}
+
+	if c.Timeout <= 0 {
+		addErr("notify.timeout: must be positive")
+	}
+	if c.Retries < 0 {
+		addErr("notify.retries: must not be negative")
+	}
+	if c.BackoffBase <= 0 {
+		addErr("notify.backoffBase: must be positive")
+	}
+	for i, w := range c.Webhooks {
+		if !isHTTPURL(w.URL) {
+			addErr("notify.webhooks[%d].url: %q is not an http(s) URL", i, w.URL)
+		}
+	}
+	for i, p := range c.Push {
+		if !isHTTPURL(p.URL) {
+			addErr("notify.push[%d].url: %q is not an http(s) URL", i, p.URL)
+		}
+		switch p.Kind {
+		case "ntfy":
+		case "gotify":
+			if p.Token == "" {
+				addErr("notify.push[%d].token: gotify needs an application token", i)
+			}
+		default:
+			addErr("notify.push[%d].kind: %q should be ntfy or gotify", i, p.Kind)
+		}
+	}
+	return errs
+}
+
+// notifyTargetName is the URL without credentials or query, which may
+// hold tokens, for the logs
+func notifyTargetName(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "(bad url)"
+	}
+	return u.Scheme + "://" + u.Host + u.Path
+}
+
+func isHTTPURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// notifyBackend delivers one message somewhere
+type notifyBackend interface {
+	name() string
+	request(r TableRefresh) (*http.Request, error)
+}
+
+// Delivery is one entry of the delivery log
+type Delivery struct {
+	Time       time.Time `json:"time"`
+	Backend    string    `json:"backend"`
+	TableID    int       `json:"tableId"`
+	Listings   int       `json:"listings"`
+	Attempts   int       `json:"attempts"`
+	OK         bool      `json:"ok"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+var maxDeliveryLog = 200
+
+// Notifier sends refreshes with new listings to every backend.  Deliveries
+// run in the background so a slow endpoint never holds up a refresh.
+type Notifier struct {
+	backends []notifyBackend
+	retry    FetchSettings
+	client   *http.Client
+
+	mu  sync.Mutex
+	log []Delivery
+	wg  sync.WaitGroup
+}
+
+func newNotifier(c NotifyConfig) *Notifier {
+	n := &Notifier{
+		retry: FetchSettings{
+			Timeout:     time.Duration(c.Timeout),
+			MaxRetries:  c.Retries,
+			BackoffBase: time.Duration(c.BackoffBase),
+			BackoffMax:  time.Duration(c.BackoffBase) * 16,
+		},
+		client: &http.Client{Timeout: time.Duration(c.Timeout)},
+	}
+	for _, w := range c.Webhooks {
+		n.backends = append(n.backends, webhookBackend{w})
+	}
+	for _, p := range c.Push {
+		if p.Kind == "gotify" {
+			n.backends = append(n.backends, gotifyBackend{p})
+		} else {
+			n.backends = append(n.backends, ntfyBackend{p})
+		}
+	}
+	return n
+}
+
+var notifier *Notifier
+
+// setNotifier makes n the one that hears about refreshes, nil for none
+func setNotifier(n *Notifier) {
+	notifier = n
+	if n == nil || len(n.backends) == 0 {
+		setRefreshListener("notify", nil)
+		return
+	}
+	setRefreshListener("notify", n.notify)
+}
+
+// notify starts a delivery to each backend if the refresh found anything
+func (n *Notifier) notify(r TableRefresh) {
+	if r.newListingCount() == 0 {
+		return
+	}
+	for _, b := range n.backends {
+		n.wg.Add(1)
+		go func(b notifyBackend) {
+			defer n.wg.Done()
+			n.deliver(b, r)
+		}(b)
+	}
+}
+
+// wait blocks until every delivery started so far is done
+func (n *Notifier) wait() {
+	n.wg.Wait()
+}
+
+func (n *Notifier) deliver(b notifyBackend, r TableRefresh) {
+	d := Delivery{Time: time.Now(), Backend: b.name(), TableID: r.TableID, Listings: r.newListingCount()}
+
+	statusCode, err := withRetries(n.retry, func() (int, *FetchError) {
+		d.Attempts++
+		req, err := b.request(r)
+		if err != nil {
+			return 0, &FetchError{Kind: FetchErrorClient, URL: b.name(), Err: err}
+		}
+		resp, err := n.client.Do(req)
+		if err != nil {
+			return 0, classifyTransportError(b.name(), err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode, classifyResponse(b.name(), resp, "")
+	})
+
+	d.StatusCode = statusCode
+	d.OK = err == nil
+	if err != nil {
+		d.Error = err.Error()
+		warnf("notify %s: %v\n", b.name(), err)
+	} else {
+		debugf("notify %s: sent %d listings\n", b.name(), d.Listings)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.log = append(n.log, d)
+	if len(n.log) > maxDeliveryLog {
+		n.log = n.log[len(n.log)-maxDeliveryLog:]
+	}
+}
+
+// deliveries is the delivery log, newest first
+func (n *Notifier) deliveries() []Delivery {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	log := make([]Delivery, len(n.log))
+	for i, d := range n.log {
+		log[len(n.log)-1-i] = d
+	}
+	return log
+}
+
+// notificationTitle and notificationText are the human readable message
+// the push backends send
+func notificationTitle(r TableRefresh) string {
+	count := r.newListingCount()
+	plural := "s"
+	if count == 1 {
+		plural = ""
+	}
+	return fmt.Sprintf("%d new listing%s in %s", count, plural, strings.TrimSpace(r.TableName))
+}
+
+func notificationText(r TableRefresh) string {
+	var sb strings.Builder
+	for _, c := range r.cellsWithNewListings() {
+		fmt.Fprintf(&sb, "%s in %s:\n", c.Side, c.Top)
+		for _, l := range c.NewListings {
+			if l.HasPrice {
+				fmt.Fprintf(&sb, "  %s ($%d) %s\n", l.Title, l.Price, l.URL)
+			} else {
+				fmt.Fprintf(&sb, "  %s %s\n", l.Title, l.URL)
+			}
+		}
+	}
+	return strings.TrimRight(sb.String(), "\n")
+}
+
+// webhookPayload is the JSON a webhook receives
+type webhookPayload struct {
+	Event     string        `json:"event"`
+	TableID   int           `json:"tableId"`
+	TableName string        `json:"tableName"`
+	Time      time.Time     `json:"time"`
+	Cells     []CellRefresh `json:"cells"`
+}
+
+type webhookBackend struct {
+	cfg WebhookConfig
+}
+
+func (b webhookBackend) name() string {
+	return "webhook " + notifyTargetName(b.cfg.URL)
+}
+
+func (b webhookBackend) request(r TableRefresh) (*http.Request, error) {
+	body, err := json.Marshal(webhookPayload{
+		Event:     "new_listings",
+		TableID:   r.TableID,
+		TableName: r.TableName,
+		Time:      r.Time,
+		Cells:     r.cellsWithNewListings(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", b.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", politenessSettings.UserAgent)
+	if b.cfg.Secret != "" {
+		req.Header.Set("X-Craigsmatrix-Signature", "sha256="+webhookSignature(b.cfg.Secret, body))
+	}
+	return req, nil
+}
+
+// webhookSignature is the hex HMAC-SHA256 of body, for receivers to check
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ntfyBackend posts the message as plain text to an ntfy topic URL
+type ntfyBackend struct {
+	cfg PushConfig
+}
+
+func (b ntfyBackend) name() string {
+	return "ntfy " + notifyTargetName(b.cfg.URL)
+}
+
+func (b ntfyBackend) request(r TableRefresh) (*http.Request, error) {
+	req, err := http.NewRequest("POST", b.cfg.URL, strings.NewReader(notificationText(r)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Title", notificationTitle(r))
+	req.Header.Set("Tags", "craigsmatrix")
+	if cells := r.cellsWithNewListings(); len(cells) == 1 {
+		req.Header.Set("Click", cells[0].PageURL)
+	}
+	if b.cfg.Priority > 0 {
+		req.Header.Set("Priority", fmt.Sprint(b.cfg.Priority))
+	}
+	if b.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+b.cfg.Token)
+	}
+	return req, nil
+}
+
+// gotifyBackend posts to a gotify server's /message with an app token
+type gotifyBackend struct {
+	cfg PushConfig
+}
+
+func (b gotifyBackend) name() string {
+	return "gotify " + notifyTargetName(b.cfg.URL)
+}
+
+func (b gotifyBackend) request(r TableRefresh) (*http.Request, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"title":    notificationTitle(r),
+		"message":  notificationText(r),
+		"priority": b.cfg.Priority,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", strings.TrimRight(b.cfg.URL, "/")+"/message", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", b.cfg.Token)
+	return req, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// notifyReceiver is a stand-in webhook/ntfy/gotify server that records
+// every request and fails the first failures of them
+type notifyReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   []string
+	failures int
+}
+
+func startNotifyReceiver(failures int) *notifyReceiver {
+	rcv := &notifyReceiver{failures: failures}
+	rcv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		rcv.mu.Lock()
+		defer rcv.mu.Unlock()
+		rcv.requests = append(rcv.requests, r)
+		rcv.bodies = append(rcv.bodies, string(body))
+		if rcv.failures > 0 {
+			rcv.failures--
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	return rcv
+}
+
+func testNotifyConfig() NotifyConfig {
+	c := defaultNotifyConfig()
+	c.BackoffBase = duration(time.Millisecond)
+	return c
+}
+
+func sampleRefresh() TableRefresh {
+	return TableRefresh{
+		TableID:   3,
+		TableName: "furniture",
+		Time:      time.Now(),
+		Cells: []CellRefresh{
+			{Side: "desk", Top: "sfbay", PageURL: "https://sfbay.craigslist.org/search/sss?query=desk",
+				NewListings: []Listing{{Title: "Oak desk", URL: "https://sfbay.craigslist.org/d/oak/1.html", Price: 120, HasPrice: true}}},
+			{Side: "desk", Top: "boston", FirstFetch: true,
+				NewListings: []Listing{{Title: "Already there", URL: "https://boston.craigslist.org/d/x/2.html"}}},
+		},
+	}
+}
+
+func Test_notifier_webhookIsSigned(t *testing.T) {
+	rcv := startNotifyReceiver(0)
+	defer rcv.Close()
+
+	c := testNotifyConfig()
+	c.Webhooks = []WebhookConfig{{URL: rcv.URL + "/hook", Secret: "s3cret"}}
+	n := newNotifier(c)
+	n.notify(sampleRefresh())
+	n.wait()
+
+	if len(rcv.requests) != 1 {
+		t.Fatalf("expected one delivery, got %d", len(rcv.requests))
+	}
+	body := rcv.bodies[0]
+	if rcv.requests[0].Header.Get("X-Craigsmatrix-Signature") != "sha256="+webhookSignature("s3cret", []byte(body)) {
+		t.Fatalf("bad signature %q", rcv.requests[0].Header.Get("X-Craigsmatrix-Signature"))
+	}
+
+	var payload webhookPayload
+	if err := json.Unmarshal([]byte(body), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Event != "new_listings" || payload.TableID != 3 || len(payload.Cells) != 1 || payload.Cells[0].NewListings[0].Title != "Oak desk" {
+		t.Fatalf("first fetches shouldn't be in the payload: %+v", payload)
+	}
+}
+
+func Test_notifier_pushBackends(t *testing.T) {
+	rcv := startNotifyReceiver(0)
+	defer rcv.Close()
+
+	c := testNotifyConfig()
+	c.Push = []PushConfig{
+		{Kind: "ntfy", URL: rcv.URL + "/mytopic", Token: "tk", Priority: 4},
+		{Kind: "gotify", URL: rcv.URL + "/gotify/", Token: "app"},
+	}
+	n := newNotifier(c)
+	n.notify(sampleRefresh())
+	n.wait()
+
+	if len(rcv.requests) != 2 {
+		t.Fatalf("expected two deliveries, got %d", len(rcv.requests))
+	}
+	for i, r := range rcv.requests {
+		switch r.URL.Path {
+		case "/mytopic":
+			if r.Header.Get("Title") != "1 new listing in furniture" || r.Header.Get("Authorization") != "Bearer tk" ||
+				r.Header.Get("Priority") != "4" || !strings.Contains(rcv.bodies[i], "Oak desk ($120)") {
+				t.Fatalf("bad ntfy request %v %q", r.Header, rcv.bodies[i])
+			}
+		case "/gotify/message":
+			var msg map[string]interface{}
+			json.Unmarshal([]byte(rcv.bodies[i]), &msg)
+			if r.Header.Get("X-Gotify-Key") != "app" || msg["title"] != "1 new listing in furniture" {
+				t.Fatalf("bad gotify request %v %q", r.Header, rcv.bodies[i])
+			}
+		default:
+			t.Fatalf("unexpected request to %s", r.URL.Path)
+		}
+	}
+}
+
+func Test_notifier_retriesAndLogsDeliveries(t *testing.T) {
+	rcv := startNotifyReceiver(2)
+	defer rcv.Close()
+
+	c := testNotifyConfig()
+	c.Webhooks = []WebhookConfig{{URL: rcv.URL + "/hook?token=hidden"}}
+	n := newNotifier(c)
+	n.notify(sampleRefresh())
+	n.wait()
+
+	log := n.deliveries()
+	if len(log) != 1 || !log[0].OK || log[0].Attempts != 3 || log[0].Listings != 1 {
+		t.Fatalf("expected one delivery after two retries: %+v", log)
+	}
+	if strings.Contains(log[0].Backend, "hidden") {
+		t.Fatalf("the query string may hold a token and shouldn't be logged: %s", log[0].Backend)
+	}
+
+	rcv.failures = 10
+	n.notify(sampleRefresh())
+	n.wait()
+	log = n.deliveries()
+	if len(log) != 2 || log[0].OK || log[0].Attempts != c.Retries+1 || log[0].StatusCode != http.StatusBadGateway {
+		t.Fatalf("newest entry should be the failed delivery: %+v", log)
+	}
+}
+
+func Test_updateTableData_notifiesOnlyAboutNewListings(t *testing.T) {
+	stub := setUpStubTable(t, Listing{Title: "a", URL: "https://stub.example/1"})
+
+	rcv := startNotifyReceiver(0)
+	defer rcv.Close()
+	c := testNotifyConfig()
+	c.Webhooks = []WebhookConfig{{URL: rcv.URL}}
+	setNotifier(newNotifier(c))
+	defer setNotifier(nil)
+
+	updateTableData(0) // first fetch, nothing to announce
+	updateTableData(0) // nothing new
+	stub.listings = append(stub.listings, Listing{Title: "b", URL: "https://stub.example/2"})
+	updateTableData(0)
+	notifier.wait()
+
+	if len(rcv.bodies) != 1 || !strings.Contains(rcv.bodies[0], "https://stub.example/2") || strings.Contains(rcv.bodies[0], "https://stub.example/1\"") {
+		t.Fatalf("expected one notification about listing b, got %q", rcv.bodies)
+	}
+
+	rec := postAPI("/api/admin/notifications", `{}`)
+	expectStatus(t, rec, http.StatusOK)
+	var log []Delivery
+	if err := json.Unmarshal(rec.Body.Bytes(), &log); err != nil || len(log) != 1 || !log[0].OK {
+		t.Fatalf("delivery log not served: %s", rec.Body.String())
+	}
+}
+
+func Test_NotifyConfig_validate(t *testing.T) {
+	c := defaultNotifyConfig()
+	c.Webhooks = []WebhookConfig{{URL: "ftp://x"}}
+	c.Push = []PushConfig{{Kind: "pager", URL: "https://x.example"}, {Kind: "gotify", URL: "https://x.example"}}
+	errs := strings.Join(c.validate(), "\n")
+	for _, expected := range []string{"notify.webhooks[0].url", "notify.push[0].kind", "notify.push[1].token"} {
+		if !strings.Contains(errs, expected) {
+			t.Errorf("expected %s in %s", expected, errs)
+		}
+	}
+}
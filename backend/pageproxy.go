@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// PageProxySettings limits what the /api/ cell preview will fetch, so the
+// server can't be used as an open proxy into the local network
+type PageProxySettings struct {
+	// a host is allowed if it is one of these domains or a subdomain of one
+	AllowedHosts []string
+	// the URL path has to start with one of these
+	AllowedPaths []string
+	// only for testing against a fake craigslist on localhost
+	AllowPrivateAddresses bool
+}
+
+func defaultPageProxySettings() PageProxySettings {
+	return PageProxySettings{
+		AllowedHosts: []string{"craigslist.org"},
+		AllowedPaths: []string{"/search", "/d/"},
+	}
+}
+
+var pageProxySettings = defaultPageProxySettings()
+
+// PageProxyRefusal is why a preview URL was not fetched
+type PageProxyRefusal struct {
+	URL    string
+	Reason string
+}
+
+func (r *PageProxyRefusal) Error() string {
+	return fmt.Sprintf("refusing to fetch %q: %s", r.URL, r.Reason)
+}
+
+// lookupIPAddrs is swapped out in tests
+var lookupIPAddrs = net.DefaultResolver.LookupIPAddr
+
+var privateNetworks = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		fatal(err)
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func isPrivateIP(ip net.IP) bool {
+	if ip.IsUnspecified() || ip.IsMulticast() {
+		return true
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func hostAllowed(host string, allowed []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, domain := range allowed {
+		domain = strings.ToLower(strings.TrimPrefix(domain, "*."))
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// pathAllowed is true if p starts with one of the allowed prefixes.  A
+// prefix is a whole number of path segments, so /search allows /search
+// and /search/sss but not /searching.
+func pathAllowed(p string, allowed []string) bool {
+	for _, prefix := range allowed {
+		dir := strings.TrimSuffix(prefix, "/")
+		if p == dir || strings.HasPrefix(p, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanURLPath is p without . and .. segments, keeping a trailing slash.
+// An empty path stays empty.
+func cleanURLPath(p string) string {
+	if p == "" {
+		return p
+	}
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// checkPageProxyURL returns a *PageProxyRefusal unless rawURL is a search
+// page on an allowed host that resolves to public addresses only
+func checkPageProxyURL(rawURL string, s PageProxySettings) error {
+	refuse := func(format string, a ...interface{}) error {
+		return &PageProxyRefusal{URL: rawURL, Reason: fmt.Sprintf(format, a...)}
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return refuse("not a URL")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return refuse("only http and https are allowed")
+	}
+	if u.User != nil {
+		return refuse("credentials in the URL are not allowed")
+	}
+	host := u.Hostname()
+	if !hostAllowed(host, s.AllowedHosts) {
+		return refuse("host %s is not in the allowed list %v", host, s.AllowedHosts)
+	}
+	// the server would resolve /search/../account to /account, so the path
+	// has to be in its clean form to be judged by its prefix
+	if cleanURLPath(u.Path) != u.Path {
+		return refuse("the path can't have . or .. in it")
+	}
+	if !pathAllowed(u.Path, s.AllowedPaths) {
+		return refuse("only search pages are allowed")
+	}
+	if s.AllowPrivateAddresses {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = resolvePublicIPs(ctx, host)
+	if err != nil {
+		return refuse("%v", err)
+	}
+	return nil
+}
+
+// resolvePublicIPs looks host up, failing if any of its addresses is
+// private
+func resolvePublicIPs(ctx context.Context, host string) ([]net.IP, error) {
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := lookupIPAddrs(ctx, host)
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve %s: %v", host, err)
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("%s has no addresses", host)
+	}
+	for _, ip := range ips {
+		if isPrivateIP(ip) {
+			return nil, fmt.Errorf("%s resolves to private address %s", host, ip)
+		}
+	}
+	return ips, nil
+}
+
+// checkPageProxyURL only looks at the URL before the fetch.  The name can
+// resolve differently by the time we connect, and the page can redirect,
+// so makePageProxyRequest also checks every redirect, and its requests
+// carry the settings down to guardedDialContext, which checks the address
+// it actually connects to.
+
+type pageProxyGuardKey struct{}
+
+func withPageProxyGuard(ctx context.Context, s PageProxySettings) context.Context {
+	return context.WithValue(ctx, pageProxyGuardKey{}, s)
+}
+
+func pageProxyGuard(ctx context.Context) (PageProxySettings, bool) {
+	s, guarded := ctx.Value(pageProxyGuardKey{}).(PageProxySettings)
+	return s, guarded
+}
+
+// dialPageProxyAddress connects to an address that has been checked, and
+// is swapped out in tests
+var dialPageProxyAddress = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+
+// guardedDialContext resolves the host itself and only ever connects to
+// an address it has checked, so DNS can't change its answer in between
+func guardedDialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	s, _ := pageProxyGuard(ctx)
+	if s.AllowPrivateAddresses {
+		return dialPageProxyAddress(ctx, network, addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := resolvePublicIPs(ctx, host)
+	if err != nil {
+		return nil, &PageProxyRefusal{URL: addr, Reason: err.Error()}
+	}
+
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := dialPageProxyAddress(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// networkTransport is the bottom of the scrape chain.  Page proxy
+// requests get their own pool of connections, all made by
+// guardedDialContext; everything else goes through plain.  Through
+// outbound proxies the proxy does the resolving, so there only the URL
+// and redirect checks apply.
+type networkTransport struct {
+	plain   http.RoundTripper
+	guarded http.RoundTripper
+}
+
+func newNetworkTransport(proxies *ProxyTransport) networkTransport {
+	if proxies != nil {
+		return networkTransport{plain: proxies, guarded: proxies}
+	}
+	guarded := http.DefaultTransport.(*http.Transport).Clone()
+	guarded.Proxy = nil
+	guarded.DialContext = guardedDialContext
+	return networkTransport{plain: http.DefaultTransport, guarded: guarded}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t networkTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.plain
+	if _, guarded := pageProxyGuard(req.Context()); guarded {
+		next = t.guarded
+	}
+
+	req, cancel := startFetchTimeout(req)
+	resp, err := next.RoundTrip(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = fetchTimeoutBody{ReadCloser: resp.Body, ctx: req.Context(), cancel: cancel}
+	return resp, nil
+}
+
+// makePageProxyRequest is makeRequest for URLs that came from a user,
+// checked against s before the fetch, at every redirect and at every
+// connection
+func makePageProxyRequest(rawURL string, s PageProxySettings) (string, int, error) {
+	if err := checkPageProxyURL(rawURL, s); err != nil {
+		return "", 0, &FetchError{Kind: FetchErrorDisallowed, URL: rawURL, Err: err}
+	}
+	checkRedirect := func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return fmt.Errorf("stopped after 10 redirects")
+		}
+		return checkPageProxyURL(req.URL.String(), s)
+	}
+	return fetchURL(withPageProxyGuard(context.Background(), s), rawURL, checkRedirect)
+}
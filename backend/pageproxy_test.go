@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func fakeLookup(ips ...string) func(context.Context, string) ([]net.IPAddr, error) {
+	return func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		var addrs []net.IPAddr
+		for _, ip := range ips {
+			addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+		}
+		return addrs, nil
+	}
+}
+
+func Test_checkPageProxyURL_allowsCraigslistSearch(t *testing.T) {
+	lookupIPAddrs = fakeLookup("208.82.237.1")
+	defer func() { lookupIPAddrs = net.DefaultResolver.LookupIPAddr }()
+
+	for _, u := range []string{
+		"https://sfbay.craigslist.org/search/sss?query=desk",
+		"https://sfbay.craigslist.org/d/jobs/search/jjj?query=Welding",
+		makeCraigslistPageURL("welding", "boston", "jobs"),
+	} {
+		if err := checkPageProxyURL(u, defaultPageProxySettings()); err != nil {
+			t.Fatalf("%s should be allowed: %v", u, err)
+		}
+	}
+}
+
+func Test_checkPageProxyURL_refusals(t *testing.T) {
+	lookupIPAddrs = fakeLookup("208.82.237.1")
+	defer func() { lookupIPAddrs = net.DefaultResolver.LookupIPAddr }()
+
+	for _, u := range []string{
+		"http://localhost:8080/data/themodel.json",
+		"http://169.254.169.254/latest/meta-data/",
+		"https://craigslist.org.evil.com/search/sss",
+		"https://evilcraigslist.org/search/sss",
+		"file:///etc/passwd",
+		"https://sfbay.craigslist.org/account",
+		"https://user:pw@sfbay.craigslist.org/search/sss",
+		"https://sfbay.craigslist.org/search/../account",
+		"https://sfbay.craigslist.org/search/%2e%2e/account",
+		"https://sfbay.craigslist.org/searching",
+	} {
+		err := checkPageProxyURL(u, defaultPageProxySettings())
+		if _, ok := err.(*PageProxyRefusal); !ok {
+			t.Fatalf("%s should be refused, got %v", u, err)
+		}
+	}
+}
+
+func Test_checkPageProxyURL_refusesHostsResolvingToPrivateAddresses(t *testing.T) {
+	defer func() { lookupIPAddrs = net.DefaultResolver.LookupIPAddr }()
+
+	for _, ip := range []string{"127.0.0.1", "10.1.2.3", "192.168.0.10", "::1", "fd00::1"} {
+		lookupIPAddrs = fakeLookup("208.82.237.1", ip)
+		if err := checkPageProxyURL("https://sfbay.craigslist.org/search/sss", defaultPageProxySettings()); err == nil {
+			t.Fatalf("a host resolving to %s should be refused", ip)
+		}
+	}
+}
+
+// allowLocalPages lets the scraper fetch from test servers on localhost
+func allowLocalPages(t *testing.T) {
+	pageProxySettings = PageProxySettings{AllowedHosts: []string{"127.0.0.1"}, AllowedPaths: []string{"/"}, AllowPrivateAddresses: true}
+	t.Cleanup(func() { pageProxySettings = defaultPageProxySettings() })
+}
+
+// publicTestIP stands in for craigslist's address.  Connections to it go
+// to the test server instead, and every address actually dialed is kept.
+const publicTestIP = "203.0.113.7"
+
+func routePublicTestIPTo(t *testing.T, server *httptest.Server) *[]string {
+	var mu sync.Mutex
+	var dialed []string
+	serverAddress := server.Listener.Addr().String()
+	dialPageProxyAddress = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, addr)
+		mu.Unlock()
+		if strings.HasPrefix(addr, publicTestIP+":") {
+			addr = serverAddress
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	t.Cleanup(func() {
+		dialPageProxyAddress = (&net.Dialer{}).DialContext
+		lookupIPAddrs = net.DefaultResolver.LookupIPAddr
+	})
+	return &dialed
+}
+
+func expectRefusal(t *testing.T, err error) {
+	t.Helper()
+	var refusal *PageProxyRefusal
+	if !errors.As(err, &refusal) {
+		t.Fatalf("expected a refusal, got %v", err)
+	}
+}
+
+func Test_makePageProxyRequest_fetchesAllowedPages(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("results for " + r.URL.Query().Get("query")))
+	}))
+	defer server.Close()
+	routePublicTestIPTo(t, server)
+	lookupIPAddrs = fakeLookup(publicTestIP)
+
+	body, _, err := makePageProxyRequest("http://sfbay.craigslist.org/search/sss?query=desk", defaultPageProxySettings())
+	if err != nil || body != "results for desk" {
+		t.Fatalf("expected the page, got %q %v", body, err)
+	}
+}
+
+func Test_makePageProxyRequest_refusesRedirectsToPrivateAddresses(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("the internal server shouldn't be reached: %s", r.URL)
+	}))
+	defer internal.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, r.URL.Query().Get("to"), http.StatusFound)
+	}))
+	defer server.Close()
+	dialed := routePublicTestIPTo(t, server)
+
+	lookupIPAddrs = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		if host == "intranet.craigslist.org" {
+			return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, nil
+		}
+		return []net.IPAddr{{IP: net.ParseIP(publicTestIP)}}, nil
+	}
+
+	for _, to := range []string{
+		internal.URL + "/search/sss",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://intranet.craigslist.org:" + strings.Split(internal.Listener.Addr().String(), ":")[1] + "/search/sss",
+		"http://sfbay.craigslist.org/account",
+	} {
+		_, _, err := makePageProxyRequest("http://sfbay.craigslist.org/search/sss?to="+to, defaultPageProxySettings())
+		expectRefusal(t, err)
+	}
+	for _, addr := range *dialed {
+		if !strings.HasPrefix(addr, publicTestIP+":") {
+			t.Fatalf("dialed %s", addr)
+		}
+	}
+}
+
+func Test_makePageProxyRequest_refusesDNSRebinding(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("the internal server shouldn't be reached: %s", r.URL)
+	}))
+	defer internal.Close()
+	dialed := routePublicTestIPTo(t, internal)
+
+	// public for the check, loopback for the connection
+	lookups := 0
+	lookupIPAddrs = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		lookups++
+		if lookups == 1 {
+			return []net.IPAddr{{IP: net.ParseIP(publicTestIP)}}, nil
+		}
+		return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, nil
+	}
+
+	port := strings.Split(internal.Listener.Addr().String(), ":")[1]
+	_, _, err := makePageProxyRequest("http://sfbay.craigslist.org:"+port+"/search/sss", defaultPageProxySettings())
+	expectRefusal(t, err)
+	if lookups < 2 || len(*dialed) != 0 {
+		t.Fatalf("the connection should have looked again and refused: %d lookups, dialed %v", lookups, *dialed)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/temoto/robotstxt"
+)
+
+// PolitenessSettings keeps us from getting blocked by craigslist
+type PolitenessSettings struct {
+	RequestsPerMinute int
+	Burst             int
+	RespectRobotsTxt  bool
+	UserAgent         string
+}
+
+func defaultPolitenessSettings() PolitenessSettings {
+	return PolitenessSettings{
+		RequestsPerMinute: 20,
+		Burst:             3,
+		RespectRobotsTxt:  false,
+		UserAgent:         "craigsmatrix/1.0 (+https://github.com/bootladder/craigsmatrix)",
+	}
+}
+
+var politenessSettings = defaultPolitenessSettings()
+
+var robotsTxtTTL = 24 * time.Hour
+
+// PoliteTransport is a RoundTripper that sets our User-Agent, waits its turn
+// in a per-host rate limiter and, if asked to, honours robots.txt.
+type PoliteTransport struct {
+	settings PolitenessSettings
+	limiter  *hostRateLimiter
+	next     http.RoundTripper
+
+	mu     sync.Mutex
+	robots map[string]robotsTxtEntry
+}
+
+type robotsTxtEntry struct {
+	data      *robotstxt.RobotsData
+	fetchedAt time.Time
+}
+
+func newPoliteTransport(s PolitenessSettings, next http.RoundTripper) *PoliteTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &PoliteTransport{
+		settings: s,
+		limiter:  newHostRateLimiter(s.RequestsPerMinute, s.Burst),
+		next:     next,
+		robots:   map[string]robotsTxtEntry{},
+	}
+}
+
+// RoundTrip implements http.RoundTripper
+func (p *PoliteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	if p.settings.UserAgent != "" {
+		req.Header.Set("User-Agent", p.settings.UserAgent)
+	}
+
+	if p.settings.RespectRobotsTxt && !p.allowedByRobotsTxt(req) {
+		return nil, &FetchError{Kind: FetchErrorDisallowed, URL: req.URL.String()}
+	}
+
+	if err := p.limiter.wait(req, req.URL.Host); err != nil {
+		return nil, err
+	}
+	return p.next.RoundTrip(req)
+}
+
+func (p *PoliteTransport) allowedByRobotsTxt(req *http.Request) bool {
+	host := req.URL.Host
+
+	p.mu.Lock()
+	entry, found := p.robots[host]
+	p.mu.Unlock()
+
+	if !found || time.Since(entry.fetchedAt) > robotsTxtTTL {
+		entry = robotsTxtEntry{data: p.fetchRobotsTxt(req), fetchedAt: time.Now()}
+		p.mu.Lock()
+		p.robots[host] = entry
+		p.mu.Unlock()
+	}
+
+	if entry.data == nil {
+		return true
+	}
+	return entry.data.TestAgent(req.URL.EscapedPath(), p.settings.UserAgent)
+}
+
+// fetchRobotsTxt returns nil, which allows everything, when robots.txt
+// can't be fetched at all
+func (p *PoliteTransport) fetchRobotsTxt(req *http.Request) *robotstxt.RobotsData {
+	robotsURL := *req.URL
+	robotsURL.Path = "/robots.txt"
+	robotsURL.RawPath = ""
+	robotsURL.RawQuery = ""
+
+	robotsReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, robotsURL.String(), nil)
+	if err != nil {
+		return nil
+	}
+	robotsReq.Header.Set("User-Agent", p.settings.UserAgent)
+
+	if err := p.limiter.wait(robotsReq, robotsURL.Host); err != nil {
+		return nil
+	}
+	resp, err := p.next.RoundTrip(robotsReq)
+	if err != nil {
+		printf("robots.txt: %v\n", err)
+		return nil
+	}
+	defer resp.Body.Close()
+
+	data, err := robotstxt.FromResponse(resp)
+	if err != nil {
+		printf("robots.txt: %v\n", err)
+		return nil
+	}
+	return data
+}
+
+// hostRateLimiter is a token bucket per host
+type hostRateLimiter struct {
+	perSecond float64
+	burst     float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newHostRateLimiter(requestsPerMinute, burst int) *hostRateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &hostRateLimiter{
+		perSecond: float64(requestsPerMinute) / 60,
+		burst:     float64(burst),
+		buckets:   map[string]*tokenBucket{},
+	}
+}
+
+// reserve takes a token for host and says how long to wait before using it
+func (l *hostRateLimiter) reserve(host string) time.Duration {
+	if l.perSecond <= 0 {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, found := l.buckets[host]
+	if !found {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[host] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.perSecond
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	b.tokens--
+
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / l.perSecond * float64(time.Second))
+}
+
+func (l *hostRateLimiter) wait(req *http.Request, host string) error {
+	delay := l.reserve(host)
+	if delay == 0 {
+		return nil
+	}
+
+	printf("ratelimit: waiting %v for %s\n", delay, host)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-req.Context().Done():
+		l.unreserve(host)
+		return req.Context().Err()
+	}
+}
+
+// unreserve gives back the token reserve took, for a request that was
+// given up on before it was sent
+func (l *hostRateLimiter) unreserve(host string) {
+	if l.perSecond <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if b, found := l.buckets[host]; found && b.tokens < l.burst {
+		b.tokens++
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_hostRateLimiter_burstThenWait(t *testing.T) {
+	l := newHostRateLimiter(60, 2)
+
+	if l.reserve("a") != 0 || l.reserve("a") != 0 {
+		t.Fatalf("the burst should go through without waiting")
+	}
+	if d := l.reserve("a"); d < 900*time.Millisecond || d > time.Second {
+		t.Fatalf("third request at 60/min should wait about a second, got %v", d)
+	}
+	if l.reserve("b") != 0 {
+		t.Fatalf("hosts should have separate buckets")
+	}
+}
+
+func Test_hostRateLimiter_cancelledWaitGivesTheTokenBack(t *testing.T) {
+	l := newHostRateLimiter(60, 1)
+	l.reserve("a")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://a/", nil)
+	if err := l.wait(req, "a"); err == nil {
+		t.Fatalf("a cancelled wait should fail")
+	}
+
+	if d := l.reserve("a"); d > time.Second {
+		t.Fatalf("the cancelled request's token should have been given back, next wait is %v", d)
+	}
+}
+
+func Test_fetchURL_rateLimitWaitIsNotCountedAgainstTheTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(500 * time.Millisecond)
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	oldFetchSettings, oldTransport := fetchSettings, scrapeTransport
+	defer func() {
+		setFetchSettings(oldFetchSettings)
+		setScrapeTransport(oldTransport)
+	}()
+	s := fastFetchSettings()
+	s.Timeout = 200 * time.Millisecond
+	s.MaxRetries = 0
+	setFetchSettings(s)
+	// a token every 250ms, longer than the timeout
+	politeness := PolitenessSettings{RequestsPerMinute: 240, Burst: 2}
+	setScrapeTransport(newPoliteTransport(politeness, newNetworkTransport(nil)))
+
+	for i := 0; i < 5; i++ {
+		if _, _, err := makeRequest(server.URL + "/search"); err != nil {
+			t.Fatalf("request %d, past the burst, should wait its turn and not time out: %v", i, err)
+		}
+	}
+
+	_, _, err := makeRequest(server.URL + "/slow")
+	if fetchErr, ok := err.(*FetchError); !ok || fetchErr.Kind != FetchErrorTimeout {
+		t.Fatalf("a slow response should still time out, got %v", err)
+	}
+}
+
+func Test_politeTransport_setsUserAgent_andHonoursRobotsTxt(t *testing.T) {
+	var userAgent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			w.Write([]byte("User-agent: *\nDisallow: /private\n"))
+			return
+		}
+		userAgent = r.Header.Get("User-Agent")
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	settings := PolitenessSettings{RequestsPerMinute: 600, Burst: 10, RespectRobotsTxt: true, UserAgent: "testbot"}
+	client := http.Client{Transport: newPoliteTransport(settings, nil)}
+
+	resp, err := client.Get(server.URL + "/search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if userAgent != "testbot" {
+		t.Fatalf("expected the configured user agent, got %q", userAgent)
+	}
+
+	_, err = client.Get(server.URL + "/private/page")
+	if fetchErr := classifyTransportError("", err); fetchErr.Kind != FetchErrorDisallowed {
+		t.Fatalf("expected robots.txt to disallow /private, got %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxySettings routes all outbound scraping through HTTP or SOCKS5 proxies.
+// With Rotate set each request goes to the next proxy in turn, otherwise
+// the first healthy proxy in the list is used.
+type ProxySettings struct {
+	URLs   []string
+	Rotate bool
+}
+
+var proxySettings ProxySettings
+
+// a proxy that fails this many times in a row is skipped for proxyCooldown
+var proxyMaxConsecutiveFailures = 3
+var proxyCooldown = time.Minute
+
+var proxies *ProxyTransport
+
+func setProxies(p *ProxyTransport) {
+	proxies = p
+}
+
+// ProxyTransport is a RoundTripper that sends each request through one of
+// several proxies and keeps track of how healthy each one is.
+type ProxyTransport struct {
+	rotate bool
+
+	mu      sync.Mutex
+	proxies []*proxyState
+	next    int
+}
+
+type proxyState struct {
+	url       *url.URL
+	transport *http.Transport
+
+	requests            int
+	failures            int
+	consecutiveFailures int
+	lastError           string
+	lastUsed            time.Time
+	downUntil           time.Time
+}
+
+// ProxyHealth is what the diagnostics endpoint reports for each proxy
+type ProxyHealth struct {
+	URL                 string    `json:"url"`
+	Healthy             bool      `json:"healthy"`
+	Requests            int       `json:"requests"`
+	Failures            int       `json:"failures"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	LastError           string    `json:"lastError"`
+	LastUsed            time.Time `json:"lastUsed"`
+}
+
+func parseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return nil, fmt.Errorf("proxy %q: %v", raw, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("proxy %q: scheme must be http, https or socks5", raw)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy %q: missing host", raw)
+	}
+	return u, nil
+}
+
+func newProxyTransport(s ProxySettings) (*ProxyTransport, error) {
+	p := &ProxyTransport{rotate: s.Rotate}
+	for _, raw := range s.URLs {
+		u, err := parseProxyURL(raw)
+		if err != nil {
+			return nil, err
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = http.ProxyURL(u)
+		p.proxies = append(p.proxies, &proxyState{url: u, transport: transport})
+	}
+	if len(p.proxies) == 0 {
+		return nil, fmt.Errorf("no proxies configured")
+	}
+	return p, nil
+}
+
+// RoundTrip implements http.RoundTripper
+func (p *ProxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	proxy := p.pick()
+
+	resp, err := proxy.transport.RoundTrip(req)
+
+	failure := ""
+	if err != nil {
+		failure = err.Error()
+	} else if resp.StatusCode == http.StatusProxyAuthRequired {
+		failure = resp.Status
+	}
+	p.record(proxy, failure)
+
+	return resp, err
+}
+
+// pick returns the next proxy that isn't cooling down. If they all are,
+// the one that has been down the longest gets another chance.
+func (p *ProxyTransport) pick() *proxyState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	start := 0
+	if p.rotate {
+		start = p.next
+		p.next = (p.next + 1) % len(p.proxies)
+	}
+
+	fallback := p.proxies[start]
+	for i := range p.proxies {
+		proxy := p.proxies[(start+i)%len(p.proxies)]
+		if now.After(proxy.downUntil) {
+			proxy.lastUsed = now
+			return proxy
+		}
+		if proxy.downUntil.Before(fallback.downUntil) {
+			fallback = proxy
+		}
+	}
+	fallback.lastUsed = now
+	return fallback
+}
+
+func (p *ProxyTransport) record(proxy *proxyState, failure string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	proxy.requests++
+	if failure == "" {
+		proxy.consecutiveFailures = 0
+		return
+	}
+
+	printf("proxy %s: %s\n", redactedProxyURL(proxy.url), failure)
+	proxy.failures++
+	proxy.consecutiveFailures++
+	proxy.lastError = failure
+	if proxy.consecutiveFailures >= proxyMaxConsecutiveFailures {
+		proxy.downUntil = time.Now().Add(proxyCooldown)
+	}
+}
+
+func (p *ProxyTransport) health() []ProxyHealth {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	health := []ProxyHealth{}
+	for _, proxy := range p.proxies {
+		health = append(health, ProxyHealth{
+			URL:                 redactedProxyURL(proxy.url),
+			Healthy:             now.After(proxy.downUntil),
+			Requests:            proxy.requests,
+			Failures:            proxy.failures,
+			ConsecutiveFailures: proxy.consecutiveFailures,
+			LastError:           proxy.lastError,
+			LastUsed:            proxy.lastUsed,
+		})
+	}
+	return health
+}
+
+// redactedProxyURL keeps proxy passwords out of logs and diagnostics
+func redactedProxyURL(u *url.URL) string {
+	if u.User == nil {
+		return u.String()
+	}
+	redacted := *u
+	redacted.User = url.User(u.User.Username())
+	return redacted.String()
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// a stand-in forward proxy that answers every request itself
+func makeStandInProxy(name string, seen *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*seen = append(*seen, name+" "+r.URL.String())
+		w.Write([]byte(name))
+	}))
+}
+
+func Test_parseProxyURL_rejectsUnknownSchemes(t *testing.T) {
+	if _, err := parseProxyURL("ftp://localhost:21"); err == nil {
+		t.Fatalf("ftp proxies should be rejected")
+	}
+	if _, err := parseProxyURL("socks5://localhost:1080"); err != nil {
+		t.Fatalf("socks5 should be accepted: %v", err)
+	}
+}
+
+func Test_proxyTransport_rotatesBetweenProxies(t *testing.T) {
+	var seen []string
+	a := makeStandInProxy("a", &seen)
+	defer a.Close()
+	b := makeStandInProxy("b", &seen)
+	defer b.Close()
+
+	p, err := newProxyTransport(ProxySettings{URLs: []string{a.URL, b.URL}, Rotate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := http.Client{Transport: p}
+
+	var bodies []string
+	for i := 0; i < 4; i++ {
+		resp, err := client.Get("http://sfbay.craigslist.org/search/sss")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		bodies = append(bodies, string(body))
+	}
+
+	if bodies[0] != "a" || bodies[1] != "b" || bodies[2] != "a" || bodies[3] != "b" {
+		t.Fatalf("expected requests to alternate, got %v", bodies)
+	}
+	if seen[0] != "a http://sfbay.craigslist.org/search/sss" {
+		t.Fatalf("the proxy should see the absolute target URL, got %q", seen[0])
+	}
+}
+
+func Test_proxyTransport_skipsDeadProxy_andReportsIt(t *testing.T) {
+	var seen []string
+	dead := makeStandInProxy("dead", &seen)
+	dead.Close()
+	alive := makeStandInProxy("alive", &seen)
+	defer alive.Close()
+
+	p, err := newProxyTransport(ProxySettings{URLs: []string{dead.URL, alive.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := http.Client{Transport: p}
+
+	for i := 0; i < proxyMaxConsecutiveFailures; i++ {
+		client.Get("http://sfbay.craigslist.org/")
+	}
+	resp, err := client.Get("http://sfbay.craigslist.org/")
+	if err != nil {
+		t.Fatalf("should have fallen over to the live proxy: %v", err)
+	}
+	resp.Body.Close()
+
+	health := p.health()
+	if health[0].Healthy || health[0].Failures != proxyMaxConsecutiveFailures || health[0].LastError == "" {
+		t.Fatalf("dead proxy not reported: %+v", health[0])
+	}
+	if !health[1].Healthy || health[1].Requests != 1 {
+		t.Fatalf("live proxy not reported: %+v", health[1])
+	}
+}
+
+// makeStandInSOCKS5Proxy speaks just enough SOCKS5 to take a CONNECT,
+// with or without a username and password, and sends every connection on
+// to target whatever address was asked for.  It records user@address.
+func makeStandInSOCKS5Proxy(t *testing.T, target string, seen chan<- string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		read := func(n int) []byte {
+			b := make([]byte, n)
+			if _, err := io.ReadFull(r, b); err != nil {
+				panic(err)
+			}
+			return b
+		}
+		defer func() { recover() }()
+
+		greeting := read(2)
+		methods := read(int(greeting[1]))
+		user := ""
+		if bytes.IndexByte(methods, 2) >= 0 {
+			conn.Write([]byte{5, 2})
+			read(1)
+			user = string(read(int(read(1)[0])))
+			read(int(read(1)[0])) // password
+			conn.Write([]byte{1, 0})
+		} else {
+			conn.Write([]byte{5, 0})
+		}
+
+		request := read(4)
+		var host string
+		switch request[3] {
+		case 1:
+			host = net.IP(read(4)).String()
+		case 3:
+			host = string(read(int(read(1)[0])))
+		case 4:
+			host = net.IP(read(16)).String()
+		}
+		port := read(2)
+		seen <- fmt.Sprintf("%s@%s:%d", user, host, int(port[0])<<8|int(port[1]))
+
+		upstream, err := net.Dial("tcp", target)
+		if err != nil {
+			conn.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer upstream.Close()
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		go io.Copy(upstream, r)
+		io.Copy(conn, upstream)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func Test_proxyTransport_socks5(t *testing.T) {
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("through socks " + r.Host))
+	}))
+	defer site.Close()
+
+	seen := make(chan string, 2)
+	proxyAddress := makeStandInSOCKS5Proxy(t, site.Listener.Addr().String(), seen)
+
+	for _, proxyURL := range []string{"socks5://" + proxyAddress, "socks5://scraper:secret@" + proxyAddress} {
+		p, err := newProxyTransport(ProxySettings{URLs: []string{proxyURL}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := http.Client{Transport: p}
+		resp, err := client.Get("http://sfbay.craigslist.org/search/sss")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if string(body) != "through socks sfbay.craigslist.org" {
+			t.Fatalf("%s: got %q", proxyURL, body)
+		}
+		expected := "@sfbay.craigslist.org:80"
+		if strings.Contains(proxyURL, "scraper") {
+			expected = "scraper" + expected
+		}
+		if got := <-seen; got != expected {
+			t.Fatalf("%s: the proxy should be asked for %s, got %s", proxyURL, expected, got)
+		}
+		if health := p.health(); health[0].Requests != 1 || !health[0].Healthy {
+			t.Fatalf("%s: wrong health %+v", proxyURL, health)
+		}
+	}
+}
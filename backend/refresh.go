@@ -0,0 +1,72 @@
+package main
+
+import (
+	"time"
+)
+
+// TableRefresh is what a refresh of a whole table turned up.  Everything
+// that reacts to refreshes (notifications and the like) is handed one.
+type TableRefresh struct {
+	TableID   int           `json:"tableId"`
+	TableName string        `json:"tableName"`
+	Time      time.Time     `json:"time"`
+	Cells     []CellRefresh `json:"cells"`
+}
+
+// CellRefresh is one cell of a TableRefresh
+type CellRefresh struct {
+	Row         int       `json:"row"`
+	Col         int       `json:"col"`
+	Side        string    `json:"side"`
+	Top         string    `json:"top"`
+	PageURL     string    `json:"pageUrl"`
+	Hits        int       `json:"hits"`
+	ResultCount int       `json:"resultCount"`
+	Error       string    `json:"error,omitempty"`
+	NewListings []Listing `json:"newListings"`
+
+	// FirstFetch is set when the cell had never been fetched, so everything
+	// in it looks new and shouldn't be announced
+	FirstFetch bool `json:"firstFetch"`
+}
+
+// newListingCount counts the new listings worth announcing
+func (r TableRefresh) newListingCount() int {
+	n := 0
+	for _, c := range r.Cells {
+		if !c.FirstFetch {
+			n += len(c.NewListings)
+		}
+	}
+	return n
+}
+
+// cellsWithNewListings drops the cells with nothing to announce
+func (r TableRefresh) cellsWithNewListings() []CellRefresh {
+	cells := []CellRefresh{}
+	for _, c := range r.Cells {
+		if !c.FirstFetch && len(c.NewListings) > 0 {
+			cells = append(cells, c)
+		}
+	}
+	return cells
+}
+
+// refreshListeners are called after every table refresh has been written to
+// disk, keyed by name so each subsystem can replace its own.  They mustn't
+// block for long.
+var refreshListeners = map[string]func(TableRefresh){}
+
+func setRefreshListener(name string, f func(TableRefresh)) {
+	if f == nil {
+		delete(refreshListeners, name)
+		return
+	}
+	refreshListeners[name] = f
+}
+
+func announceRefresh(r TableRefresh) {
+	for _, f := range refreshListeners {
+		f(r)
+	}
+}
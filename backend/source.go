@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Source is somewhere listings come from.  A table picks one by name and a
+// cell can override it; craigslist is the default.
+type Source interface {
+	// Name is what tables and cells refer to the source by
+	Name() string
+	// QueryURL is the search page for one cell of a table
+	QueryURL(side, top string, filters SourceFilters) string
+	// Listings fetches a search page and returns what is on it
+	Listings(queryURL string) ([]Listing, error)
+}
+
+// SourceFilters narrows a search beyond its side and top headings.
+// A zero price means no limit.
+type SourceFilters struct {
+	Category string
+	MinPrice int
+	MaxPrice int
+}
+
+var defaultSourceName = "craigslist"
+
+var sources = map[string]Source{}
+
+func registerSource(s Source) {
+	sources[s.Name()] = s
+}
+
+func init() {
+	registerSource(craigslistSource{})
+}
+
+func lookupSource(name string) (Source, error) {
+	if name == "" {
+		name = defaultSourceName
+	}
+	s, found := sources[name]
+	if !found {
+		return nil, fmt.Errorf("there is no source called %q", name)
+	}
+	return s, nil
+}
+
+func sourceNames() []string {
+	names := []string{}
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (tm TableModel) sourceFilters() SourceFilters {
+	return SourceFilters{Category: tm.Category, MinPrice: tm.MinPrice, MaxPrice: tm.MaxPrice}
+}
+
+// cellSourceName is the cell's own source if it has one, else the table's
+func (tm TableModel) cellSourceName(cell CellModel) string {
+	if cell.Source != "" {
+		return cell.Source
+	}
+	if tm.Source != "" {
+		return tm.Source
+	}
+	return defaultSourceName
+}
+
+// cellPageURL is the search page for a cell under side and top
+func (tm TableModel) cellPageURL(cell CellModel, side, top string) string {
+	source, err := lookupSource(tm.cellSourceName(cell))
+	if err != nil {
+		warnf("table %d: %v\n", tm.ID, err)
+		return ""
+	}
+	return source.QueryURL(side, top, tm.sourceFilters())
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// stubSource answers with canned listings and remembers what it was asked
+type stubSource struct {
+	name     string
+	listings []Listing
+	err      error
+	queried  []string
+}
+
+func (s *stubSource) Name() string {
+	return s.name
+}
+
+func (s *stubSource) QueryURL(side, top string, filters SourceFilters) string {
+	return "https://stub.example/" + top + "?q=" + side
+}
+
+func (s *stubSource) Listings(queryURL string) ([]Listing, error) {
+	s.queried = append(s.queried, queryURL)
+	return s.listings, s.err
+}
+
+func registerStubSource(t *testing.T, s *stubSource) {
+	registerSource(s)
+	t.Cleanup(func() { delete(sources, s.name) })
+}
+
+// setUpStubTable is a fresh model whose table 0 searches a stub answering
+// with listings
+func setUpStubTable(t *testing.T, listings ...Listing) *stubSource {
+	resetModelForAPITest()
+	stub := &stubSource{name: "stub", listings: listings}
+	registerStubSource(t, stub)
+	if err := updateTableSource(0, "stub"); err != nil {
+		t.Fatal(err)
+	}
+	return stub
+}
+
+func Test_craigslistSource_QueryURL_addsPriceFilters(t *testing.T) {
+	got := craigslistSource{}.QueryURL("oak desk", "sfbay", SourceFilters{Category: "for sale", MinPrice: 10, MaxPrice: 200})
+	expected := "https://sfbay.craigslist.org/search/sss?query=oak+desk&min_price=10&max_price=200"
+	if got != expected {
+		t.Fatalf("expected %s, got %s", expected, got)
+	}
+
+	got = craigslistSource{}.QueryURL("welder", "boston", SourceFilters{Category: "jobs"})
+	if got != makeCraigslistPageURL("welder", "boston", "jobs") {
+		t.Fatalf("no filters should be the plain search page, got %s", got)
+	}
+}
+
+func Test_craigslistSource_refusesTopHeadingsThatArentSites(t *testing.T) {
+	for _, top := range []string{"127.0.0.1:8080/x?", "evil.com#", "sfbay.craigslist.org@evil.com", "", "-sfbay"} {
+		queryURL := craigslistSource{}.QueryURL("desk", top, SourceFilters{Category: "for sale", MaxPrice: 100})
+		if queryURL != "" {
+			t.Errorf("%q: expected no URL, got %s", top, queryURL)
+		}
+		if _, err := (craigslistSource{}).Listings(queryURL); err == nil {
+			t.Errorf("%q: expected an error", top)
+		}
+	}
+	if got := makeCraigslistPageURL("desk", " SFBay ", "for sale"); got != "https://sfbay.craigslist.org/search/sss?query=desk" {
+		t.Fatalf("site names should be lowercased, got %s", got)
+	}
+}
+
+func Test_craigslistSource_onlyFetchesWhatThePageProxyWould(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("the internal server shouldn't be reached: %s", r.URL)
+	}))
+	defer internal.Close()
+
+	_, err := craigslistSource{}.Listings(internal.URL + "/search/sss?query=desk")
+	expectRefusal(t, err)
+}
+
+func Test_lookupSource(t *testing.T) {
+	s, err := lookupSource("")
+	if err != nil || s.Name() != "craigslist" {
+		t.Fatalf("empty name should be craigslist, got %v %v", s, err)
+	}
+	if _, err := lookupSource("nowhere"); err == nil {
+		t.Fatal("expected an error for an unknown source")
+	}
+}
+
+func Test_cellSource_overridesTableSource(t *testing.T) {
+	resetModelForAPITest()
+	stub := &stubSource{name: "stub", listings: []Listing{{Title: "a", URL: "https://stub.example/1"}}}
+	registerStubSource(t, stub)
+
+	editTableModelField(0, 0, "desk", "side")
+	if err := updateCellSource(0, 0, 0, "stub"); err != nil {
+		t.Fatal(err)
+	}
+
+	cell, _ := model.lookupCell(0, 0, 0)
+	if cell.Source != "stub" || cell.PageURL != "https://stub.example/TopHeading?q=desk" {
+		t.Fatalf("cell should search the stub: %+v", cell)
+	}
+
+	updateTableData(0)
+	cell, _ = model.lookupCell(0, 0, 0)
+	if len(stub.queried) != 1 || cell.Hits != 1 || cell.Status != cellStatusOK {
+		t.Fatalf("refresh should have gone to the stub: %v %+v", stub.queried, cell)
+	}
+
+	// renaming a heading keeps the cell's own source
+	editTableModelField(0, 0, "chair", "side")
+	cell, _ = model.lookupCell(0, 0, 0)
+	if cell.Source != "stub" || cell.PageURL != "https://stub.example/TopHeading?q=chair" {
+		t.Fatalf("cell lost its source: %+v", cell)
+	}
+}
+
+func Test_refreshCell_sourceError_keepsHistory(t *testing.T) {
+	stub := setUpStubTable(t, Listing{Title: "a", URL: "https://stub.example/1"})
+	updateTableData(0)
+
+	stub.err = errors.New("down")
+	updateTableData(0)
+	cell, _ := model.lookupCell(0, 0, 0)
+	if cell.Status != cellStatusError || cell.Hits != 1 || len(cell.LinksAlreadySeen) != 1 {
+		t.Fatalf("a failed refresh should keep the old hits: %+v", cell)
+	}
+}
+
+func Test_api_updatesource(t *testing.T) {
+	resetModelForAPITest()
+	stub := &stubSource{name: "stub"}
+	registerStubSource(t, stub)
+
+	rec := postAPI("/api/updatesource", `{"tableId": 0, "source": "nowhere"}`)
+	expectStatus(t, rec, http.StatusBadRequest)
+
+	rec = postAPI("/api/updatesource", `{"tableId": 0, "source": "stub"}`)
+	expectStatus(t, rec, http.StatusOK)
+	table := decodeElmTableModel(t, rec)
+	if table["source"] != "stub" {
+		t.Fatalf("source not set: %v", table["source"])
+	}
+
+	rec = postAPI("/api/sources", `{}`)
+	expectStatus(t, rec, http.StatusOK)
+	if rec.Body.String() != "[\n  \"craigslist\",\n  \"stub\"\n]" {
+		t.Fatalf("unexpected source list %s", rec.Body.String())
+	}
+}
+
+func Test_api_updatefilters(t *testing.T) {
+	resetModelForAPITest()
+	editTableModelField(0, 0, "desk", "side")
+
+	rec := postAPI("/api/updatefilters", `{"tableId": 0, "minPrice": 50, "maxPrice": 10}`)
+	expectStatus(t, rec, http.StatusBadRequest)
+
+	rec = postAPI("/api/updatefilters", `{"tableId": 0, "minPrice": 10, "maxPrice": 50}`)
+	expectStatus(t, rec, http.StatusOK)
+	cell, _ := model.lookupCell(0, 0, 0)
+	if cell.PageURL != (craigslistSource{}).QueryURL("desk", "TopHeading", SourceFilters{MinPrice: 10, MaxPrice: 50}) {
+		t.Fatalf("filters not applied to the page URL: %s", cell.PageURL)
+	}
+}
@@ -1,16 +1,34 @@
 package main
 
 import (
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 	//"github.com/mmcdole/gofeed"
 )
 
 var defaultmodelpath = "./data/themodel.json"
 var model Model // = loadModelDataFile()
 
+// modelMu is held by whatever reads or writes the model, requests and
+// background work like the digest scheduler alike, but never across a
+// fetch or anything else that waits on the network
+var modelMu sync.Mutex
+
+// withModel runs f with modelMu held
+func withModel(f func()) {
+	modelMu.Lock()
+	defer modelMu.Unlock()
+	f()
+}
+
 var modelDiskWriter ModelDiskWriter
 
 func setModel(m Model) {
@@ -29,7 +47,7 @@ func loadModelDataFile() Model {
 
 	if err != nil {
 		//create new model, set the model and write to disk
-		fmt.Printf("Model not found. Creating a  new one " + defaultmodelpath + "\n")
+		printf("model not found, creating a new one at %s\n", defaultmodelpath)
 		fileReader, err = os.Create(defaultmodelpath)
 		model = makeNewModel()
 		modelDiskWriter.writeModelToDisk()
@@ -39,6 +57,7 @@ func loadModelDataFile() Model {
 
 	var themodel Model
 	json.Unmarshal(b, &themodel)
+	themodel.resolveSeenLinks()
 	return themodel
 }
 
@@ -50,21 +69,31 @@ func editTableModelField(tableID, fieldIndex int, fieldValue, fieldType string)
 	} else if fieldType == "side" {
 		tableModel.SideHeadings[fieldIndex] = fieldValue
 	} else {
-		fmt.Print("NO FIELD TYPE SUPPLIED. DOING NOTHING")
+		warnf("editTableModelField: field type %q should be top or side, doing nothing\n", fieldType)
 	}
 
+	rebuildRows(&tableModel)
+
+	writeTable(tableModel, tableID)
+}
+
+// rebuildRows lays out fresh cells for the current headings, keeping any
+// cell's own source
+func rebuildRows(tableModel *TableModel) {
+	oldRows := tableModel.Rows
 	tableModel.Rows = make([][]CellModel, len(tableModel.SideHeadings))
 	for i := range tableModel.Rows {
 		tableModel.Rows[i] = make([]CellModel, len(tableModel.TopHeadings))
 
 		for j := range tableModel.Rows[i] {
-			tableModel.Rows[i][j].PageURL =
-				makeCraigslistPageURL(tableModel.SideHeadings[i], tableModel.TopHeadings[j], tableModel.Category)
-			tableModel.Rows[i][j].Hits = -1
+			cell := makeNewCellModel()
+			if i < len(oldRows) && j < len(oldRows[i]) {
+				cell.Source = oldRows[i][j].Source
+			}
+			cell.PageURL = tableModel.cellPageURL(cell, tableModel.SideHeadings[i], tableModel.TopHeadings[j])
+			tableModel.Rows[i][j] = cell
 		}
 	}
-
-	writeTable(tableModel, tableID)
 }
 
 var categoryCodes = map[string]string{
@@ -72,42 +101,170 @@ var categoryCodes = map[string]string{
 	"jobs":     "jjj",
 }
 
-func makeCraigslistPageURL(side, top, category string) string {
-	return "https://" + top + ".craigslist.org/search/" + categoryCodes[category] + "?query=" + side
+// craigslistSiteURLTemplate is where a site's pages live, {site} being the
+// top heading.  Tests point it at a fake craigslist.
+var defaultCraigslistSiteURLTemplate = "https://{site}.craigslist.org"
+var craigslistSiteURLTemplate = defaultCraigslistSiteURLTemplate
+
+func setCraigslistSiteURLTemplate(t string) {
+	craigslistSiteURLTemplate = t
 }
 
-func updateTableData(tableID int) {
+// craigslistSiteName is what can go in {site}: a top heading like
+// "sfbay", never something that would change the host or path
+var craigslistSiteName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
 
-	tableModel := model.getTableModelByID(tableID)
+// makeCraigslistPageURL is "" when top isn't a craigslist site name
+func makeCraigslistPageURL(side, top, category string) string {
+	site := strings.ToLower(strings.TrimSpace(top))
+	if !craigslistSiteName.MatchString(site) {
+		return ""
+	}
+	siteURL := strings.Replace(craigslistSiteURLTemplate, "{site}", site, -1)
+	return siteURL + "/search/" + categoryCodes[category] + "?query=" + url.QueryEscape(side)
+}
 
+// updateTableData refreshes every cell of a table.  The cells are copied
+// out to be fetched and put back after, holding modelMu only for that, so
+// a cell whose search was changed in the meantime keeps the new search.
+// Refresh listeners are called with modelMu held.
+func updateTableData(tableID int) {
+	var tableModel TableModel
+	withModel(func() {
+		tableModel = model.getTableModelByID(tableID)
+		tableModel.Rows = copyRows(tableModel.Rows)
+	})
+	refresh := TableRefresh{TableID: tableID, TableName: tableModel.Name, Time: time.Now()}
+
+	var cellRefreshes []CellRefresh
 	for i := range tableModel.Rows {
 		for j := range tableModel.Rows[i] {
+			cell := &tableModel.Rows[i][j]
+			firstFetch := cell.Status != cellStatusOK && len(cell.LinksAlreadySeen) == 0
+
+			newListings, err := refreshCell(tableModel, cell)
+
+			cellRefresh := CellRefresh{
+				Row:         i,
+				Col:         j,
+				Side:        tableModel.SideHeadings[i],
+				Top:         tableModel.TopHeadings[j],
+				PageURL:     cell.PageURL,
+				Hits:        cell.Hits,
+				ResultCount: cell.ResultCount,
+				NewListings: newListings,
+				FirstFetch:  firstFetch,
+			}
+			if err != nil {
+				cellRefresh.Error = err.Error()
+				cellRefresh.NewListings = []Listing{}
+			}
+			cellRefreshes = append(cellRefreshes, cellRefresh)
+		}
+	}
 
-			searchUrl := tableModel.Rows[i][j].PageURL
-
-			results := getResultsFromCraigslistUrl(searchUrl)
-			fmt.Printf("There are %d search results\n", len(results))
-
-			var numberOfUnseenLinks = 0
-			for _, item := range results {
-				fmt.Print(item.Title)
-				if false == sliceContains(tableModel.Rows[i][j].LinksAlreadySeen, item.Url) {
-					numberOfUnseenLinks++
-				}
+	withModel(func() {
+		current, found := model.lookupTableModelByID(tableID)
+		if !found {
+			return
+		}
+		for _, c := range cellRefreshes {
+			if c.Row >= len(current.Rows) || c.Col >= len(current.Rows[c.Row]) {
+				continue
 			}
-			fmt.Printf("There are %d UNSEEN items\n", numberOfUnseenLinks)
+			fetched := tableModel.Rows[c.Row][c.Col]
+			cell := &current.Rows[c.Row][c.Col]
+			if cell.PageURL != fetched.PageURL || cell.Source != fetched.Source {
+				continue
+			}
+			*cell = fetched
+			refresh.Cells = append(refresh.Cells, c)
+		}
+		writeTable(current, tableID)
+		announceRefresh(refresh)
+	})
+}
 
-			tableModel.Rows[i][j].Hits = numberOfUnseenLinks
+// copyRows copies the cells, so they can be changed without touching the
+// model's
+func copyRows(rows [][]CellModel) [][]CellModel {
+	copied := make([][]CellModel, len(rows))
+	for i := range rows {
+		copied[i] = append([]CellModel{}, rows[i]...)
+	}
+	return copied
+}
 
-			tableModel.Rows[i][j].LinksAlreadySeen = make([]string, len(results))
-			for z, item := range results {
-				tableModel.Rows[i][j].LinksAlreadySeen[z] = item.Url
-			}
+// refreshCell fetches a cell from its source and records which listings
+// weren't there last time, which it returns
+func refreshCell(tableModel TableModel, cell *CellModel) ([]Listing, error) {
+	start := time.Now()
+	source, err := lookupSource(tableModel.cellSourceName(*cell))
+	var results []Listing
+	if err == nil {
+		results, err = source.Listings(cell.PageURL)
+	}
+	cell.LastFetched = start
+	cell.FetchDurationMs = int64(time.Since(start) / time.Millisecond)
 
+	if err != nil {
+		// keep the previous hits and seen links, the cell is just stale
+		warnf("Fetch failed for %s: %v\n", cell.PageURL, err)
+		cell.Status = cellStatusError
+		cell.LastError = err.Error()
+		return nil, err
+	}
+	debugf("There are %d search results\n", len(results))
+
+	newListings := []Listing{}
+	var newLinks []string
+	for _, item := range results {
+		debugf("%s\n", item.Title)
+		if !sliceContains(cell.LinksAlreadySeen, item.URL) {
+			newListings = append(newListings, item)
+			newLinks = append(newLinks, item.URL)
 		}
 	}
+	debugf("There are %d UNSEEN items\n", len(newListings))
+
+	cell.Hits = len(newListings)
+	cell.NewLinks = newLinks
+	cell.ResultCount = len(results)
+	cell.Status = cellStatusOK
+	cell.LastError = ""
+
+	recent := make([]SeenListing, 0, len(newListings)+len(cell.Recent))
+	for _, item := range newListings {
+		recent = append(recent, SeenListing{
+			ID: item.ID, Title: item.Title, URL: item.URL, Price: item.Price, HasPrice: item.HasPrice,
+			Posted: item.Date, FirstSeen: start,
+		})
+	}
+	recent = append(recent, cell.Recent...)
+	if len(recent) > maxRecentListingsPerCell {
+		recent = recent[:maxRecentListingsPerCell]
+	}
+	cell.Recent = recent
 
-	writeTable(tableModel, tableID)
+	cell.LinksAlreadySeen = make([]string, len(results))
+	for z, item := range results {
+		cell.LinksAlreadySeen[z] = item.URL
+	}
+	return newListings, nil
+}
+
+// findCellByPageURL looks through every table for the cell showing pageURL
+func findCellByPageURL(pageURL string) (CellModel, bool) {
+	for _, tableModel := range model.TableModels {
+		for i := range tableModel.Rows {
+			for j := range tableModel.Rows[i] {
+				if tableModel.Rows[i][j].PageURL == pageURL {
+					return tableModel.Rows[i][j], true
+				}
+			}
+		}
+	}
+	return CellModel{}, false
 }
 
 func sliceContains(slice []string, elem string) bool {
@@ -130,8 +287,11 @@ func addTopField(tableID int) {
 func addSideField(tableID int) {
 	tableModel := model.getTableModelByID(tableID)
 	tableModel.SideHeadings = append(tableModel.SideHeadings, "new field")
-	tableModel.Rows =
-		append(tableModel.Rows, make([]CellModel, len(tableModel.TopHeadings)))
+	newRow := make([]CellModel, len(tableModel.TopHeadings))
+	for j := range newRow {
+		newRow[j] = makeNewCellModel()
+	}
+	tableModel.Rows = append(tableModel.Rows, newRow)
 
 	writeTable(tableModel, tableID)
 }
@@ -161,7 +321,7 @@ func deleteSideField(tableID int) {
 func addTable() int {
 	numTables := len(model.TableModels)
 	//pick a unique ID
-	newTableID := numTables + 1
+	newTableID := nextTableID()
 	newTableModel := makeNewtableModel(newTableID)
 
 	model.TableModels = append(model.TableModels, newTableModel)
@@ -201,6 +361,49 @@ func updateTableCategory(category string) {
 	writeTable(tableModel, model.ActiveTableModelID)
 }
 
+// updateTableSource points a table at another source, which starts its
+// cells over
+func updateTableSource(tableID int, name string) error {
+	if _, err := lookupSource(name); err != nil {
+		return err
+	}
+	tableModel := model.getTableModelByID(tableID)
+	tableModel.Source = name
+	rebuildRows(&tableModel)
+	writeTable(tableModel, tableID)
+	return nil
+}
+
+// updateCellSource gives one cell its own source, or an empty name puts it
+// back on the table's
+func updateCellSource(tableID, row, col int, name string) error {
+	if name != "" {
+		if _, err := lookupSource(name); err != nil {
+			return err
+		}
+	}
+	tableModel := model.getTableModelByID(tableID)
+	if row < 0 || row >= len(tableModel.Rows) || col < 0 || col >= len(tableModel.Rows[row]) {
+		return fmt.Errorf("no cell at row %d col %d of table %d", row, col, tableID)
+	}
+
+	cell := makeNewCellModel()
+	cell.Source = name
+	cell.PageURL = tableModel.cellPageURL(cell, tableModel.SideHeadings[row], tableModel.TopHeadings[col])
+	tableModel.Rows[row][col] = cell
+	writeTable(tableModel, tableID)
+	return nil
+}
+
+// updateTableFilters sets the price range every cell searches with
+func updateTableFilters(tableID, minPrice, maxPrice int) {
+	tableModel := model.getTableModelByID(tableID)
+	tableModel.MinPrice = minPrice
+	tableModel.MaxPrice = maxPrice
+	rebuildRows(&tableModel)
+	writeTable(tableModel, tableID)
+}
+
 func listOfTableNamesAndIDsAsJSONBytes() []byte {
 
 	var namesandids []TableNameAndID
@@ -238,3 +441,162 @@ func modelToJSONBytes(tableID int) []byte {
 	contents, _ := json.MarshalIndent(tableModel, "", "  ")
 	return contents
 }
+
+// nextTableID is one more than the highest table ID, so it's unused even
+// after tables have been deleted
+func nextTableID() int {
+	next := 0
+	for _, tableModel := range model.TableModels {
+		if tableModel.ID >= next {
+			next = tableModel.ID + 1
+		}
+	}
+	return next
+}
+
+// parseHeadingList reads pasted headings: one per line, comma separated,
+// or CSV with quoted fields.  Blank entries and repeats, ignoring case, are
+// dropped.
+func parseHeadingList(text string) ([]string, error) {
+	r := csv.NewReader(strings.NewReader(text))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	// a quote inside a heading, like Toys "R" Us, is just a character
+	r.LazyQuotes = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var headings []string
+	for _, record := range records {
+		headings = appendNewHeadings(headings, record...)
+	}
+	return headings, nil
+}
+
+// appendNewHeadings adds the headings that aren't blank or already there,
+// ignoring case
+func appendNewHeadings(headings []string, more ...string) []string {
+	seen := map[string]bool{}
+	for _, h := range headings {
+		seen[strings.ToLower(h)] = true
+	}
+	for _, h := range more {
+		h = strings.TrimSpace(h)
+		if h == "" || seen[strings.ToLower(h)] {
+			continue
+		}
+		seen[strings.ToLower(h)] = true
+		headings = append(headings, h)
+	}
+	return headings
+}
+
+// updateHeadingsInBulk sets, or appends to, a table's top or side headings
+// from pasted text, then lays out the cells once for all of them
+func updateHeadingsInBulk(tableID int, axis, mode, text string) error {
+	if axis != "top" && axis != "side" {
+		return fmt.Errorf("axis %q should be top or side", axis)
+	}
+	if mode != "set" && mode != "append" {
+		return fmt.Errorf("mode %q should be set or append", mode)
+	}
+	parsed, err := parseHeadingList(text)
+	if err != nil {
+		return err
+	}
+
+	tableModel := model.getTableModelByID(tableID)
+	old := tableModel
+	headings := &tableModel.TopHeadings
+	if axis == "side" {
+		headings = &tableModel.SideHeadings
+	}
+	if mode == "set" {
+		*headings = parsed
+	} else {
+		*headings = appendNewHeadings(*headings, parsed...)
+	}
+	if len(*headings) == 0 {
+		return fmt.Errorf("no %s headings in %q", axis, text)
+	}
+
+	rebuildRowsByHeading(&tableModel, old)
+	writeTable(tableModel, tableID)
+	return nil
+}
+
+// rebuildRowsByHeading lays out the cells for the current headings, keeping
+// every cell, history and source included, whose side and top headings
+// were both already there in old.  The rest start over.
+func rebuildRowsByHeading(tableModel *TableModel, old TableModel) {
+	firstIndex := func(headings []string) map[string]int {
+		index := map[string]int{}
+		for i := len(headings) - 1; i >= 0; i-- {
+			index[headings[i]] = i
+		}
+		return index
+	}
+	oldSides, oldTops := firstIndex(old.SideHeadings), firstIndex(old.TopHeadings)
+
+	tableModel.Rows = make([][]CellModel, len(tableModel.SideHeadings))
+	for i, side := range tableModel.SideHeadings {
+		tableModel.Rows[i] = make([]CellModel, len(tableModel.TopHeadings))
+		for j, top := range tableModel.TopHeadings {
+			oldI, sideFound := oldSides[side]
+			oldJ, topFound := oldTops[top]
+			if sideFound && topFound && oldI < len(old.Rows) && oldJ < len(old.Rows[oldI]) {
+				tableModel.Rows[i][j] = old.Rows[oldI][oldJ]
+				continue
+			}
+			cell := makeNewCellModel()
+			cell.PageURL = tableModel.cellPageURL(cell, side, top)
+			tableModel.Rows[i][j] = cell
+		}
+	}
+}
+
+// cloneTable copies a table into a new ID and makes it the active one.
+// Without history the copy's cells start over as if never refreshed; its
+// headings, filters, cell sources, alert rules and digest settings are
+// the same either way.
+func cloneTable(tableID int, withHistory bool, name string) int {
+	original := model.getTableModelByID(tableID)
+
+	clone := original
+	clone.ID = nextTableID()
+	clone.Name = name
+	if strings.TrimSpace(name) == "" {
+		clone.Name = "Copy of " + strings.TrimSpace(original.Name)
+	}
+	clone.TopHeadings = append([]string{}, original.TopHeadings...)
+	clone.SideHeadings = append([]string{}, original.SideHeadings...)
+	clone.AlertRules = append([]AlertRule(nil), original.AlertRules...)
+	clone.Digest.Recipients = append([]string(nil), original.Digest.Recipients...)
+	clone.Digest.Pending = nil
+	if !clone.Digest.LastSent.IsZero() {
+		clone.Digest.LastSent = time.Now()
+	}
+
+	clone.Rows = make([][]CellModel, len(original.Rows))
+	for i := range original.Rows {
+		clone.Rows[i] = append([]CellModel{}, original.Rows[i]...)
+		for j, cell := range clone.Rows[i] {
+			clone.Rows[i][j].LinksAlreadySeen = append([]string{}, cell.LinksAlreadySeen...)
+			clone.Rows[i][j].NewLinks = append([]string(nil), cell.NewLinks...)
+			clone.Rows[i][j].Recent = append([]SeenListing(nil), cell.Recent...)
+		}
+	}
+	if withHistory {
+		clone.AlertHistory = append([]Alert(nil), original.AlertHistory...)
+	} else {
+		clone.AlertHistory = nil
+		rebuildRows(&clone)
+	}
+
+	model.TableModels = append(model.TableModels, clone)
+	model.ActiveTableModelID = clone.ID
+	modelDiskWriter.writeModelToDisk()
+	return clone.ID
+}
@@ -3,8 +3,13 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 
@@ -104,6 +109,17 @@ func Test_addTable_5times_allhavedifferentids(t *testing.T) {
 
 }
 
+func Test_addTable_afterDeletes_doesntReuseAnID(t *testing.T) {
+	clearModel_andSetMockModelDiskWriter()
+	setModel(makeNewModel())
+	model.TableModels = append(model.TableModels, makeNewtableModel(3))
+
+	addTable()
+	if id := model.ActiveTableModelID; id != 4 || model.TableModels[2].ID != 4 {
+		t.Fatalf("expected the new table to be 4, got %d", id)
+	}
+}
+
 func occurrencesOf(id int, ids []int) int {
 	count := 0
 	for _, v := range ids {
@@ -224,3 +240,231 @@ func Test_deleteTopField_works(t * testing.T){
 	addTopField(id)
 	deleteTopField(id)
 }
+
+func Test_updateTableData_recordsFetchStatusPerCell(t * testing.T){
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><body><ul>` +
+			`<li class="result-row"><a href="https://x.craigslist.org/1.html" class="result-title">one</a></li>` +
+			`<li class="result-row"><a href="https://x.craigslist.org/2.html" class="result-title">two</a></li>` +
+			`</ul></body></html>`))
+	}))
+	defer good.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer broken.Close()
+	allowLocalPages(t)
+
+	clearModel_andSetMockModelDiskWriter()
+	setModel(makeNewModel())
+	addTopField(0)
+	model.TableModels[0].Rows = [][]CellModel{{makeNewCellModel(), makeNewCellModel()}}
+	model.TableModels[0].Rows[0][0].PageURL = good.URL
+	model.TableModels[0].Rows[0][1].PageURL = broken.URL
+
+	updateTableData(0)
+
+	okCell := model.TableModels[0].Rows[0][0]
+	if okCell.Status != cellStatusOK || okCell.Hits != 2 || okCell.ResultCount != 2 || okCell.LastFetched.IsZero() {
+		t.Fatalf("good cell not recorded properly: %+v", okCell)
+	}
+
+	errCell := model.TableModels[0].Rows[0][1]
+	if errCell.Status != cellStatusError || errCell.LastError == "" || errCell.Hits != -1 {
+		t.Fatalf("broken cell should keep its hits and record the error: %+v", errCell)
+	}
+}
+
+func Test_updateTableData_doesntLockTheModelWhileFetching(t *testing.T) {
+	fetching, release := make(chan bool), make(chan bool)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetching <- true
+		<-release
+		w.Write([]byte(`<html><body><ul><li class="result-row"><a href="https://x.craigslist.org/1.html">one</a></li></ul></body></html>`))
+	}))
+	defer slow.Close()
+	allowLocalPages(t)
+
+	resetModelForAPITest()
+	model.TableModels[0].Rows = [][]CellModel{{makeNewCellModel()}}
+	model.TableModels[0].Rows[0][0].PageURL = slow.URL
+
+	done := make(chan bool)
+	go func() {
+		postAPI("/api/updatetabledata", `{"tableId": 0}`)
+		done <- true
+	}()
+	<-fetching
+
+	edited := make(chan int)
+	go func() {
+		edited <- postAPI("/api/fieldedit", `{"tableId": 0, "fieldIndex": 0, "fieldValue": "desk", "fieldType": "side"}`).Code
+	}()
+	select {
+	case code := <-edited:
+		if code != http.StatusOK {
+			t.Fatalf("the edit failed with %d", code)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("an edit should go through while a refresh is fetching")
+	}
+
+	close(release)
+	<-done
+	cell := model.TableModels[0].Rows[0][0]
+	if cell.PageURL == slow.URL || cell.Status == cellStatusOK {
+		t.Fatalf("the refresh shouldn't overwrite a cell whose search changed: %+v", cell)
+	}
+}
+
+func Test_loadModelDataFile_resolvesOldSeenLinks(t *testing.T) {
+	saved := makeNewModel()
+	saved.TableModels[0].Rows = [][]CellModel{{{
+		PageURL:          "https://sfbay.craigslist.org/search/tls?query=saw",
+		LinksAlreadySeen: []string{"/eby/tls/d/saw/1.html", "https://sfbay.craigslist.org/eby/tls/d/drill/2.html"},
+		NewLinks:         []string{"/eby/tls/d/saw/1.html"},
+	}}}
+	b, _ := json.Marshal(saved)
+	path := filepath.Join(t.TempDir(), "themodel.json")
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(p string) { defaultmodelpath = p }(defaultmodelpath)
+	defaultmodelpath = path
+
+	cell := loadModelDataFile().TableModels[0].Rows[0][0]
+	expected := "https://sfbay.craigslist.org/eby/tls/d/saw/1.html"
+	if cell.LinksAlreadySeen[0] != expected || cell.LinksAlreadySeen[1] != "https://sfbay.craigslist.org/eby/tls/d/drill/2.html" || cell.NewLinks[0] != expected {
+		t.Fatalf("links not resolved against the cell's page: %+v", cell)
+	}
+}
+
+func Test_parseHeadingList_linesCommasAndCSV(t *testing.T) {
+	for _, tc := range []struct{ text, expected string }{
+		{"sfbay\nlosangeles\n\nseattle\n", "sfbay|losangeles|seattle"},
+		{"sfbay, losangeles,seattle", "sfbay|losangeles|seattle"},
+		{`"electrician, licensed",plumber` + "\r\ncarpenter,Plumber", "electrician, licensed|plumber|carpenter"},
+		{"  ", ""},
+		{`Toys "R" Us, "Bed, Bath"` + "\n" + `Macy's`, `Toys "R" Us|Bed, Bath|Macy's`},
+	} {
+		headings, err := parseHeadingList(tc.text)
+		if err != nil || strings.Join(headings, "|") != tc.expected {
+			t.Errorf("%q: expected %s, got %v (%v)", tc.text, tc.expected, headings, err)
+		}
+	}
+}
+
+func Test_api_bulkheadings_setsAndAppendsInOneGo(t *testing.T) {
+	resetModelForAPITest()
+
+	rec := postAPI("/api/bulkheadings", `{"tableId": 0, "axis": "top", "mode": "set", "text": "sfbay\nseattle\nportland"}`)
+	expectStatus(t, rec, http.StatusOK)
+	rec = postAPI("/api/bulkheadings", `{"tableId": 0, "axis": "side", "mode": "append", "text": "plumber, SideHeading, electrician, plumber"}`)
+	expectStatus(t, rec, http.StatusOK)
+	if !mockModelDiskWriter.isWriteCalled() {
+		t.Fatal("headings not written to disk")
+	}
+
+	tableModel := model.getTableModelByID(0)
+	if strings.Join(tableModel.TopHeadings, ",") != "sfbay,seattle,portland" ||
+		strings.Join(tableModel.SideHeadings, ",") != "SideHeading,plumber,electrician" {
+		t.Fatalf("wrong headings %v %v", tableModel.TopHeadings, tableModel.SideHeadings)
+	}
+	if len(tableModel.Rows) != 3 || len(tableModel.Rows[2]) != 3 || !strings.Contains(tableModel.Rows[2][1].PageURL, "seattle") ||
+		!strings.Contains(tableModel.Rows[2][1].PageURL, "query=electrician") {
+		t.Fatalf("rows not rebuilt: %+v", tableModel.Rows)
+	}
+
+	for _, body := range []string{
+		`{"tableId": 0, "axis": "diagonal", "mode": "set", "text": "a"}`,
+		`{"tableId": 0, "axis": "top", "mode": "merge", "text": "a"}`,
+		`{"tableId": 0, "axis": "top", "mode": "set", "text": " , \n"}`,
+	} {
+		expectStatus(t, postAPI("/api/bulkheadings", body), http.StatusBadRequest)
+	}
+	if len(model.getTableModelByID(0).TopHeadings) != 3 {
+		t.Fatal("a refused request shouldn't change the table")
+	}
+}
+
+func Test_updateHeadingsInBulk_keepsCellsByHeading(t *testing.T) {
+	setUpFeedTable(t)
+	registerStubSource(t, &stubSource{name: "stub2"})
+	if err := updateCellSource(0, 1, 0, "stub2"); err != nil {
+		t.Fatal(err)
+	}
+	before := model.getTableModelByID(0)
+	chair := before.Rows[1][0]
+	chair.LinksAlreadySeen = []string{"https://stub.example/1"}
+	before.Rows[1][0] = chair
+	writeTable(before, 0)
+
+	// chair moves up, desk goes and lamp is new
+	if err := updateHeadingsInBulk(0, "side", "set", "chair\nlamp"); err != nil {
+		t.Fatal(err)
+	}
+	after := model.getTableModelByID(0)
+	if after.Rows[0][0].Source != "stub2" || len(after.Rows[0][0].LinksAlreadySeen) != 1 || after.Rows[0][0].Hits != chair.Hits {
+		t.Fatalf("chair's cell should have moved with its heading: %+v", after.Rows[0][0])
+	}
+	if lamp := after.Rows[1][0]; lamp.Source != "" || lamp.Status != cellStatusPending || len(lamp.LinksAlreadySeen) != 0 {
+		t.Fatalf("lamp's cell should start over, not take desk's place: %+v", lamp)
+	}
+
+	// appending keeps everything that was there; desk was removed, so it
+	// comes back empty
+	if err := updateHeadingsInBulk(0, "side", "append", "desk"); err != nil {
+		t.Fatal(err)
+	}
+	after = model.getTableModelByID(0)
+	if after.Rows[0][0].Source != "stub2" || len(after.Rows[0][0].LinksAlreadySeen) != 1 || after.Rows[2][0].Status != cellStatusPending {
+		t.Fatalf("append lost history: %+v", after.Rows)
+	}
+	if err := updateHeadingsInBulk(0, "top", "append", "sfbay"); err != nil {
+		t.Fatal(err)
+	}
+	after = model.getTableModelByID(0)
+	if len(after.Rows[0]) != 2 || len(after.Rows[0][0].LinksAlreadySeen) != 1 || after.Rows[0][1].Status != cellStatusPending {
+		t.Fatalf("adding a column lost history: %+v", after.Rows)
+	}
+}
+
+func Test_api_clonetable_withAndWithoutHistory(t *testing.T) {
+	setUpFeedTable(t)
+	if err := updateAlertRules(0, []AlertRule{{Name: "any", MinHits: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := postAPI("/api/clonetable", `{"tableId": 0}`)
+	expectStatus(t, rec, http.StatusOK)
+	fresh := model.getActiveTableModel()
+	rec = postAPI("/api/clonetable", `{"tableId": 0, "history": true, "name": "desks again"}`)
+	expectStatus(t, rec, http.StatusOK)
+	seasoned := model.getActiveTableModel()
+	original := model.getTableModelByID(0)
+
+	if fresh.ID == 0 || seasoned.ID == fresh.ID || fresh.Name != "Copy of New Table id 0" || seasoned.Name != "desks again" {
+		t.Fatalf("clones need new IDs and names: %d %q, %d %q", fresh.ID, fresh.Name, seasoned.ID, seasoned.Name)
+	}
+	for _, clone := range []TableModel{fresh, seasoned} {
+		if strings.Join(clone.SideHeadings, ",") != "desk,chair" || clone.Source != "stub" || len(clone.AlertRules) != 1 ||
+			clone.Rows[1][0].PageURL != original.Rows[1][0].PageURL {
+			t.Fatalf("clone %d isn't a copy: %+v", clone.ID, clone)
+		}
+	}
+	if fresh.Rows[0][0].Status != cellStatusPending || len(fresh.Rows[0][0].Recent) != 0 || len(fresh.AlertHistory) != 0 {
+		t.Fatalf("clone without history should start over: %+v", fresh.Rows[0][0])
+	}
+	if seasoned.Rows[0][0].Status != cellStatusOK || len(seasoned.Rows[0][0].LinksAlreadySeen) != 2 || len(seasoned.AlertHistory) != len(original.AlertHistory) {
+		t.Fatalf("clone with history lost it: %+v", seasoned.Rows[0][0])
+	}
+
+	// the copy is its own table
+	editTableModelField(seasoned.ID, 0, "lamp", "side")
+	if model.getTableModelByID(0).SideHeadings[0] != "desk" {
+		t.Fatal("editing the clone changed the original")
+	}
+
+	rec = postAPI("/api/clonetable", `{"tableId": 42}`)
+	expectStatus(t, rec, http.StatusNotFound)
+}
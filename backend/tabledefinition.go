@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// TableDefinition is a table as a document that can be handed to someone
+// else and imported into their craigsmatrix.  It has no ID, the importing
+// side picks one.  History is only there if it was asked for.
+type TableDefinition struct {
+	Version      int                    `json:"version" yaml:"version"`
+	Name         string                 `json:"name" yaml:"name"`
+	Category     string                 `json:"category,omitempty" yaml:"category,omitempty"`
+	Source       string                 `json:"source,omitempty" yaml:"source,omitempty"`
+	MinPrice     int                    `json:"minPrice,omitempty" yaml:"minPrice,omitempty"`
+	MaxPrice     int                    `json:"maxPrice,omitempty" yaml:"maxPrice,omitempty"`
+	TopHeadings  []string               `json:"topHeadings" yaml:"topHeadings"`
+	SideHeadings []string               `json:"sideHeadings" yaml:"sideHeadings"`
+	CellSources  []CellSourceDefinition `json:"cellSources,omitempty" yaml:"cellSources,omitempty"`
+	History      []CellHistory          `json:"history,omitempty" yaml:"history,omitempty"`
+}
+
+// the version of TableDefinition written now
+const tableDefinitionVersion = 1
+
+// CellSourceDefinition is a cell searching somewhere other than its table
+type CellSourceDefinition struct {
+	Row    int    `json:"row" yaml:"row"`
+	Col    int    `json:"col" yaml:"col"`
+	Source string `json:"source" yaml:"source"`
+}
+
+// CellHistory is what a cell has seen, so an imported table only shows
+// what's new since the export
+type CellHistory struct {
+	Row              int           `json:"row" yaml:"row"`
+	Col              int           `json:"col" yaml:"col"`
+	Hits             int           `json:"hits" yaml:"hits"`
+	Status           string        `json:"status" yaml:"status"`
+	LastFetched      time.Time     `json:"lastFetched" yaml:"lastFetched"`
+	ResultCount      int           `json:"resultCount" yaml:"resultCount"`
+	LinksAlreadySeen []string      `json:"linksAlreadySeen" yaml:"linksAlreadySeen"`
+	NewLinks         []string      `json:"newLinks,omitempty" yaml:"newLinks,omitempty"`
+	Recent           []SeenListing `json:"recent,omitempty" yaml:"recent,omitempty"`
+}
+
+func makeTableDefinition(tableModel TableModel, withHistory bool) TableDefinition {
+	d := TableDefinition{
+		Version:      tableDefinitionVersion,
+		Name:         strings.TrimSpace(tableModel.Name),
+		Category:     tableModel.Category,
+		Source:       tableModel.Source,
+		MinPrice:     tableModel.MinPrice,
+		MaxPrice:     tableModel.MaxPrice,
+		TopHeadings:  tableModel.TopHeadings,
+		SideHeadings: tableModel.SideHeadings,
+	}
+	for i := range tableModel.Rows {
+		for j, cell := range tableModel.Rows[i] {
+			if cell.Source != "" {
+				d.CellSources = append(d.CellSources, CellSourceDefinition{i, j, cell.Source})
+			}
+			if withHistory && cell.Status != cellStatusPending {
+				d.History = append(d.History, CellHistory{
+					Row: i, Col: j, Hits: cell.Hits, Status: cell.Status, LastFetched: cell.LastFetched,
+					ResultCount: cell.ResultCount, LinksAlreadySeen: cell.LinksAlreadySeen,
+					NewLinks: cell.NewLinks, Recent: cell.Recent,
+				})
+			}
+		}
+	}
+	return d
+}
+
+// validate returns one message per problem
+func (d TableDefinition) validate() []string {
+	var errs []string
+	if d.Version > tableDefinitionVersion {
+		errs = append(errs, fmt.Sprintf("version: %d is newer than this craigsmatrix understands", d.Version))
+	}
+	if strings.TrimSpace(d.Name) == "" {
+		errs = append(errs, "name: must not be empty")
+	}
+	if _, found := categoryCodes[d.Category]; d.Category != "" && !found {
+		errs = append(errs, fmt.Sprintf("category: %q should be one of %s", d.Category, strings.Join(categoryNames(), ", ")))
+	}
+	if _, err := lookupSource(d.Source); err != nil {
+		errs = append(errs, "source: "+err.Error())
+	}
+	if d.MinPrice < 0 || d.MaxPrice < 0 || (d.MaxPrice > 0 && d.MinPrice > d.MaxPrice) {
+		errs = append(errs, fmt.Sprintf("minPrice, maxPrice: %d to %d isn't a price range", d.MinPrice, d.MaxPrice))
+	}
+	errs = append(errs, validateHeadings("topHeadings", d.TopHeadings)...)
+	errs = append(errs, validateHeadings("sideHeadings", d.SideHeadings)...)
+
+	inTable := func(row, col int) bool {
+		return row >= 0 && row < len(d.SideHeadings) && col >= 0 && col < len(d.TopHeadings)
+	}
+	for i, c := range d.CellSources {
+		if !inTable(c.Row, c.Col) {
+			errs = append(errs, fmt.Sprintf("cellSources[%d]: no cell at row %d col %d", i, c.Row, c.Col))
+		}
+		if _, err := lookupSource(c.Source); c.Source == "" || err != nil {
+			errs = append(errs, fmt.Sprintf("cellSources[%d].source: %q is not a source", i, c.Source))
+		}
+	}
+	for i, h := range d.History {
+		if !inTable(h.Row, h.Col) {
+			errs = append(errs, fmt.Sprintf("history[%d]: no cell at row %d col %d", i, h.Row, h.Col))
+		}
+	}
+	return errs
+}
+
+func validateHeadings(where string, headings []string) []string {
+	var errs []string
+	if len(headings) == 0 {
+		errs = append(errs, where+": needs at least one heading")
+	}
+	seen := map[string]bool{}
+	for i, h := range headings {
+		if strings.TrimSpace(h) == "" {
+			errs = append(errs, fmt.Sprintf("%s[%d]: must not be empty", where, i))
+		} else if seen[h] {
+			errs = append(errs, fmt.Sprintf("%s[%d]: %q is there twice", where, i, h))
+		}
+		seen[h] = true
+	}
+	return errs
+}
+
+func categoryNames() []string {
+	var names []string
+	for name := range categoryCodes {
+		names = append(names, fmt.Sprintf("%q", name))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// marshalTableDefinition writes d as json or yaml
+func marshalTableDefinition(d TableDefinition, format string) ([]byte, error) {
+	switch format {
+	case "json", "":
+		return json.MarshalIndent(d, "", "  ")
+	case "yaml":
+		return yaml.Marshal(d)
+	}
+	return nil, fmt.Errorf("format %q should be json or yaml", format)
+}
+
+// parseTableDefinition reads a json or yaml document, refusing fields it
+// doesn't know.  With no format, a document starting with { is json.
+func parseTableDefinition(document []byte, format string) (TableDefinition, error) {
+	var d TableDefinition
+	if format == "" {
+		format = "yaml"
+		if bytes.HasPrefix(bytes.TrimSpace(document), []byte("{")) {
+			format = "json"
+		}
+	}
+	switch format {
+	case "json":
+		decoder := json.NewDecoder(bytes.NewReader(document))
+		decoder.DisallowUnknownFields()
+		return d, decoder.Decode(&d)
+	case "yaml":
+		return d, yaml.UnmarshalStrict(document, &d)
+	}
+	return d, fmt.Errorf("format %q should be json or yaml", format)
+}
+
+// importTableDefinition adds d as a new table and makes it the active one,
+// returning its ID
+func importTableDefinition(d TableDefinition) (int, error) {
+	if errs := d.validate(); len(errs) > 0 {
+		return 0, fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+
+	tableModel := makeNewtableModel(nextTableID())
+	tableModel.Name = strings.TrimSpace(d.Name)
+	tableModel.Category = d.Category
+	tableModel.Source = d.Source
+	tableModel.MinPrice = d.MinPrice
+	tableModel.MaxPrice = d.MaxPrice
+	tableModel.TopHeadings = append([]string{}, d.TopHeadings...)
+	tableModel.SideHeadings = append([]string{}, d.SideHeadings...)
+
+	// rebuildRows keeps each cell's source, so put them in first
+	tableModel.Rows = make([][]CellModel, len(d.SideHeadings))
+	for i := range tableModel.Rows {
+		tableModel.Rows[i] = make([]CellModel, len(d.TopHeadings))
+	}
+	for _, c := range d.CellSources {
+		tableModel.Rows[c.Row][c.Col].Source = c.Source
+	}
+	rebuildRows(&tableModel)
+
+	for _, h := range d.History {
+		cell := &tableModel.Rows[h.Row][h.Col]
+		cell.Hits = h.Hits
+		cell.Status = h.Status
+		cell.LastFetched = h.LastFetched
+		cell.ResultCount = h.ResultCount
+		cell.LinksAlreadySeen = h.LinksAlreadySeen
+		cell.NewLinks = h.NewLinks
+		cell.Recent = h.Recent
+		if cell.LinksAlreadySeen == nil {
+			cell.LinksAlreadySeen = []string{}
+		}
+	}
+
+	model.TableModels = append(model.TableModels, tableModel)
+	model.ActiveTableModelID = tableModel.ID
+	modelDiskWriter.writeModelToDisk()
+	return tableModel.ID, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func Test_api_exportAndImportTable_roundTrips(t *testing.T) {
+	setUpFeedTable(t)
+	updateTableCategory("for sale")
+	updateTableFilters(0, 50, 500)
+	registerStubSource(t, &stubSource{name: "stub2", listings: []Listing{{Title: "Teak chair", URL: "https://stub.example/9"}}})
+	if err := updateCellSource(0, 1, 0, "stub2"); err != nil {
+		t.Fatal(err)
+	}
+	updateTableData(0) // the filters started the cells over
+
+	for _, format := range []string{"json", "yaml"} {
+		for _, history := range []bool{false, true} {
+			req, _ := json.Marshal(exportTableRequest{TableID: 0, Format: format, History: history})
+			rec := postAPI("/api/exporttable", string(req))
+			expectStatus(t, rec, http.StatusOK)
+			document := rec.Body.String()
+			if strings.Contains(document, "linksAlreadySeen") != history {
+				t.Fatalf("%s history %v: history in the document? %s", format, history, document)
+			}
+
+			req, _ = json.Marshal(importTableRequest{Document: document})
+			rec = postAPI("/api/importtable", string(req))
+			expectStatus(t, rec, http.StatusOK)
+			imported := model.getActiveTableModel()
+			original := model.getTableModelByID(0)
+
+			if imported.ID == 0 || imported.Name != "New Table id 0" || imported.Category != "for sale" ||
+				imported.Source != "stub" || imported.MinPrice != 50 || imported.MaxPrice != 500 ||
+				strings.Join(imported.SideHeadings, ",") != "desk,chair" {
+				t.Fatalf("%s: wrong table %+v", format, imported)
+			}
+			if imported.Rows[1][0].Source != "stub2" || imported.Rows[1][0].PageURL != original.Rows[1][0].PageURL {
+				t.Fatalf("%s: cell source lost: %+v", format, imported.Rows[1][0])
+			}
+			cell := imported.Rows[0][0]
+			if history && (cell.Status != cellStatusOK || len(cell.LinksAlreadySeen) != 2 || len(cell.Recent) != 2 || imported.Rows[1][0].Recent[0].Title != "Teak chair" || !cell.Recent[0].FirstSeen.Equal(original.Rows[0][0].Recent[0].FirstSeen)) {
+				t.Fatalf("%s: history lost: %+v", format, cell)
+			}
+			if !history && cell.Status != cellStatusPending {
+				t.Fatalf("%s: cell should be waiting for its first refresh: %+v", format, cell)
+			}
+		}
+	}
+
+	ids := map[int]bool{}
+	for _, tableModel := range model.TableModels {
+		if ids[tableModel.ID] {
+			t.Fatalf("table ID %d used twice", tableModel.ID)
+		}
+		ids[tableModel.ID] = true
+	}
+}
+
+func Test_api_importTable_reportsEveryProblem(t *testing.T) {
+	resetModelForAPITest()
+
+	rec := postAPI("/api/importtable", `{"format": "yaml", "document": "name: \"\"\ncategory: boats\nsource: nowhere\ntopHeadings: [sfbay, sfbay]\nsideHeadings: []\nhistory: [{row: 3, col: 0}]\n"}`)
+	expectStatus(t, rec, http.StatusBadRequest)
+	for _, problem := range []string{"name:", "category:", "source:", "topHeadings[1]", "sideHeadings:", "history[0]"} {
+		if !strings.Contains(rec.Body.String(), problem) {
+			t.Errorf("expected %s in %s", problem, rec.Body.String())
+		}
+	}
+
+	rec = postAPI("/api/importtable", `{"document": "{\"name\": \"x\", \"colour\": \"red\"}"}`)
+	expectStatus(t, rec, http.StatusBadRequest)
+	if len(model.TableModels) != 1 {
+		t.Fatal("nothing should have been imported")
+	}
+
+	rec = postAPI("/api/exporttable", `{"tableId": 0, "format": "xml"}`)
+	expectStatus(t, rec, http.StatusBadRequest)
+	rec = postAPI("/api/exporttable", `{"tableId": 9}`)
+	expectStatus(t, rec, http.StatusNotFound)
+}
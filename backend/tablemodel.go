@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"net/url"
+	"time"
 )
 
 
@@ -25,7 +27,7 @@ func (m Model) getActiveTableModel() TableModel {
 			return tableModel
 		}
 	}
-	panic("getActiveTableModel could not find the TableModel")
+	panic(tableNotFoundError{m.ActiveTableModelID})
 }
 
 func (m Model) getTableModelByID(id int) TableModel{
@@ -35,7 +37,53 @@ func (m Model) getTableModelByID(id int) TableModel{
 			return tableModel
 		}
 	}
-	panic("getTableModelByID could not find the TableModel")
+	panic(tableNotFoundError{id})
+}
+
+func (m Model) lookupTableModelByID(id int) (TableModel, bool) {
+	for _, tableModel := range m.TableModels {
+		if tableModel.ID == id {
+			return tableModel, true
+		}
+	}
+	return TableModel{}, false
+}
+
+// resolveSeenLinks makes the links cells remember into listing URLs.
+// Models saved before that kept the hrefs as they were on the page.
+func (m *Model) resolveSeenLinks() {
+	for t := range m.TableModels {
+		for i := range m.TableModels[t].Rows {
+			for j := range m.TableModels[t].Rows[i] {
+				cell := &m.TableModels[t].Rows[i][j]
+				base, _ := url.Parse(cell.PageURL)
+				for k, link := range cell.LinksAlreadySeen {
+					cell.LinksAlreadySeen[k] = resolveListingLink(base, link)
+				}
+				for k, link := range cell.NewLinks {
+					cell.NewLinks[k] = resolveListingLink(base, link)
+				}
+			}
+		}
+	}
+}
+
+// lookupCell returns the cell at row, col of a table, if there is one
+func (m Model) lookupCell(tableID, row, col int) (CellModel, bool) {
+	tableModel, found := m.lookupTableModelByID(tableID)
+	if !found || row < 0 || row >= len(tableModel.Rows) || col < 0 || col >= len(tableModel.Rows[row]) {
+		return CellModel{}, false
+	}
+	return tableModel.Rows[row][col], true
+}
+
+// tableNotFoundError is what the get*TableModel functions panic with
+type tableNotFoundError struct {
+	id int
+}
+
+func (e tableNotFoundError) Error() string {
+	return fmt.Sprintf("could not find the TableModel with id %d", e.id)
 }
 
 // TableModel stores everything in a table
@@ -43,9 +91,16 @@ type TableModel struct {
 	Name         string        `json:"name"`
 	ID           int           `json:"id"`
 	Category     string        `json:"category"`
+	// Source is where the cells search, craigslist when empty
+	Source       string        `json:"source,omitempty"`
+	MinPrice     int           `json:"minPrice,omitempty"`
+	MaxPrice     int           `json:"maxPrice,omitempty"`
 	TopHeadings  []string      `json:"topHeadings"`
 	SideHeadings []string      `json:"sideHeadings"`
 	Rows         [][]CellModel `json:"rows"`
+	Digest       DigestSettings `json:"digest"`
+	AlertRules   []AlertRule    `json:"alertRules,omitempty"`
+	AlertHistory []Alert        `json:"alertHistory,omitempty"`
 }
 
 func makeNewtableModel(id int) TableModel {
@@ -62,8 +117,49 @@ func makeNewtableModel(id int) TableModel {
 type CellModel struct {
 	FeedURL          string `json:"feedUrl"`
 	PageURL          string `json:"pageUrl"`
+	// Source overrides the table's source for this cell
+	Source           string `json:"source,omitempty"`
 	Hits             int    `json:"hits"`
 	LinksAlreadySeen []string
+	// the links that were unseen at the last refresh
+	NewLinks []string `json:"newLinks,omitempty"`
+
+	// fetch status of the last refresh, so a broken cell can be told apart
+	// from a quiet one
+	Status          string    `json:"status"`
+	LastFetched     time.Time `json:"lastFetched"`
+	FetchDurationMs int64     `json:"fetchDurationMs"`
+	ResultCount     int       `json:"resultCount"`
+	LastError       string    `json:"lastError"`
+
+	// Recent is what the last few refreshes found new, newest first, which
+	// is what the feeds are made of
+	Recent []SeenListing `json:"recent,omitempty"`
+}
+
+// SeenListing is a listing as it looked when a refresh first found it
+type SeenListing struct {
+	ID        string    `json:"id" yaml:"id"`
+	Title     string    `json:"title" yaml:"title"`
+	URL       string    `json:"url" yaml:"url"`
+	Price     int       `json:"price" yaml:"price"`
+	HasPrice  bool      `json:"hasPrice" yaml:"hasPrice"`
+	Posted    time.Time `json:"posted" yaml:"posted"`
+	FirstSeen time.Time `json:"firstSeen" yaml:"firstSeen"`
+}
+
+// a cell remembers this many of the listings it found new
+var maxRecentListingsPerCell = 50
+
+// values of CellModel.Status.  An empty status is the same as pending.
+const (
+	cellStatusPending = "pending"
+	cellStatusOK      = "ok"
+	cellStatusError   = "error"
+)
+
+func makeNewCellModel() CellModel {
+	return CellModel{Hits: -1, Status: cellStatusPending}
 }
 
 // TableNameAndID  is used so the frontend can populate the dropdown
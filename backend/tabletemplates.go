@@ -0,0 +1,47 @@
+package main
+
+import "fmt"
+
+// tableTemplates are ready-to-refresh tables to start from instead of
+// "New Table id N".  The top headings are craigslist sites.
+var tableTemplates = []TableDefinition{
+	{
+		Name:         "West Coast trades jobs",
+		Category:     "jobs",
+		TopHeadings:  []string{"seattle", "portland", "sfbay", "sacramento", "losangeles", "sandiego"},
+		SideHeadings: []string{"electrician", "plumber", "carpenter", "welder", "hvac", "roofer"},
+	},
+	{
+		Name:         "Bay Area furniture",
+		Category:     "for sale",
+		MaxPrice:     1000,
+		TopHeadings:  []string{"sfbay", "santacruz", "monterey", "stockton", "sacramento"},
+		SideHeadings: []string{"desk", "couch", "dresser", "bookshelf", "dining table", "office chair"},
+	},
+	{
+		Name:         "Cars in major metros",
+		Category:     "for sale",
+		MinPrice:     2000,
+		TopHeadings:  []string{"newyork", "losangeles", "chicago", "houston", "phoenix", "sfbay"},
+		SideHeadings: []string{"toyota tacoma", "honda civic", "subaru outback", "ford f-150", "tesla model 3"},
+	},
+}
+
+func lookupTableTemplate(name string) (TableDefinition, error) {
+	for _, t := range tableTemplates {
+		if t.Name == name {
+			return t, nil
+		}
+	}
+	return TableDefinition{}, fmt.Errorf("there is no table template called %q", name)
+}
+
+// addTableFromTemplate creates a table from the named template and makes
+// it the active one
+func addTableFromTemplate(name string) (int, error) {
+	t, err := lookupTableTemplate(name)
+	if err != nil {
+		return 0, err
+	}
+	return importTableDefinition(t)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func Test_tableTemplates_areValid(t *testing.T) {
+	for _, template := range tableTemplates {
+		if errs := template.validate(); len(errs) > 0 {
+			t.Errorf("%s: %s", template.Name, strings.Join(errs, "; "))
+		}
+	}
+}
+
+func Test_api_addtablefromtemplate(t *testing.T) {
+	resetModelForAPITest()
+
+	rec := postAPI("/api/tabletemplates", `{}`)
+	expectStatus(t, rec, http.StatusOK)
+	var templates []TableDefinition
+	if err := json.Unmarshal(rec.Body.Bytes(), &templates); err != nil || len(templates) != len(tableTemplates) {
+		t.Fatalf("templates not listed: %s", rec.Body.String())
+	}
+
+	rec = postAPI("/api/addtablefromtemplate", `{"template": "Cars in major metros"}`)
+	expectStatus(t, rec, http.StatusOK)
+	tableModel := model.getActiveTableModel()
+	if tableModel.ID == 0 || tableModel.Name != "Cars in major metros" || tableModel.MinPrice != 2000 {
+		t.Fatalf("wrong table %+v", tableModel)
+	}
+	cell := tableModel.Rows[0][0]
+	if cell.Status != cellStatusPending || !strings.Contains(cell.PageURL, "newyork") || !strings.Contains(cell.PageURL, "min_price=2000") {
+		t.Fatalf("table should be ready to refresh: %+v", cell)
+	}
+
+	// a second one is a separate table
+	postAPI("/api/addtablefromtemplate", `{"template": "Cars in major metros"}`)
+	if len(model.TableModels) != 3 || model.getActiveTableModel().ID == tableModel.ID {
+		t.Fatalf("expected three tables, got %d", len(model.TableModels))
+	}
+
+	rec = postAPI("/api/addtablefromtemplate", `{"template": "Boats"}`)
+	expectStatus(t, rec, http.StatusNotFound)
+}
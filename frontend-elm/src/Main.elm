@@ -155,7 +155,7 @@ update msg model =
 
                 Err e ->
                     ( { model
-                        | craigslistPageHtmlString = "FAIL"
+                        | craigslistPageHtmlString = "FAIL: " ++ httpErrorToString e
                       }
                     , Cmd.none
                     )
@@ -299,7 +299,7 @@ httpErrorToString e =
             "Network Error"
 
         Http.BadStatus i ->
-            "Bad status"
+            "Bad status " ++ String.fromInt i
 
         Http.BadUrl s ->
             s
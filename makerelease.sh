@@ -7,13 +7,12 @@ echo cd into frontend
 cd frontend-elm
 echo build frontend
 ./runner.sh
-echo copy main.js to release
-cp main.js ../release
 echo cd -
 cd -
 
-echo copy frontend-static into release
-cp frontend-static/* release
+echo copy frontend into backend/webroot to be embedded
+cp frontend-static/* backend/webroot
+cp frontend-elm/main.js backend/webroot
 
 echo cd into backend
 cd backend
@@ -27,6 +26,7 @@ GOOS=windows go build
 
 echo copy backend to release
 cp craigsmatrix.exe craigsmatrix-mac craigsmatrix-linux ../release
+cp craigsmatrix.example.yaml ../release
 cd -
 
 echo "create data directory"